@@ -0,0 +1,38 @@
+package main
+
+import "sync/atomic"
+
+// AG 的选择策略，与 XFS 相同：
+//   - 新目录轮流放在各个 AG 中，使不相关的目录树分散开
+//   - 文件和其他 inode 放在父目录所在的 AG 中，同一目录下的文件相互靠近
+//   - 选中的 AG 没有足够的连续空间时依次尝试其他 AG
+
+// NextDirAg 返回下一个新目录所在的 AG
+func (mp *MountPoint) NextDirAg() uint32 {
+	mp.agsMu.RLock()
+	defer mp.agsMu.RUnlock()
+	return (atomic.AddUint32(&mp.dirRotor, 1) - 1) % uint32(len(mp.AgCtx))
+}
+
+// AllocNear 优先在 AG agno 中分配 nblock 个连续的块，空间不足时从下一个 AG 开始依次尝试其他 AG
+func (mp *MountPoint) AllocNear(agno uint32, nblock uint64) (uint64, error) {
+	return mp.allocNear(agno, nblock, false)
+}
+
+// AllocInode 同 AllocNear，第一块用作 inode，计入所在 AG 的 inode 数
+func (mp *MountPoint) AllocInode(agno uint32, nblock uint64) (uint64, error) {
+	return mp.allocNear(agno, nblock, true)
+}
+
+func (mp *MountPoint) allocNear(agno uint32, nblock uint64, inode bool) (uint64, error) {
+	mp.agsMu.RLock()
+	defer mp.agsMu.RUnlock()
+	agcount := uint32(len(mp.AgCtx))
+	for i := uint32(0); i < agcount; i++ {
+		blkno, err := mp.allocBlock((agno+i)%agcount, nblock, inode)
+		if err != ErrNoSpace {
+			return blkno, err
+		}
+	}
+	return 0, ErrNoSpace
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAgAllocPolicy(t *testing.T) {
+	// 4 个 AG，每个 512 块
+	dev, err := NewMemBlockDevice(2048, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{AgCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 目录轮流放在各个 AG 中
+	var dirs []*InoContext
+	for i := 0; i < 4; i++ {
+		dir, err := fs.mkdir(root, fmt.Sprintf("d%d", i), 0755, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if agno := fs.mp.BlockAg(dir.ino); agno != uint32(i) {
+			t.Errorf("directory #%d in AG %d", i, agno)
+		}
+		dirs = append(dirs, dir)
+	}
+	// 文件放在父目录的 AG 中，放不下时换到下一个 AG
+	spilled := false
+	for i := 0; i < 16; i++ {
+		file, err := fs.createFile(dirs[1], fmt.Sprintf("f%d", i), S_IFREG|0644, 0, 0, 0, 40*DefaultBlockSize)
+		if err != nil {
+			t.Fatalf("create #%d: %v", i, err)
+		}
+		switch agno := fs.mp.BlockAg(file.ino); {
+		case agno == 2:
+			spilled = true
+		case agno != 1 || spilled:
+			t.Fatalf("file #%d in AG %d", i, agno)
+		}
+	}
+	if !spilled {
+		t.Error("AG 1 never filled up")
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
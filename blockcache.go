@@ -0,0 +1,298 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Syncer 由能把已写入的数据持久化的块设备实现
+type Syncer interface {
+	Sync() error
+}
+
+// CacheStats 是缓存的统计信息
+type CacheStats struct {
+	Hits       uint64
+	Misses     uint64
+	Writebacks uint64 // 写回下层设备的块数
+	Cached     int
+	Dirty      int
+}
+
+type cacheEntry struct {
+	blkno uint64
+	data  []byte
+	dirty bool
+}
+
+// CachedBlockDevice 是 BlockDevice 之上的 LRU 写回缓存
+//   - 写入只修改缓存并标记为脏，被淘汰、定期写回或 Sync 时才写到下层设备
+//   - 读写都复制数据，调用者可以随意修改拿到的块
+type CachedBlockDevice struct {
+	mu       sync.Mutex
+	dev      BlockDevice
+	capacity int        // 最多缓存的块数
+	lru      *list.List // 越靠前越近使用，元素为 *cacheEntry
+	entries  map[uint64]*list.Element
+	stats    CacheStats
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewCachedBlockDevice 在 dev 之上创建缓存，budget 是缓存数据占用的内存上限（字节）
+func NewCachedBlockDevice(dev BlockDevice, budget uint64) *CachedBlockDevice {
+	capacity := int(budget / uint64(dev.GetBlockSize()))
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &CachedBlockDevice{
+		dev:      dev,
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[uint64]*list.Element),
+	}
+}
+
+// StartWriteback 启动后台写回，每隔 interval 把脏块写到下层设备
+func (c *CachedBlockDevice) StartWriteback(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil || interval <= 0 {
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func(stop chan struct{}, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := c.Flush(); err != nil {
+					logrus.Errorf("block cache writeback failed: %v", err)
+				}
+			}
+		}
+	}(c.stop, c.done)
+}
+
+// StopWriteback 停止后台写回，不会写回脏块
+func (c *CachedBlockDevice) StopWriteback() {
+	c.mu.Lock()
+	stop, done := c.stop, c.done
+	c.stop, c.done = nil, nil
+	c.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (c *CachedBlockDevice) ReadBlock(blockno uint64) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent, err := c.get(blockno)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(ent.data))
+	copy(data, ent.data)
+	c.evictOnRead()
+	return data, nil
+}
+
+func (c *CachedBlockDevice) WriteBlock(blockno uint64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(data) != int(c.dev.GetBlockSize()) {
+		return ErrInvalidArgument
+	}
+	if blockno >= uint64(c.dev.GetTotalBlockCount()) {
+		return ErrOutOfRange
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	c.put(blockno, buf)
+	return c.evict()
+}
+
+// Read 读取从字节偏移 offset 开始的数据，经过缓存
+func (c *CachedBlockDevice) Read(offset uint64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bs := uint64(c.dev.GetBlockSize())
+	for done := uint64(0); done < uint64(len(data)); {
+		pos := offset + done
+		ent, err := c.get(pos / bs)
+		if err != nil {
+			return err
+		}
+		done += uint64(copy(data[done:], ent.data[pos%bs:]))
+	}
+	c.evictOnRead()
+	return nil
+}
+
+// Write 写入从字节偏移 offset 开始的数据，经过缓存
+func (c *CachedBlockDevice) Write(offset uint64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bs := uint64(c.dev.GetBlockSize())
+	for done := uint64(0); done < uint64(len(data)); {
+		pos := offset + done
+		ent, err := c.get(pos / bs)
+		if err != nil {
+			return err
+		}
+		done += uint64(copy(ent.data[pos%bs:], data[done:]))
+		if !ent.dirty {
+			ent.dirty = true
+			c.stats.Dirty++
+		}
+	}
+	return c.evict()
+}
+
+func (c *CachedBlockDevice) GetTotalBlockCount() uint32 {
+	return c.dev.GetTotalBlockCount()
+}
+
+func (c *CachedBlockDevice) GetBlockSize() uint32 {
+	return c.dev.GetBlockSize()
+}
+
+// Resize 扩展下层设备，下层设备不支持时返回 ErrNotImplemented
+func (c *CachedBlockDevice) Resize(blockcount uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dev, ok := c.dev.(ResizableBlockDevice)
+	if !ok {
+		return ErrNotImplemented
+	}
+	return dev.Resize(blockcount)
+}
+
+// Flush 把所有脏块按块号顺序写到下层设备
+func (c *CachedBlockDevice) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+// Sync 写回所有脏块，并让下层设备持久化
+func (c *CachedBlockDevice) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if dev, ok := c.dev.(Syncer); ok {
+		return dev.Sync()
+	}
+	return nil
+}
+
+// Close 停止后台写回并 Sync，不会关闭下层设备
+func (c *CachedBlockDevice) Close() error {
+	c.StopWriteback()
+	return c.Sync()
+}
+
+func (c *CachedBlockDevice) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Cached = c.lru.Len()
+	return stats
+}
+
+// get 返回缓存中的块，未命中时从下层设备读入
+func (c *CachedBlockDevice) get(blockno uint64) (*cacheEntry, error) {
+	if elem, ok := c.entries[blockno]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cacheEntry), nil
+	}
+	c.stats.Misses++
+	data, err := c.dev.ReadBlock(blockno)
+	if err != nil {
+		return nil, err
+	}
+	ent := &cacheEntry{blkno: blockno, data: data}
+	c.entries[blockno] = c.lru.PushFront(ent)
+	return ent, nil
+}
+
+// put 用 data 替换缓存中的块并标记为脏
+func (c *CachedBlockDevice) put(blockno uint64, data []byte) {
+	if elem, ok := c.entries[blockno]; ok {
+		ent := elem.Value.(*cacheEntry)
+		ent.data = data
+		if !ent.dirty {
+			ent.dirty = true
+			c.stats.Dirty++
+		}
+		c.lru.MoveToFront(elem)
+		return
+	}
+	ent := &cacheEntry{blkno: blockno, data: data, dirty: true}
+	c.stats.Dirty++
+	c.entries[blockno] = c.lru.PushFront(ent)
+}
+
+// evict 淘汰最久未使用的块直到不超过容量，脏块先写回
+func (c *CachedBlockDevice) evict() error {
+	for c.lru.Len() > c.capacity {
+		elem := c.lru.Back()
+		ent := elem.Value.(*cacheEntry)
+		if err := c.writeback(ent); err != nil {
+			return err
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, ent.blkno)
+	}
+	return nil
+}
+
+// evictOnRead 在读路径上淘汰，写回失败不影响本次读取，脏块留在缓存中
+func (c *CachedBlockDevice) evictOnRead() {
+	if err := c.evict(); err != nil {
+		logrus.Errorf("block cache eviction failed: %v", err)
+	}
+}
+
+func (c *CachedBlockDevice) writeback(ent *cacheEntry) error {
+	if !ent.dirty {
+		return nil
+	}
+	if err := c.dev.WriteBlock(ent.blkno, ent.data); err != nil {
+		return err
+	}
+	ent.dirty = false
+	c.stats.Dirty--
+	c.stats.Writebacks++
+	return nil
+}
+
+func (c *CachedBlockDevice) flush() error {
+	var dirty []*cacheEntry
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		if ent := elem.Value.(*cacheEntry); ent.dirty {
+			dirty = append(dirty, ent)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].blkno < dirty[j].blkno })
+	for _, ent := range dirty {
+		if err := c.writeback(ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
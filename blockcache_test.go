@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachedBlockDevice(t *testing.T) {
+	file, err := NewFileBlockDevice(filepath.Join(t.TempDir(), "cache.bin"), 64, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	// 最多缓存 4 块
+	cache := NewCachedBlockDevice(file, 4*DefaultBlockSize)
+
+	blk := bytes.Repeat([]byte{0xab}, DefaultBlockSize)
+	if err = cache.WriteBlock(1, blk); err != nil {
+		t.Fatal(err)
+	}
+	// 写回之前下层设备中仍是旧数据
+	data, err := file.ReadBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 0 {
+		t.Errorf("block 1 written through before sync")
+	}
+	data, err = cache.ReadBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, blk) {
+		t.Errorf("cached block 1 differs")
+	}
+	// 修改返回的数据不影响缓存
+	data[0] = 0
+	if data, _ = cache.ReadBlock(1); data[0] != 0xab {
+		t.Errorf("cache shares memory with caller")
+	}
+
+	// 跨块的字节读写
+	if err = cache.Write(DefaultBlockSize*3-2, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if err = cache.Read(DefaultBlockSize*3-2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q", buf)
+	}
+
+	// 超过容量后淘汰最久未使用的块 1，脏数据写回
+	for blkno := uint64(10); blkno < 14; blkno++ {
+		if _, err = cache.ReadBlock(blkno); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, _ = file.ReadBlock(1); !bytes.Equal(data, blk) {
+		t.Errorf("evicted dirty block 1 was not written back")
+	}
+	stats := cache.Stats()
+	if stats.Cached != 4 || stats.Dirty != 0 || stats.Writebacks != 3 {
+		t.Errorf("bad stats %+v", stats)
+	}
+
+	if err = cache.WriteBlock(64, blk); err != ErrOutOfRange {
+		t.Errorf("err is %v not %v", err, ErrOutOfRange)
+	}
+	if err = cache.WriteBlock(5, blk[:10]); err != ErrInvalidArgument {
+		t.Errorf("err is %v not %v", err, ErrInvalidArgument)
+	}
+
+	// 后台定期写回
+	cache.StartWriteback(10 * time.Millisecond)
+	defer cache.StopWriteback()
+	if err = cache.WriteBlock(20, blk); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && cache.Stats().Dirty > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if data, _ = file.ReadBlock(20); !bytes.Equal(data, blk) {
+		t.Errorf("block 20 was not written back")
+	}
+}
+
+func TestCachedBlockDeviceFs(t *testing.T) {
+	file, err := NewFileBlockDevice(filepath.Join(t.TempDir(), "cachefs.bin"), 8192, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	cache := NewCachedBlockDevice(file, 1<<20)
+	if _, err = Makefs(cache, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(cache, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err = fs.mkdir(root, name, 0755, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = fs.lookupPath("/b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits == 0 || stats.Dirty == 0 {
+		t.Errorf("bad stats %+v", stats)
+	}
+	if code := fs.sync(); !code.Ok() {
+		t.Fatal(code)
+	}
+	if stats := cache.Stats(); stats.Dirty != 0 {
+		t.Errorf("%d dirty blocks after sync", stats.Dirty)
+	}
+
+	// 直接检查下层设备
+	report, err := Fsck(file, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() || report.Dirs != 4 {
+		t.Errorf("fsck: %d dirs, %v", report.Dirs, report.Problems)
+	}
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
-	"errors"
+	"fmt"
+	"io"
 	"os"
 )
 
-const BlockSize = 512
+// 块大小在格式化时确定并记录在超级块中，支持 512 到 4096 之间 2 的幂
+const (
+	DefaultBlockSize = 512
+	MinBlockSize     = 512
+	MaxBlockSize     = 4096
+)
+
+// ValidBlockSize 判断 bs 是否是支持的块大小
+func ValidBlockSize(bs uint32) bool {
+	return bs >= MinBlockSize && bs <= MaxBlockSize && bs&(bs-1) == 0
+}
 
 type BlockDevice interface {
 	ReadBlock(blockno uint64) ([]byte, error)
@@ -13,21 +24,34 @@ type BlockDevice interface {
 	Read(offset uint64, data []byte) error
 	Write(offset uint64, data []byte) error
 	GetTotalBlockCount() uint32
+	GetBlockSize() uint32
+}
+
+// ResizableBlockDevice 是可以扩展大小的块设备，growfs 需要它
+type ResizableBlockDevice interface {
+	BlockDevice
+	Resize(blockcount uint64) error
 }
 
 type FileBlockDevice struct {
 	file       *os.File
 	blockcount uint64
+	blocksize  uint32
 }
 
-func NewFileBlockDevice(path string, blockcount uint64) (*FileBlockDevice, error) {
+// NewFileBlockDevice 创建（或调整）一个 blockcount 个 blocksize 字节块的镜像文件，仅供格式化使用。
+// 挂载已有镜像请使用 OpenFileBlockDevice，它不会创建或截断文件
+func NewFileBlockDevice(path string, blockcount uint64, blocksize uint32) (*FileBlockDevice, error) {
+	if !ValidBlockSize(blocksize) {
+		return nil, ErrBadBlockSize
+	}
 	// create if not exists
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
 	// truncate to blockcount * blocksize
-	err = file.Truncate(int64(blockcount * BlockSize))
+	err = file.Truncate(int64(blockcount * uint64(blocksize)))
 	if err != nil {
 		return nil, err
 	}
@@ -35,51 +59,102 @@ func NewFileBlockDevice(path string, blockcount uint64) (*FileBlockDevice, error
 	return &FileBlockDevice{
 		file:       file,
 		blockcount: blockcount,
+		blocksize:  blocksize,
 	}, nil
 }
 
-func (f *FileBlockDevice) ReadBlock(blockno uint64) ([]byte, error) {
-	data := make([]byte, BlockSize)
-	nbytes, err := f.file.ReadAt(data, int64(blockno*BlockSize))
+// probeBlockSize 从主超级块中读取块大小。主超级块损坏时依次按每种块大小寻找超级块副本，
+// 副本中记录的块大小必须与扫描所用的相符；都找不到时返回 DefaultBlockSize
+func probeBlockSize(file *os.File, size int64) uint32 {
+	data := make([]byte, MinBlockSize)
+	if _, err := file.ReadAt(data, 0); err == nil {
+		var sb Superblock
+		if CheckMagic(data[:4], SuperBlockMagicNum) && StructOf(data, &sb) == nil && ValidBlockSize(sb.BlockSize) {
+			return sb.BlockSize
+		}
+	}
+	for bs := uint32(MinBlockSize); bs <= MaxBlockSize; bs *= 2 {
+		dev := &FileBlockDevice{file: file, blockcount: uint64(size) / uint64(bs), blocksize: bs}
+		if _, _, err := findBackupSuperblock(dev); err == nil {
+			return bs
+		}
+	}
+	return DefaultBlockSize
+}
+
+// OpenFileBlockDevice 打开一个已存在的镜像文件，块大小取自超级块，块数由文件大小决定
+func OpenFileBlockDevice(path string, readonly bool) (*FileBlockDevice, error) {
+	flags := os.O_RDWR
+	if readonly {
+		flags = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flags, 0)
 	if err != nil {
 		return nil, err
 	}
-	if nbytes != BlockSize {
-		return nil, errors.New("short read")
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	blocksize := probeBlockSize(file, fi.Size())
+	blockcount := uint64(fi.Size()) / uint64(blocksize)
+	if blockcount == 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s is smaller than one block", path)
+	}
+	return &FileBlockDevice{
+		file:       file,
+		blockcount: blockcount,
+		blocksize:  blocksize,
+	}, nil
+}
+
+func (f *FileBlockDevice) ReadBlock(blockno uint64) ([]byte, error) {
+	data := make([]byte, f.blocksize)
+	if err := f.Read(blockno*uint64(f.blocksize), data); err != nil {
+		return nil, err
 	}
 	return data, nil
 }
 
 func (f *FileBlockDevice) WriteBlock(blockno uint64, data []byte) error {
-	nbytes, err := f.file.WriteAt(data, int64(blockno*BlockSize))
-	if err != nil {
-		return err
-	}
-	if nbytes != BlockSize {
-		return errors.New("short write")
+	if len(data) != int(f.blocksize) {
+		return ErrInvalidArgument
 	}
-	return nil
+	return f.Write(blockno*uint64(f.blocksize), data)
 }
 
+// Read 读取从字节偏移 offset 开始的 len(data) 字节，读不满时返回 ErrShortIO
 func (f *FileBlockDevice) Read(offset uint64, data []byte) error {
-	nbytes, err := f.file.ReadAt(data, int64(offset))
-	if err != nil {
-		return err
+	if offset+uint64(len(data)) > f.blockcount*uint64(f.blocksize) {
+		return ErrOutOfRange
 	}
+	nbytes, err := f.file.ReadAt(data, int64(offset))
 	if nbytes != len(data) {
-		// return errors.New("short read")
+		if err == nil || err == io.EOF {
+			return ErrShortIO
+		}
+		return err
 	}
 	return nil
 }
 
-
+// Write 写入从字节偏移 offset 开始的数据，不允许越过设备末尾
 func (f *FileBlockDevice) Write(offset uint64, data []byte) error {
+	if offset+uint64(len(data)) > f.blockcount*uint64(f.blocksize) {
+		return ErrOutOfRange
+	}
 	nbytes, err := f.file.WriteAt(data, int64(offset))
 	if err != nil {
 		return err
 	}
 	if nbytes != len(data) {
-		// return errors.New("short write")
+		return ErrShortIO
 	}
 	return nil
 }
@@ -87,3 +162,29 @@ func (f *FileBlockDevice) Write(offset uint64, data []byte) error {
 func (f *FileBlockDevice) GetTotalBlockCount() uint32 {
 	return uint32(f.blockcount)
 }
+
+// Resize 把镜像文件扩展到 blockcount 块，不允许缩小
+func (f *FileBlockDevice) Resize(blockcount uint64) error {
+	if blockcount < f.blockcount {
+		return ErrOutOfRange
+	}
+	err := f.file.Truncate(int64(blockcount * uint64(f.blocksize)))
+	if err != nil {
+		return err
+	}
+	f.blockcount = blockcount
+	return nil
+}
+
+func (f *FileBlockDevice) GetBlockSize() uint32 {
+	return f.blocksize
+}
+
+// Sync 把镜像文件的内容持久化到磁盘
+func (f *FileBlockDevice) Sync() error {
+	return f.file.Sync()
+}
+
+func (f *FileBlockDevice) Close() error {
+	return f.file.Close()
+}
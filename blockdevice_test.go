@@ -1,21 +1,23 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestNewFileBlockDevice(t *testing.T) {
 	// 50MB
 	blockcount := uint64(50 * 1024 * 1024 / 512)
-	dev, err := NewFileBlockDevice("./device.bin", blockcount)
+	dev, err := NewFileBlockDevice(filepath.Join(t.TempDir(), "device.bin"), blockcount, DefaultBlockSize)
 	if err != nil {
 		t.Error(err)
 	}
 	if dev == nil {
 		t.Error("dev is nil")
 	}
-	fill1 := make([]byte, BlockSize)
-	for i := 0; i < BlockSize; i++ {
+	fill1 := make([]byte, DefaultBlockSize)
+	for i := 0; i < DefaultBlockSize; i++ {
 		fill1[i] = 0xff
 	}
 	err = dev.WriteBlock(0, fill1)
@@ -39,3 +41,61 @@ func TestNewFileBlockDevice(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestMemBlockDevice(t *testing.T) {
+	dev, err := NewMemBlockDevice(16, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Write(DefaultBlockSize-2, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	snap := dev.Snapshot()
+	if err = dev.Write(DefaultBlockSize-2, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if err = dev.Read(DefaultBlockSize-2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q after restore", buf)
+	}
+	if _, err = dev.ReadBlock(16); err != ErrOutOfRange {
+		t.Errorf("err is %v not %v", err, ErrOutOfRange)
+	}
+	if err = dev.WriteBlock(0, buf); err != ErrInvalidArgument {
+		t.Errorf("err is %v not %v", err, ErrInvalidArgument)
+	}
+	if err = dev.Resize(32); err != nil {
+		t.Fatal(err)
+	}
+	if dev.GetTotalBlockCount() != 32 {
+		t.Errorf("%d blocks after resize", dev.GetTotalBlockCount())
+	}
+	if err = dev.Resize(8); err != ErrOutOfRange {
+		t.Errorf("err is %v not %v", err, ErrOutOfRange)
+	}
+}
+
+func TestFileBlockDeviceShortIO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short.bin")
+	dev, err := NewFileBlockDevice(path, 8, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if err = dev.Write(8*DefaultBlockSize-2, []byte("abc")); err != ErrOutOfRange {
+		t.Errorf("err is %v not %v", err, ErrOutOfRange)
+	}
+	// 镜像文件被其他程序截断后，读不满一块必须报错
+	if err = os.Truncate(path, 4*DefaultBlockSize+10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dev.ReadBlock(4); err != ErrShortIO {
+		t.Errorf("err is %v not %v", err, ErrShortIO)
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
-	"errors"
+	"encoding/binary"
+	"fmt"
 	"reflect"
+	"sort"
 
 	"github.com/sirupsen/logrus"
 )
 
 type any = interface{}
 
-const BtreeBlockMagicNum = uint32(0x42465442) // "BTFB" btree free block
+const BtreeBlockMagicNum = uint32(0x42465442) // "BTFB" btree free block，没有 btree 特性时的单块格式
+const BtreeNodeMagicNum = uint32(0x444e5442)  // "BTND" B+ 树节点
+
+// DBtreeBlock 是没有 FeatIncompatBtree 的镜像中树的格式：只有一个根节点，它同时也是叶子节点
 type DBtreeBlock[TRec any] struct {
 	MagicNum uint32 `struct:"uint32"`
 	NumRecs  uint32 `struct:"uint32,sizeof=Recs"`
@@ -18,6 +23,28 @@ type DBtreeBlock[TRec any] struct {
 	// followed by BtreeRecord
 }
 
+// DBtreeNode 是 B+ 树的节点。Level 为 0 的是叶子节点，Recs 是记录；
+// 内部节点的 Recs 是 DBtreePtr。同一层的节点通过 LeftSib、RightSib 连成链表，0 表示没有
+type DBtreeNode[TRec any] struct {
+	MagicNum uint32 `struct:"uint32"`
+	NumRecs  uint32 `struct:"uint32,sizeof=Recs"`
+	BlkNo    uint64 `struct:"uint64"`
+	Level    uint32 `struct:"uint32"`
+	Pad      uint32 `struct:"uint32"`
+	LeftSib  uint64 `struct:"uint64"`
+	RightSib uint64 `struct:"uint64"`
+	Recs     []TRec
+}
+
+// btreeLevelOff 是 DBtreeNode 中 Level 的偏移，解码前据此选择记录的类型
+const btreeLevelOff = 16
+
+// DBtreePtr 是内部节点中的一项：子节点中记录的下界和子节点的块号
+type DBtreePtr[TRec any] struct {
+	Key TRec
+	Ptr uint64 `struct:"uint64"`
+}
+
 type DFreeBlockBtRec struct {
 	BlockCount uint64 `struct:"uint64"`
 	StartBlock uint64 `struct:"uint64"`
@@ -27,20 +54,64 @@ func (f DFreeBlockBtRec) GetKey() uint64 {
 	return f.BlockCount
 }
 
+// Less 先比较 BlockCount，相同时比较 StartBlock
 func (f DFreeBlockBtRec) Less(other RecInterface[uint64]) bool {
-	return f.BlockCount < other.GetKey()
+	o := other.(DFreeBlockBtRec)
+	if f.BlockCount != o.BlockCount {
+		return f.BlockCount < o.BlockCount
+	}
+	return f.StartBlock < o.StartBlock
+}
+
+// DFreeBnoBtRec 是按起始块号排序的空闲空间树的记录，磁盘格式与 DFreeBlockBtRec 相同
+type DFreeBnoBtRec DFreeBlockBtRec
+
+func (f DFreeBnoBtRec) GetKey() uint64 {
+	return f.StartBlock
+}
+
+// Less 比较 StartBlock，空闲区间不重叠，StartBlock 不会相同
+func (f DFreeBnoBtRec) Less(other RecInterface[uint64]) bool {
+	return f.StartBlock < other.(DFreeBnoBtRec).StartBlock
 }
 
 type RecInterface[TKey uint64] interface {
 	GetKey() TKey
-	// Comparable
+	// Less 比较完整的记录，GetKey 相同的记录也必须能区分先后，使树中的记录有全序
 	Less(other RecInterface[TKey]) bool
 }
 
-// BtreeContext 用于管理基于磁盘的 Btree 结构
+// btreeCapacity 返回一个 blocksize 字节的块在 hdr 之后最多能容纳的 rec 数，块末尾为校验和保留
+func btreeCapacity(blocksize uint32, hdr any, rec any) int {
+	hdrSize, err := SizeOf(hdr)
+	if err != nil {
+		panic(err)
+	}
+	recSize, err := SizeOf(rec)
+	if err != nil {
+		panic(err)
+	}
+	return (int(blocksize) - metaCrcSize - hdrSize) / recSize
+}
+
+// BtreeBlockCapacity 返回一个 blocksize 字节的叶子节点最多能容纳的记录数，对两种格式都成立
+func BtreeBlockCapacity[TRec any](blocksize uint32) int {
+	var rec TRec
+	return btreeCapacity(blocksize, &DBtreeNode[TRec]{}, &rec)
+}
+
+// BtreeAllocator 为 B+ 树的非根节点分配和释放块
+type BtreeAllocator interface {
+	AllocNode() (uint64, error)
+	FreeNode(blkno uint64) error
+}
+
+// BtreeContext 用于管理基于磁盘的 Btree 结构。
+// 根节点的块号固定不变，树长高时把根节点的内容移到新分配的块中
 type BtreeContext[TKey uint64, TRec RecInterface[TKey]] struct {
-	dev  BlockDevice
-	root uint64 // root blockno
+	dev   BlockDevice
+	root  uint64 // root blockno
+	alloc BtreeAllocator
 }
 
 func NewBtreeContext[TKey uint64, TRec RecInterface[TKey]](dev BlockDevice, root uint64) *BtreeContext[TKey, TRec] {
@@ -53,208 +124,671 @@ func NewBtreeContext[TKey uint64, TRec RecInterface[TKey]](dev BlockDevice, root
 	}
 }
 
+// WithAllocator 设置节点分配器。没有分配器时树不能分裂，根节点满了之后插入返回 ErrNoSpace；
+// 删除时也不能释放节点，过空的节点不合并，树不会变矮，删空根节点以外的叶子返回 ErrNoSpace
+func (ctx *BtreeContext[TKey, TRec]) WithAllocator(alloc BtreeAllocator) *BtreeContext[TKey, TRec] {
+	ctx.alloc = alloc
+	return ctx
+}
+
+// btNode 是内存中的节点
+type btNode[TRec any] struct {
+	blkno       uint64
+	level       uint32
+	left, right uint64
+	recs        []TRec            // 叶子节点的记录
+	ptrs        []DBtreePtr[TRec] // 内部节点的子节点
+}
+
+func (n *btNode[TRec]) count() int {
+	if n.level == 0 {
+		return len(n.recs)
+	}
+	return len(n.ptrs)
+}
+
+// lowKey 返回节点中记录的下界，节点不能为空
+func (n *btNode[TRec]) lowKey() TRec {
+	if n.level == 0 {
+		return n.recs[0]
+	}
+	return n.ptrs[0].Key
+}
+
+// legacy 表示树使用单块格式
+func (ctx *BtreeContext[TKey, TRec]) legacy() bool {
+	return !btreeEnabled(ctx.dev)
+}
+
+// capacity 返回 level 层的节点最多能容纳的项数
+func (ctx *BtreeContext[TKey, TRec]) capacity(level uint32) int {
+	bs := ctx.dev.GetBlockSize()
+	var rec TRec
+	if ctx.legacy() {
+		return btreeCapacity(bs, &DBtreeBlock[TRec]{}, &rec)
+	}
+	if level == 0 {
+		return btreeCapacity(bs, &DBtreeNode[TRec]{}, &rec)
+	}
+	return btreeCapacity(bs, &DBtreeNode[DBtreePtr[TRec]]{}, &DBtreePtr[TRec]{})
+}
+
+// minFill 返回非根节点删除后不需要调整的最少项数
+func (ctx *BtreeContext[TKey, TRec]) minFill(level uint32) int {
+	return ctx.capacity(level) / 2
+}
+
 // initBlock 初始化一个 BtreeBlock，并将其写入磁盘
 func (ctx *BtreeContext[TKey, TRec]) InitBlock() error {
-	blk := DBtreeBlock[TRec]{
-		MagicNum: BtreeBlockMagicNum,
-		NumRecs:  0,
-		BlkNo:    ctx.root,
-		Recs:     make([]TRec, 0),
+	return ctx.writeNode(&btNode[TRec]{blkno: ctx.root, recs: make([]TRec, 0)})
+}
+
+// loadBlock 从指定块号加载节点
+func (ctx *BtreeContext[TKey, TRec]) loadBlock(blkno uint64) (*btNode[TRec], error) {
+	if blkno == 0 {
+		return nil, ErrUnreachable
 	}
-	blkBytes, err := BytesOf(&blk)
+	data, err := readMetaBlock(ctx.dev, blkno)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return ctx.dev.WriteBlock(ctx.root, Pad(blkBytes, BlockSize))
+	numRecs := int(binary.LittleEndian.Uint32(data[4:]))
+	node := &btNode[TRec]{blkno: blkno}
+	var hdrBlkNo uint64
+	switch binary.LittleEndian.Uint32(data[0:4]) {
+	case BtreeBlockMagicNum:
+		if blkno != ctx.root || numRecs > ctx.capacity(0) {
+			return nil, ErrBadBtree
+		}
+		var blk DBtreeBlock[TRec]
+		if err := StructOf(data, &blk); err != nil {
+			return nil, err
+		}
+		hdrBlkNo, node.recs = blk.BlkNo, blk.Recs
+	case BtreeNodeMagicNum:
+		node.level = binary.LittleEndian.Uint32(data[btreeLevelOff:])
+		if numRecs > ctx.capacity(node.level) {
+			return nil, ErrBadBtree
+		}
+		if node.level == 0 {
+			var blk DBtreeNode[TRec]
+			if err := StructOf(data, &blk); err != nil {
+				return nil, err
+			}
+			hdrBlkNo, node.left, node.right, node.recs = blk.BlkNo, blk.LeftSib, blk.RightSib, blk.Recs
+		} else {
+			var blk DBtreeNode[DBtreePtr[TRec]]
+			if err := StructOf(data, &blk); err != nil {
+				return nil, err
+			}
+			hdrBlkNo, node.left, node.right, node.ptrs = blk.BlkNo, blk.LeftSib, blk.RightSib, blk.Recs
+		}
+	default:
+		return nil, ErrBadBtree
+	}
+	if hdrBlkNo != blkno {
+		return nil, ErrBadBtree
+	}
+	return node, nil
 }
 
-// loadBlock 从指定块号加载根结点
-func (ctx *BtreeContext[TKey, TRec]) loadBlock(blkno uint64) (*DBtreeBlock[TRec], error) {
-	if blkno == 0 {
-		return nil, ErrUnreachable
+// writeNode 把节点写入磁盘，节点超出容量时返回 ErrNoSpace
+func (ctx *BtreeContext[TKey, TRec]) writeNode(n *btNode[TRec]) error {
+	if n.count() > ctx.capacity(n.level) {
+		return ErrNoSpace
 	}
-	data, err := ctx.dev.ReadBlock(blkno)
+	var blk any
+	switch {
+	case ctx.legacy():
+		// 单块格式只有根节点
+		if n.blkno != ctx.root || n.level != 0 {
+			return ErrNoSpace
+		}
+		blk = &DBtreeBlock[TRec]{MagicNum: BtreeBlockMagicNum, NumRecs: uint32(len(n.recs)), BlkNo: n.blkno, Recs: n.recs}
+	case n.level == 0:
+		blk = &DBtreeNode[TRec]{MagicNum: BtreeNodeMagicNum, NumRecs: uint32(len(n.recs)), BlkNo: n.blkno,
+			LeftSib: n.left, RightSib: n.right, Recs: n.recs}
+	default:
+		blk = &DBtreeNode[DBtreePtr[TRec]]{MagicNum: BtreeNodeMagicNum, NumRecs: uint32(len(n.ptrs)), BlkNo: n.blkno,
+			Level: n.level, LeftSib: n.left, RightSib: n.right, Recs: n.ptrs}
+	}
+	blkBytes, err := BytesOf(blk)
+	if err != nil {
+		return err
+	}
+	return writeMetaBlock(ctx.dev, n.blkno, blkBytes)
+}
+
+// loadChild 加载内部节点 n 的第 i 个子节点
+func (ctx *BtreeContext[TKey, TRec]) loadChild(n *btNode[TRec], i int) (*btNode[TRec], error) {
+	child, err := ctx.loadBlock(n.ptrs[i].Ptr)
 	if err != nil {
 		return nil, err
 	}
-	// 检查 MagicNum
-	if !CheckMagic(data[0:4], BtreeBlockMagicNum) {
-		return nil, errors.New("invalid block magic num")
+	if child.level+1 != n.level {
+		return nil, ErrBadBtree
+	}
+	return child, nil
+}
+
+// childFor 返回内部节点中应当包含 rec 的子节点：下界不大于 rec 的最后一个
+func childFor[TKey uint64, TRec RecInterface[TKey]](n *btNode[TRec], rec TRec) int {
+	i := sort.Search(len(n.ptrs), func(i int) bool { return rec.Less(n.ptrs[i].Key) })
+	if i > 0 {
+		i--
 	}
-	var btreeBlock DBtreeBlock[TRec]
-	err = StructOf(data, &btreeBlock)
+	return i
+}
+
+// descendKey 从根节点走到可能包含第一个键不小于 key 的记录的叶子节点
+func (ctx *BtreeContext[TKey, TRec]) descendKey(key TKey) (*btNode[TRec], error) {
+	n, err := ctx.loadBlock(ctx.root)
 	if err != nil {
 		return nil, err
 	}
-	return &btreeBlock, nil
+	for n.level > 0 {
+		// 键相同的记录可能跨越多个子节点，选择下界的键小于 key 的最后一个
+		i := sort.Search(len(n.ptrs), func(i int) bool { return n.ptrs[i].Key.GetKey() >= key })
+		if i > 0 {
+			i--
+		}
+		if n, err = ctx.loadChild(n, i); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Height 返回树的层数
+func (ctx *BtreeContext[TKey, TRec]) Height() (int, error) {
+	root, err := ctx.loadBlock(ctx.root)
+	if err != nil {
+		return 0, err
+	}
+	return int(root.level) + 1, nil
 }
+
+// Get 返回键等于 key 的记录；没有时返回键小于 key 的最后一条记录，exactEqual 为 false
 func (ctx *BtreeContext[TKey, TRec]) Get(key TKey) (retRec *TRec, err error, exactEqual bool) {
-	rootBlk, err := ctx.loadBlock(ctx.root)
+	rec, err := ctx.GetFirstMeet(key)
 	if err != nil {
 		return nil, err, false
 	}
-	if rootBlk.NumRecs == 0 {
-		return nil, nil, false
+	if rec != nil && (*rec).GetKey() == key {
+		return rec, nil, true
 	}
-	// search in recs
-	for _, rec := range rootBlk.Recs {
-		if rec.GetKey() == key {
-			return &rec, nil, true
+	n, err := ctx.descendKey(key)
+	for err == nil {
+		for i := len(n.recs) - 1; i >= 0; i-- {
+			if n.recs[i].GetKey() < key {
+				rec := n.recs[i]
+				return &rec, nil, false
+			}
 		}
-		if rec.GetKey() < key {
-			retRec = &rec
+		if n.left == 0 {
+			return nil, nil, false
 		}
+		n, err = ctx.loadBlock(n.left)
 	}
-	// todo: search in children
-	return
+	return nil, err, false
 }
 
-type Cond = int
-
-const (
-	CondEq = iota
-	CondLt
-	CondGt
-	CondGe
-	CondLe
-)
+// GetFirstMeet 获取第一个键大于等于给定 key 的记录，没有时返回 nil
+func (ctx *BtreeContext[TKey, TRec]) GetFirstMeet(key TKey) (*TRec, error) {
+	n, err := ctx.descendKey(key)
+	for err == nil {
+		for _, rec := range n.recs {
+			if rec.GetKey() >= key {
+				return &rec, nil
+			}
+		}
+		if n.right == 0 {
+			return nil, nil
+		}
+		n, err = ctx.loadBlock(n.right)
+	}
+	return nil, err
+}
 
-// 获取第一个大于等于给定 key 的记录
-func (ctx *BtreeContext[TKey, TRec]) GetFirstMeet(key TKey) (retRec *TRec, index int, err error) {
-	retRec, _, index, err = ctx.get(key, CondGe)
-	return
+// Last 返回最大的记录，树为空时返回 nil
+func (ctx *BtreeContext[TKey, TRec]) Last() (*TRec, error) {
+	n, err := ctx.loadBlock(ctx.root)
+	if err != nil {
+		return nil, err
+	}
+	for n.level > 0 {
+		if n, err = ctx.loadChild(n, len(n.ptrs)-1); err != nil {
+			return nil, err
+		}
+	}
+	if len(n.recs) == 0 {
+		return nil, nil
+	}
+	return &n.recs[len(n.recs)-1], nil
 }
 
-func (ctx *BtreeContext[TKey, TRec]) get(key TKey, cond Cond) (retRec *TRec, exactEqual bool, index int, err error) {
-	rootBlk, err := ctx.loadBlock(ctx.root)
+// Set 插入一条记录，节点满了时分裂
+func (ctx *BtreeContext[TKey, TRec]) Set(value TRec) error {
+	tyName := reflect.TypeOf(value).String()
+	logrus.Debugf("Set type=%s, value=%v", tyName, value)
+	root, err := ctx.loadBlock(ctx.root)
 	if err != nil {
-		return nil, false, -1, err
-	}
-	if rootBlk.NumRecs == 0 {
-		return nil, false, -1, nil
-	}
-	// search in recs
-	for i, rec := range rootBlk.Recs {
-		// 如果完全匹配，立即返回
-		if cond == CondEq || cond == CondLe || cond == CondGe {
-			if rec.GetKey() == key {
-				retRec = &rec
-				exactEqual = true
-				index = i
-				return
-			}
+		return err
+	}
+	split, err := ctx.insert(root, value)
+	if err != nil || split == nil {
+		return err
+	}
+	return ctx.growRoot(root, split)
+}
+
+// insert 把 value 插入以 n 为根的子树。n 分裂时返回新的右半部分在父节点中的项
+func (ctx *BtreeContext[TKey, TRec]) insert(n *btNode[TRec], value TRec) (*DBtreePtr[TRec], error) {
+	if n.level == 0 {
+		i := sort.Search(len(n.recs), func(i int) bool { return value.Less(n.recs[i]) })
+		n.recs = append(n.recs, value)
+		copy(n.recs[i+1:], n.recs[i:])
+		n.recs[i] = value
+	} else {
+		i := childFor[TKey](n, value)
+		// 比所有记录都小时更新下界
+		lowered := value.Less(n.ptrs[0].Key)
+		if lowered {
+			n.ptrs[0].Key = value
 		}
-		if cond == CondLt || cond == CondLe {
-			// 返回最后一个满足小于条件的
-			if rec.GetKey() < key {
-				retRec = &rec
-				index = i
-			}
+		child, err := ctx.loadChild(n, i)
+		if err != nil {
+			return nil, err
 		}
-		if cond == CondGt || cond == CondGe {
-			// 返回第一个满足大于条件的
-			if rec.GetKey() > key {
-				retRec = &rec
-				index = i
+		split, err := ctx.insert(child, value)
+		if err != nil {
+			return nil, err
+		}
+		if split == nil {
+			if lowered {
+				return nil, ctx.writeNode(n)
 			}
+			return nil, nil
 		}
+		n.ptrs = append(n.ptrs, *split)
+		copy(n.ptrs[i+2:], n.ptrs[i+1:])
+		n.ptrs[i+1] = *split
+	}
+	if n.count() <= ctx.capacity(n.level) {
+		return nil, ctx.writeNode(n)
+	}
+	return ctx.split(n)
+}
 
+// split 把 n 的后一半移到新分配的右兄弟中
+func (ctx *BtreeContext[TKey, TRec]) split(n *btNode[TRec]) (*DBtreePtr[TRec], error) {
+	if ctx.legacy() || ctx.alloc == nil {
+		return nil, ErrNoSpace
+	}
+	blkno, err := ctx.alloc.AllocNode()
+	if err != nil {
+		return nil, err
 	}
-	// todo: search in children
-	return
+	right := &btNode[TRec]{blkno: blkno, level: n.level, left: n.blkno, right: n.right}
+	mid := n.count() / 2
+	if n.level == 0 {
+		right.recs = append([]TRec{}, n.recs[mid:]...)
+		n.recs = n.recs[:mid]
+	} else {
+		right.ptrs = append([]DBtreePtr[TRec]{}, n.ptrs[mid:]...)
+		n.ptrs = n.ptrs[:mid]
+	}
+	if err := ctx.setLeftSib(n.right, blkno); err != nil {
+		return nil, err
+	}
+	n.right = blkno
+	if err := ctx.writeNode(right); err != nil {
+		return nil, err
+	}
+	if err := ctx.writeNode(n); err != nil {
+		return nil, err
+	}
+	return &DBtreePtr[TRec]{Key: right.lowKey(), Ptr: blkno}, nil
 }
-func (ctx *BtreeContext[TKey, TRec]) SetByIndex(value TRec, index int) error {
-	rootBlk, err := ctx.loadBlock(ctx.root)
+
+// setLeftSib 修改 blkno 处节点的左兄弟，blkno 为 0 时什么也不做
+func (ctx *BtreeContext[TKey, TRec]) setLeftSib(blkno uint64, left uint64) error {
+	if blkno == 0 {
+		return nil
+	}
+	n, err := ctx.loadBlock(blkno)
 	if err != nil {
 		return err
 	}
-	if index < 0 || index >= int(rootBlk.NumRecs) {
-		return errors.New("index out of range")
-	}
-	rootBlk.Recs[index] = value
-	blkBytes, err := BytesOf(rootBlk)
+	n.left = left
+	return ctx.writeNode(n)
+}
+
+// growRoot 在根节点分裂后把它的左半部分移到新块中，根节点成为上一层的内部节点
+func (ctx *BtreeContext[TKey, TRec]) growRoot(root *btNode[TRec], split *DBtreePtr[TRec]) error {
+	blkno, err := ctx.alloc.AllocNode()
 	if err != nil {
 		return err
 	}
-	return ctx.dev.WriteBlock(ctx.root, Pad(blkBytes, BlockSize))
+	left := *root
+	left.blkno = blkno
+	if err := ctx.writeNode(&left); err != nil {
+		return err
+	}
+	if err := ctx.setLeftSib(split.Ptr, blkno); err != nil {
+		return err
+	}
+	return ctx.writeNode(&btNode[TRec]{
+		blkno: ctx.root,
+		level: root.level + 1,
+		ptrs:  []DBtreePtr[TRec]{{Key: left.lowKey(), Ptr: blkno}, *split},
+	})
 }
-func (ctx *BtreeContext[TKey, TRec]) Set(value TRec) error {
-	tyName := reflect.TypeOf(value).String()
-	logrus.Infof("Set type=%s, value=%v", tyName, value)
-	rootBlk, err := ctx.loadBlock(ctx.root)
+
+// Delete 删除与 value 完全相同的记录，没有时返回 ErrNoEntry
+func (ctx *BtreeContext[TKey, TRec]) Delete(value TRec) error {
+	root, err := ctx.loadBlock(ctx.root)
 	if err != nil {
 		return err
 	}
-	key := value.GetKey()
-	// 寻找插入点
-	insertPos, _ := ctx.getInsertPos(rootBlk, key)
-	if uint32(insertPos) == rootBlk.NumRecs {
-		// 插入到最后一个位置
-		rootBlk.Recs = append(rootBlk.Recs, value)
-		rootBlk.NumRecs++
-	} else {
-		// 插入到指定位置
-		var space TRec
-		rootBlk.Recs = append(rootBlk.Recs, space)
-		copy(rootBlk.Recs[insertPos+1:], rootBlk.Recs[insertPos:])
-		rootBlk.Recs[insertPos] = value
-		rootBlk.NumRecs++
-	}
-	// 写入磁盘
-	blkBytes, err := BytesOf(rootBlk)
+	found, err := ctx.delete(root, value)
 	if err != nil {
 		return err
 	}
-	return ctx.dev.WriteBlock(ctx.root, Pad(blkBytes, BlockSize))
+	if !found {
+		return ErrNoEntry
+	}
+	// 根节点只剩一个子节点时把子节点移回根节点，降低树高
+	for ctx.alloc != nil && root.level > 0 && len(root.ptrs) == 1 {
+		child, err := ctx.loadChild(root, 0)
+		if err != nil {
+			return err
+		}
+		old := child.blkno
+		child.blkno, child.left, child.right = ctx.root, 0, 0
+		if err := ctx.writeNode(child); err != nil {
+			return err
+		}
+		if err := ctx.alloc.FreeNode(old); err != nil {
+			return err
+		}
+		root = child
+	}
+	return nil
 }
 
-func (ctx *BtreeContext[TKey, TRec]) getInsertPos(rootBlk *DBtreeBlock[TRec], key TKey) (insertPos int, exactEqual bool) {
-	exactEqual = false
-	for i, rec := range rootBlk.Recs {
-		if rec.GetKey() < key {
-			insertPos = i
+// delete 从以 n 为根的子树中删除 value，子节点过空时与兄弟合并或从兄弟借用
+func (ctx *BtreeContext[TKey, TRec]) delete(n *btNode[TRec], value TRec) (bool, error) {
+	if n.level == 0 {
+		i := sort.Search(len(n.recs), func(i int) bool { return !n.recs[i].Less(value) })
+		if i == len(n.recs) || value.Less(n.recs[i]) {
+			return false, nil
 		}
-		if rec.GetKey() == key {
-			exactEqual = true
-			return
-		}
-		if rec.GetKey() > key {
-			break
+		// 没有分配器时不能释放节点，根节点以外的叶子不能删空
+		if ctx.alloc == nil && n.blkno != ctx.root && len(n.recs) == 1 {
+			return false, ErrNoSpace
 		}
+		n.recs = append(n.recs[:i], n.recs[i+1:]...)
+		return true, ctx.writeNode(n)
+	}
+	i := childFor[TKey](n, value)
+	child, err := ctx.loadChild(n, i)
+	if err != nil {
+		return false, err
 	}
-	return
+	found, err := ctx.delete(child, value)
+	if err != nil || !found {
+		return found, err
+	}
+	if child.count() >= ctx.minFill(child.level) {
+		return true, nil
+	}
+	return true, ctx.rebalance(n, i, child)
 }
 
-func (ctx *BtreeContext[TKey, TRec]) del(key TKey, delAll bool) error {
-	rootBlk, err := ctx.loadBlock(ctx.root)
+// rebalance 处理内部节点 parent 的第 i 个子节点过空的情况：
+// 与相邻的兄弟合起来放得下时合并，否则从较满的一方移一项给另一方
+func (ctx *BtreeContext[TKey, TRec]) rebalance(parent *btNode[TRec], i int, child *btNode[TRec]) error {
+	var left, right *btNode[TRec]
+	var err error
+	li := i
+	switch {
+	case i+1 < len(parent.ptrs):
+		left = child
+		right, err = ctx.loadChild(parent, i+1)
+	case i > 0:
+		li = i - 1
+		left, err = ctx.loadChild(parent, li)
+		right = child
+	default:
+		// 唯一的子节点，由 Delete 降低树高
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	// search in recs
-	for i, rec := range rootBlk.Recs {
-		if rec.GetKey() == key {
-			rootBlk.Recs = append(rootBlk.Recs[:i], rootBlk.Recs[i+1:]...)
-			rootBlk.NumRecs--
-			if !delAll {
-				break
-			}
+	if left.count()+right.count() <= ctx.capacity(left.level) {
+		// 没有分配器时不能释放右边的节点，保持过空
+		if ctx.alloc == nil {
+			return nil
+		}
+		left.recs = append(left.recs, right.recs...)
+		left.ptrs = append(left.ptrs, right.ptrs...)
+		left.right = right.right
+		if err := ctx.setLeftSib(right.right, left.blkno); err != nil {
+			return err
+		}
+		if err := ctx.writeNode(left); err != nil {
+			return err
 		}
+		parent.ptrs = append(parent.ptrs[:li+1], parent.ptrs[li+2:]...)
+		if err := ctx.writeNode(parent); err != nil {
+			return err
+		}
+		return ctx.alloc.FreeNode(right.blkno)
 	}
-	// 写入磁盘
-	blkBytes, err := BytesOf(rootBlk)
-	if err != nil {
+	if left.count() > right.count() {
+		if left.level == 0 {
+			right.recs = append([]TRec{left.recs[len(left.recs)-1]}, right.recs...)
+			left.recs = left.recs[:len(left.recs)-1]
+		} else {
+			right.ptrs = append([]DBtreePtr[TRec]{left.ptrs[len(left.ptrs)-1]}, right.ptrs...)
+			left.ptrs = left.ptrs[:len(left.ptrs)-1]
+		}
+	} else {
+		if left.level == 0 {
+			left.recs = append(left.recs, right.recs[0])
+			right.recs = right.recs[1:]
+		} else {
+			left.ptrs = append(left.ptrs, right.ptrs[0])
+			right.ptrs = right.ptrs[1:]
+		}
+	}
+	parent.ptrs[li+1].Key = right.lowKey()
+	if err := ctx.writeNode(left); err != nil {
 		return err
 	}
-	return ctx.dev.WriteBlock(ctx.root, Pad(blkBytes, BlockSize))
+	if err := ctx.writeNode(right); err != nil {
+		return err
+	}
+	return ctx.writeNode(parent)
+}
 
+func (ctx *BtreeContext[TKey, TRec]) del(key TKey, delAll bool) error {
+	for {
+		rec, err := ctx.GetFirstMeet(key)
+		if err != nil {
+			return err
+		}
+		if rec == nil || (*rec).GetKey() != key {
+			return nil
+		}
+		if err := ctx.Delete(*rec); err != nil {
+			return err
+		}
+		if !delAll {
+			return nil
+		}
+	}
 }
 
-// DelAll
+// DelAll 删除键等于 key 的所有记录
 func (ctx *BtreeContext[TKey, TRec]) DelAll(key TKey) error {
 	return ctx.del(key, true)
 }
 
-// Del
+// Del 删除键等于 key 的第一条记录
 func (ctx *BtreeContext[TKey, TRec]) Del(key TKey) error {
 	return ctx.del(key, false)
 }
+
+// walk 深度优先遍历整棵树，按从左到右的顺序对每个节点调用 visit，lo 和 hi 是父节点给出的记录范围（nil 表示不限）。
+// 检查层数和同层节点的兄弟链接，发现环或不一致时返回 ErrBadBtree
+func (ctx *BtreeContext[TKey, TRec]) walk(visit func(n *btNode[TRec], lo, hi *TRec) error) error {
+	root, err := ctx.loadBlock(ctx.root)
+	if err != nil {
+		return err
+	}
+	if root.left != 0 || root.right != 0 {
+		return fmt.Errorf("%w: root has siblings", ErrBadBtree)
+	}
+	seen := map[uint64]bool{}
+	last := map[uint32]*btNode[TRec]{} // 每一层上一个访问的节点
+	var visitNode func(n *btNode[TRec], lo, hi *TRec) error
+	visitNode = func(n *btNode[TRec], lo, hi *TRec) error {
+		if seen[n.blkno] {
+			return fmt.Errorf("%w: block %d is referenced twice", ErrBadBtree, n.blkno)
+		}
+		seen[n.blkno] = true
+		if n.blkno != ctx.root {
+			if n.count() == 0 {
+				return fmt.Errorf("%w: node %d is empty", ErrBadBtree, n.blkno)
+			}
+			prev := last[n.level]
+			if (prev == nil && n.left != 0) || (prev != nil && (prev.right != n.blkno || n.left != prev.blkno)) {
+				return fmt.Errorf("%w: bad sibling links at node %d", ErrBadBtree, n.blkno)
+			}
+			last[n.level] = n
+		}
+		if err := visit(n, lo, hi); err != nil {
+			return err
+		}
+		for i := range n.ptrs {
+			child, err := ctx.loadChild(n, i)
+			if err != nil {
+				return fmt.Errorf("node %d: %w", n.ptrs[i].Ptr, err)
+			}
+			clo, chi := &n.ptrs[i].Key, hi
+			if i+1 < len(n.ptrs) {
+				chi = &n.ptrs[i+1].Key
+			}
+			if err := visitNode(child, clo, chi); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visitNode(root, nil, nil); err != nil {
+		return err
+	}
+	for _, n := range last {
+		if n.right != 0 {
+			return fmt.Errorf("%w: bad sibling links at node %d", ErrBadBtree, n.blkno)
+		}
+	}
+	return nil
+}
+
+// Check 检查树的结构：记录和子节点有序且在父节点给出的范围内，层数和兄弟链接一致
+func (ctx *BtreeContext[TKey, TRec]) Check() error {
+	return ctx.walk(func(n *btNode[TRec], lo, hi *TRec) error {
+		inRange := func(rec TRec) bool {
+			return (lo == nil || !rec.Less(*lo)) && (hi == nil || rec.Less(*hi))
+		}
+		for i, rec := range n.recs {
+			if !inRange(rec) || (i > 0 && rec.Less(n.recs[i-1])) {
+				return fmt.Errorf("%w: record %v out of order in node %d", ErrBadBtree, rec, n.blkno)
+			}
+		}
+		for i, p := range n.ptrs {
+			if !inRange(p.Key) || (i > 0 && !n.ptrs[i-1].Key.Less(p.Key)) {
+				return fmt.Errorf("%w: key %v out of order in node %d", ErrBadBtree, p.Key, n.blkno)
+			}
+		}
+		return nil
+	})
+}
+
+// Records 返回树中的全部记录
+func (ctx *BtreeContext[TKey, TRec]) Records() ([]TRec, error) {
+	var recs []TRec
+	err := ctx.walk(func(n *btNode[TRec], lo, hi *TRec) error {
+		recs = append(recs, n.recs...)
+		return nil
+	})
+	return recs, err
+}
+
+// Blocks 返回根节点以外的所有节点占用的块
+func (ctx *BtreeContext[TKey, TRec]) Blocks() ([]uint64, error) {
+	var blks []uint64
+	err := ctx.walk(func(n *btNode[TRec], lo, hi *TRec) error {
+		if n.blkno != ctx.root {
+			blks = append(blks, n.blkno)
+		}
+		return nil
+	})
+	return blks, err
+}
+
+// BlocksNeeded 返回 Build 容纳 nrecs 条记录需要的块数（不含根节点）
+func (ctx *BtreeContext[TKey, TRec]) BlocksNeeded(nrecs int) int {
+	total := 0
+	count := (nrecs + ctx.capacity(0) - 1) / ctx.capacity(0)
+	for count > 1 {
+		total += count
+		count = (count + ctx.capacity(1) - 1) / ctx.capacity(1)
+	}
+	return total
+}
+
+// Build 用 recs 重新建立整棵树，每个节点都尽量填满。blocks 是根节点以外的节点使用的块，
+// 至少要有 BlocksNeeded(len(recs)) 块，多余的不会被使用
+func (ctx *BtreeContext[TKey, TRec]) Build(recs []TRec, blocks []uint64) error {
+	sorted := append([]TRec{}, recs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Less(sorted[j]) })
+	if ctx.BlocksNeeded(len(sorted)) > len(blocks) {
+		return ErrNoSpace
+	}
+	var level []*btNode[TRec]
+	for i := 0; i == 0 || i < len(sorted); i += ctx.capacity(0) {
+		end := i + ctx.capacity(0)
+		if end > len(sorted) {
+			end = len(sorted)
+		}
+		level = append(level, &btNode[TRec]{recs: sorted[i:end]})
+	}
+	for len(level) > 1 {
+		var parents []*btNode[TRec]
+		for i, n := range level {
+			n.blkno, blocks = blocks[0], blocks[1:]
+			if i > 0 {
+				n.left = level[i-1].blkno
+				level[i-1].right = n.blkno
+			}
+		}
+		for i, n := range level {
+			if err := ctx.writeNode(n); err != nil {
+				return err
+			}
+			if i%ctx.capacity(n.level+1) == 0 {
+				parents = append(parents, &btNode[TRec]{level: n.level + 1})
+			}
+			p := parents[len(parents)-1]
+			p.ptrs = append(p.ptrs, DBtreePtr[TRec]{Key: n.lowKey(), Ptr: n.blkno})
+		}
+		level = parents
+	}
+	level[0].blkno = ctx.root
+	return ctx.writeNode(level[0])
+}
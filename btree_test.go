@@ -1,13 +1,15 @@
 package main
 
 import (
+	"math/rand"
+	"strings"
 	"testing"
 )
 
 func TestNewBtreeContext(t *testing.T) {
 	// 1KB
-	blockcount := uint64(1 * 1024 / BlockSize)
-	dev, err := NewFileBlockDevice("./btree.bin", blockcount)
+	blockcount := uint64(1 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
 	if err != nil {
 		t.Error(err)
 	}
@@ -28,16 +30,222 @@ func TestNewBtreeContext(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	rec, err, exact := ctx.Get(123)
+	rec, err, exact := ctx.Get(999)
 	if err != nil {
 		t.Error(err)
 	}
 	if rec.StartBlock != 123 || rec.BlockCount != 999 || !exact {
 		t.Error("rec is not correct")
 	}
-	ctx.Del(123)
-	_, _, exact = ctx.Get(123)
+	ctx.Del(999)
+	_, _, exact = ctx.Get(999)
 	if exact == true {
 		t.Error("rec is not deleted")
 	}
 }
+
+// testNodeAlloc 从 next 开始顺序分配节点，释放的节点优先复用
+type testNodeAlloc struct {
+	next  uint64
+	freed []uint64
+	inUse int
+}
+
+func (a *testNodeAlloc) AllocNode() (uint64, error) {
+	a.inUse++
+	if n := len(a.freed); n > 0 {
+		blkno := a.freed[n-1]
+		a.freed = a.freed[:n-1]
+		return blkno, nil
+	}
+	a.next++
+	return a.next - 1, nil
+}
+
+func (a *testNodeAlloc) FreeNode(blkno uint64) error {
+	a.inUse--
+	a.freed = append(a.freed, blkno)
+	return nil
+}
+
+func TestBtreeSplitMerge(t *testing.T) {
+	raw, err := NewMemBlockDevice(4096, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := withFeatures(raw, &Superblock{FeatIncompat: FeatIncompatBtree})
+	alloc := &testNodeAlloc{next: 2}
+	ctx := NewBtreeContext[uint64, DFreeBlockBtRec](dev, 1).WithAllocator(alloc)
+	if err = ctx.InitBlock(); err != nil {
+		t.Fatal(err)
+	}
+	// 很多记录的键相同，只靠 StartBlock 区分
+	rng := rand.New(rand.NewSource(1))
+	const n = 2000
+	recs := make([]DFreeBlockBtRec, n)
+	for i, p := range rng.Perm(n) {
+		recs[i] = DFreeBlockBtRec{BlockCount: uint64(p%50 + 1), StartBlock: uint64(p)}
+		if err = ctx.Set(recs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ctx.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := ctx.Height(); h < 3 {
+		t.Errorf("height is %d after %d inserts", h, n)
+	}
+	blks, err := ctx.Blocks()
+	if err != nil || len(blks) != alloc.inUse {
+		t.Errorf("tree has %d blocks, allocator gave out %d: %v", len(blks), alloc.inUse, err)
+	}
+	rec, err := ctx.GetFirstMeet(50)
+	if err != nil || rec == nil || rec.BlockCount != 50 || rec.StartBlock != 49 {
+		t.Errorf("GetFirstMeet(50) is %v, %v", rec, err)
+	}
+	if rec, err = ctx.GetFirstMeet(51); err != nil || rec != nil {
+		t.Errorf("GetFirstMeet(51) is %v, %v", rec, err)
+	}
+	if rec, err = ctx.Last(); err != nil || *rec != (DFreeBlockBtRec{BlockCount: 50, StartBlock: 1999}) {
+		t.Errorf("Last() is %v, %v", rec, err)
+	}
+
+	// 删掉大部分记录，树应当合并节点并变矮
+	for i, p := range rng.Perm(n) {
+		if i == n-10 {
+			break
+		}
+		if err = ctx.Delete(recs[p]); err != nil {
+			t.Fatalf("delete %v: %v", recs[p], err)
+		}
+		if i%250 == 0 {
+			if err = ctx.Check(); err != nil {
+				t.Fatalf("after %d deletes: %v", i+1, err)
+			}
+		}
+	}
+	if err = ctx.Delete(DFreeBlockBtRec{BlockCount: 1000}); err != ErrNoEntry {
+		t.Errorf("delete missing record: err is %v not %v", err, ErrNoEntry)
+	}
+	left, err := ctx.Records()
+	if err != nil || len(left) != 10 {
+		t.Fatalf("%d records left: %v", len(left), err)
+	}
+	if h, _ := ctx.Height(); h != 1 || alloc.inUse != 0 {
+		t.Errorf("height %d with %d blocks in use after deletes", h, alloc.inUse)
+	}
+
+	// Build 和逐条插入得到相同的记录
+	if err = ctx.Build(recs, alloc.freed); err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.Check(); err != nil {
+		t.Fatal(err)
+	}
+	built, err := ctx.Records()
+	if err != nil || len(built) != n {
+		t.Errorf("Build: %d records, %v", len(built), err)
+	}
+	if blks, _ = ctx.Blocks(); len(blks) != ctx.BlocksNeeded(n) {
+		t.Errorf("Build used %d blocks, BlocksNeeded is %d", len(blks), ctx.BlocksNeeded(n))
+	}
+}
+
+func TestBtreeAgFreeSpace(t *testing.T) {
+	dev, err := NewMemBlockDevice(2048, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 逐块分配后隔一块还回去一块，空闲区间多到需要多层的树
+	fsp := newAgFreeSpace(mp.AgCtx[0])
+	var blks []uint64
+	for {
+		blk, err := mp.AllocBlock(0, 1)
+		if err == ErrNoSpace {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+	for i := 0; i < len(blks); i += 2 {
+		if err = fsp.addExtent(blks[i], 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h, err := fsp.cntTree().Height(); err != nil || h < 2 {
+		t.Errorf("height is %d: %v", h, err)
+	}
+	// 其余的块被当作泄漏，重建空闲空间树后应当一致
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range report.Problems {
+		if !strings.Contains(p, "neither free nor in use") {
+			t.Errorf("fsck: %s", p)
+		}
+	}
+	if _, err = Fsck(dev, FsckOptions{Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Fsck(dev, FsckOptions{}); err != nil || !report.Clean() {
+		t.Errorf("fsck after repair: %v %v", err, report.Problems)
+	}
+	if mp, err = NewMountPoint(dev); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mp.AllocBlock(0, 100); err != nil {
+		t.Errorf("alloc after rebuild: %v", err)
+	}
+}
+
+func TestBtreeDeleteWithoutAllocator(t *testing.T) {
+	// Build 建成的多层树没有分配器，删除时不能合并节点，叶子删空之前返回 ErrNoSpace
+	raw, err := NewMemBlockDevice(4096, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := withFeatures(raw, &Superblock{FeatIncompat: FeatIncompatBtree})
+	ctx := NewBtreeContext[uint64, DFreeBlockBtRec](dev, 1)
+	const n = 2000
+	recs := make([]DFreeBlockBtRec, n)
+	for i := range recs {
+		recs[i] = DFreeBlockBtRec{BlockCount: uint64(i%50 + 1), StartBlock: uint64(i)}
+	}
+	blks := make([]uint64, ctx.BlocksNeeded(n))
+	for i := range blks {
+		blks[i] = uint64(2 + i)
+	}
+	if err = ctx.Build(recs, blks); err != nil {
+		t.Fatal(err)
+	}
+	deleted, refused := 0, 0
+	for _, p := range rand.New(rand.NewSource(1)).Perm(n) {
+		switch err = ctx.Delete(recs[p]); err {
+		case nil:
+			deleted++
+		case ErrNoSpace:
+			refused++
+		default:
+			t.Fatalf("delete %v: %v", recs[p], err)
+		}
+	}
+	if refused == 0 {
+		t.Error("emptied every leaf without an allocator")
+	}
+	if err = ctx.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if left, err := ctx.Records(); err != nil || len(left) != n-deleted {
+		t.Errorf("%d records left after %d deletes: %v", len(left), deleted, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// 元数据块（超级块、AGF、AGI、AGFL、B+ 树块和 inode 块）的最后 4 字节保留给校验和，
+// 内容是块中其余字节的 CRC32C。只有启用了 FeatRoCompatMetaCrc 的文件系统才计算和校验，
+// 旧镜像的这 4 字节总是 0，照常挂载
+
+// metaCrcSize 是元数据块末尾为校验和保留的字节数
+const metaCrcSize = 4
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// metaCrcEnabled 判断 dev 上的文件系统是否启用了元数据校验和
+func metaCrcEnabled(dev BlockDevice) bool {
+	return devFeatures(dev).RoCompat&FeatRoCompatMetaCrc != 0
+}
+
+// metaCrc 计算元数据块的校验和
+func metaCrc(blk []byte) uint32 {
+	return crc32.Checksum(blk[:len(blk)-metaCrcSize], crc32cTable)
+}
+
+// verifyMetaCrc 检查元数据块末尾的校验和
+func verifyMetaCrc(blk []byte) bool {
+	return binary.LittleEndian.Uint32(blk[len(blk)-metaCrcSize:]) == metaCrc(blk)
+}
+
+// readMetaBlock 读取一个元数据块，启用了校验和而校验失败时返回 ErrBadChecksum
+func readMetaBlock(dev BlockDevice, blkno uint64) ([]byte, error) {
+	blk, err := dev.ReadBlock(blkno)
+	if err != nil {
+		return nil, err
+	}
+	if metaCrcEnabled(dev) && !verifyMetaCrc(blk) {
+		return nil, ErrBadChecksum
+	}
+	return blk, nil
+}
+
+// writeMetaBlock 把 data 补齐到一块后写入，启用了校验和时在末尾写入校验和。
+// data 不能占用末尾为校验和保留的字节
+func writeMetaBlock(dev BlockDevice, blkno uint64, data []byte) error {
+	blk := Pad(data, int(dev.GetBlockSize()))
+	if metaCrcEnabled(dev) {
+		binary.LittleEndian.PutUint32(blk[len(blk)-metaCrcSize:], metaCrc(blk))
+	}
+	return dev.WriteBlock(blkno, blk)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// flipByte 翻转块中的一个字节，模拟静默的磁盘损坏
+func flipByte(t *testing.T, dev BlockDevice, blkno uint64, off int) {
+	data, err := dev.ReadBlock(blkno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[off] ^= 0xff
+	if err = dev.WriteBlock(blkno, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaChecksums(t *testing.T) {
+	blockcount := uint64(1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo, err := Makefs(dev, MkfsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo.Features.RoCompat&FeatRoCompatMetaCrc == 0 {
+		t.Fatal("checksums are not enabled by default")
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.mkdir(root, "dir", 0755, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := dev.Snapshot()
+
+	// inode 块中未使用的字节损坏也能发现
+	flipByte(t, dev, dir.ino, 200)
+	if _, err = fs.lookupPath("/dir"); err != ErrBadChecksum {
+		t.Errorf("lookup: err is %v not %v", err, ErrBadChecksum)
+	}
+	var out fuse.AttrOut
+	if code := fs.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: dir.ino}}, &out); code != fuse.EIO {
+		t.Errorf("GetAttr returned %v", code)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Clean() {
+		t.Error("fsck did not notice the corrupted inode")
+	}
+
+	cntroot := uint64(fs.mp.AgCtx[0].Agf.Meta.CntRoot)
+	for _, c := range []struct {
+		name  string
+		blkno uint64
+	}{
+		{"agf", 1},
+		{"agi", 2},
+		{"agfl", 3},
+	} {
+		dev.Restore(base)
+		flipByte(t, dev, c.blkno, 100)
+		if _, err = NewPoundFS(dev, MountOptions{}); err != ErrBadChecksum {
+			t.Errorf("%s: err is %v not %v", c.name, err, ErrBadChecksum)
+		}
+	}
+	// 主超级块校验失败时改用副本
+	dev.Restore(base)
+	flipByte(t, dev, 0, 100)
+	if _, err = loadSuperblock(dev); err != ErrBadChecksum {
+		t.Errorf("superblock: err is %v not %v", err, ErrBadChecksum)
+	}
+	if mp, err := NewMountPoint(dev); err != nil || mp.BackupAg == 0 {
+		t.Errorf("superblock: backup not used, err %v", err)
+	}
+	dev.Restore(base)
+	flipByte(t, dev, cntroot, DefaultBlockSize-1)
+	if _, err = fs.mp.AllocBlock(0, 1); err != ErrBadChecksum {
+		t.Errorf("btree: err is %v not %v", err, ErrBadChecksum)
+	}
+}
+
+func TestMetaChecksumsDisabled(t *testing.T) {
+	blockcount := uint64(1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{Features: &FeatureSet{}}); err != nil {
+		t.Fatal(err)
+	}
+	// 旧镜像的元数据块末尾是 0
+	data, _ := dev.ReadBlock(0)
+	for _, b := range data[DefaultBlockSize-metaCrcSize:] {
+		if b != 0 {
+			t.Fatalf("superblock tail is %x", data[DefaultBlockSize-metaCrcSize:])
+		}
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaCrcEnabled(fs.dev) {
+		t.Error("checksums enabled on an image without the feature")
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.mkdir(root, "dir", 0755, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	flipByte(t, dev, root.ino, 200)
+	if _, err = fs.lookupPath("/dir"); err != nil {
+		t.Errorf("lookup without checksums: %v", err)
+	}
+}
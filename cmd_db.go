@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stringList 用于可重复的命令行参数
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, "; ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// poundfs db [-c CMD]... -device IMAGE
+func cmdDb(args []string) error {
+	fset := flag.NewFlagSet("db", flag.ExitOnError)
+	device := fset.String("device", "", "image path")
+	var cmds stringList
+	fset.Var(&cmds, "c", "run the command and exit, may be repeated")
+	debug := fset.Bool("debug", false, "print debug data")
+	fset.Parse(args)
+	if *device == "" {
+		return fmt.Errorf("usage: %s", commandUsage("db"))
+	}
+	setupLogLevel(*debug, log.WarnLevel)
+
+	dev, err := OpenFileBlockDevice(*device, true)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	db := NewDbSession(dev, os.Stdout)
+	if len(cmds) > 0 {
+		for _, line := range cmds {
+			if err := db.Exec(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return db.Repl(os.Stdin)
+}
+
+// DbSession 是 poundfs db 的一次会话，只读地解析镜像中的元数据
+type DbSession struct {
+	dev BlockDevice
+	sb  *Superblock // 主超级块损坏时为 nil
+	out io.Writer
+}
+
+func NewDbSession(dev BlockDevice, out io.Writer) *DbSession {
+	sb, err := loadSuperblock(dev)
+	if err != nil {
+		fmt.Fprintf(out, "warning: cannot load primary superblock: %v\n", err)
+		// 用副本确定 AG 的位置，sb 0 仍然打印块 0 中损坏的内容
+		var agno uint32
+		if sb, agno, err = findBackupSuperblock(dev); err == nil {
+			fmt.Fprintf(out, "warning: using the backup superblock in AG %d\n", agno)
+		} else {
+			sb = nil
+		}
+	}
+	if sb != nil {
+		dev = withFeatures(dev, sb)
+	}
+	return &DbSession{dev: dev, sb: sb, out: out}
+}
+
+var dbHelp = [][2]string{
+	{"sb [AGNO]", "print the superblock of an AG (default 0)"},
+	{"agf AGNO", "print the AGF of an AG"},
+	{"agi AGNO", "print the AGI of an AG"},
+	{"agfl AGNO", "print the AGFL of an AG"},
+	{"btree BLKNO", "print the free space btree block at BLKNO"},
+	{"inode INO", "print the inode and its directory entries"},
+	{"path PATH", "walk PATH from the root directory and print each inode number"},
+	{"bmap INO", "print the block map of an inode"},
+	{"help", "print this help"},
+	{"quit", "exit"},
+}
+
+// Repl 逐行读取并执行命令
+func (db *DbSession) Repl(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(db.out, "poundfs_db> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(db.out)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "quit" || line == "q" {
+			return nil
+		}
+		if err := db.Exec(line); err != nil {
+			fmt.Fprintln(db.out, "error:", err)
+		}
+	}
+}
+
+// Exec 执行一条命令
+func (db *DbSession) Exec(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd, args := fields[0], fields[1:]
+	switch cmd {
+	case "help":
+		for _, h := range dbHelp {
+			fmt.Fprintf(db.out, "%-14s %s\n", h[0], h[1])
+		}
+		return nil
+	case "sb":
+		if len(args) == 0 {
+			args = []string{"0"}
+		}
+		agno, err := parseDbArg(args, 0)
+		if err != nil {
+			return err
+		}
+		return dbPrintAgMeta[Superblock](db, uint32(agno), SuperBlockMagicNum)
+	case "agf", "agi", "agfl":
+		agno, err := parseDbArg(args, 0)
+		if err != nil {
+			return err
+		}
+		switch cmd {
+		case "agf":
+			return dbPrintAgMeta[Agf](db, uint32(agno), AgfMagicNum)
+		case "agi":
+			return dbPrintAgMeta[Agi](db, uint32(agno), AgiMagicNum)
+		default:
+			return dbPrintAgMeta[Agfl](db, uint32(agno), AgflMagicNum)
+		}
+	case "btree":
+		blkno, err := parseDbArg(args, 0)
+		if err != nil {
+			return err
+		}
+		return db.printBtree(blkno)
+	case "inode":
+		ino, err := parseDbArg(args, 0)
+		if err != nil {
+			return err
+		}
+		return db.printInode(ino)
+	case "path":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: path PATH")
+		}
+		return db.walkPath(args[0])
+	case "bmap":
+		ino, err := parseDbArg(args, 0)
+		if err != nil {
+			return err
+		}
+		return db.printBmap(ino)
+	}
+	return fmt.Errorf("unknown command %q, try help", cmd)
+}
+
+func parseDbArg(args []string, i int) (uint64, error) {
+	if i >= len(args) {
+		return 0, fmt.Errorf("missing argument")
+	}
+	// 支持 0x 前缀
+	return strconv.ParseUint(args[i], 0, 64)
+}
+
+func dbPrintAgMeta[T AgMetaType](db *DbSession, agno uint32, magic uint32) error {
+	if db.sb == nil {
+		if agno != 0 {
+			return fmt.Errorf("primary superblock is damaged, AG location unknown")
+		}
+	} else if agno >= db.sb.AgCount {
+		return ErrOutOfRange
+	}
+	agblocks := uint32(0)
+	if db.sb != nil {
+		agblocks = db.sb.AgBlocks
+	}
+	ctx := NewAgMetaCtx[T](db.dev, agno, agblocks)
+	if err := ctx.Load(); err != nil {
+		return err
+	}
+	var instance T
+	fmt.Fprintf(db.out, "%s of AG %d at block %d\n", reflect.TypeOf(instance).Name(),
+		agno, uint64(agblocks)*uint64(agno)+getBlkOff(instance))
+	if got := reflect.ValueOf(ctx.Meta).Elem().FieldByName("MagicNum").Uint(); got != uint64(magic) {
+		fmt.Fprintf(db.out, "warning: bad magic 0x%x, expected 0x%x\n", got, magic)
+	}
+	printFields(db.out, ctx.Meta)
+	return nil
+}
+
+func (db *DbSession) printBtree(blkno uint64) error {
+	data, err := db.dev.ReadBlock(blkno)
+	if err != nil {
+		return err
+	}
+	db.checkCrc(blkno, data)
+	magic := binary.LittleEndian.Uint32(data[:4])
+	if magic != BtreeNodeMagicNum {
+		if magic != BtreeBlockMagicNum {
+			fmt.Fprintf(db.out, "warning: bad magic 0x%x, expected 0x%x or 0x%x\n", magic, BtreeNodeMagicNum, BtreeBlockMagicNum)
+		}
+		var blk DBtreeBlock[DFreeBlockBtRec]
+		if err := StructOf(data, &blk); err != nil {
+			return err
+		}
+		fmt.Fprintf(db.out, "MagicNum = 0x%x\nNumRecs = %d\nBlkNo = %d\n", blk.MagicNum, blk.NumRecs, blk.BlkNo)
+		printFreeRecs(db.out, blk.Recs)
+		return nil
+	}
+	if binary.LittleEndian.Uint32(data[btreeLevelOff:]) == 0 {
+		var blk DBtreeNode[DFreeBlockBtRec]
+		if err := StructOf(data, &blk); err != nil {
+			return err
+		}
+		printBtreeHeader(db.out, blk.MagicNum, blk.NumRecs, blk.BlkNo, blk.Level, blk.LeftSib, blk.RightSib)
+		printFreeRecs(db.out, blk.Recs)
+		return nil
+	}
+	var blk DBtreeNode[DBtreePtr[DFreeBlockBtRec]]
+	if err := StructOf(data, &blk); err != nil {
+		return err
+	}
+	printBtreeHeader(db.out, blk.MagicNum, blk.NumRecs, blk.BlkNo, blk.Level, blk.LeftSib, blk.RightSib)
+	for i, p := range blk.Recs {
+		fmt.Fprintf(db.out, "ptr[%d] = start %d, count %d -> block %d\n", i, p.Key.StartBlock, p.Key.BlockCount, p.Ptr)
+	}
+	return nil
+}
+
+func printBtreeHeader(out io.Writer, magic uint32, numRecs uint32, blkno uint64, level uint32, left uint64, right uint64) {
+	fmt.Fprintf(out, "MagicNum = 0x%x\nNumRecs = %d\nBlkNo = %d\nLevel = %d\nLeftSib = %d\nRightSib = %d\n",
+		magic, numRecs, blkno, level, left, right)
+}
+
+func printFreeRecs(out io.Writer, recs []DFreeBlockBtRec) {
+	for i, rec := range recs {
+		fmt.Fprintf(out, "rec[%d] = start %d, count %d\n", i, rec.StartBlock, rec.BlockCount)
+	}
+}
+
+// checkCrc 在启用了校验和的文件系统上检查元数据块，不一致时只给出警告以便继续查看
+func (db *DbSession) checkCrc(blkno uint64, data []byte) {
+	if metaCrcEnabled(db.dev) && !verifyMetaCrc(data) {
+		fmt.Fprintf(db.out, "warning: block %d has bad checksum 0x%x, expected 0x%x\n",
+			blkno, binary.LittleEndian.Uint32(data[len(data)-metaCrcSize:]), metaCrc(data))
+	}
+}
+
+// loadInode 读取 inode，magic 错误时仍然解析以便查看
+func (db *DbSession) loadInode(ino uint64) (*InoContext, error) {
+	data, err := db.dev.ReadBlock(ino)
+	if err != nil {
+		return nil, err
+	}
+	if !CheckMagic(data[:2], InodeMagic) {
+		fmt.Fprintf(db.out, "warning: block %d has bad inode magic 0x%x\n", ino, data[:2])
+	}
+	db.checkCrc(ino, data)
+	ctx := NewInoContext(db.dev, ino)
+	if err := ctx.fromBytes(data); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func (db *DbSession) printInode(ino uint64) error {
+	ctx, err := db.loadInode(ino)
+	if err != nil {
+		return err
+	}
+	inode := ctx.coreCache
+	printFields(db.out, inode)
+	fmt.Fprintf(db.out, "mode: %s\n", StrMode(inode.Mode))
+	for _, ts := range []struct {
+		name string
+		ts   uint64
+	}{{"atime", inode.Atime}, {"mtime", inode.Mtime}, {"ctime", inode.Ctime}, {"crtime", inode.Crtime}} {
+		fmt.Fprintf(db.out, "%s: %s\n", ts.name, time.Unix(0, int64(ts.ts)).Format(time.RFC3339Nano))
+	}
+	if ctx.dirSfHdr != nil {
+		hdr := ctx.dirSfHdr
+		fmt.Fprintf(db.out, "DirSfHdr.Count = %d\nDirSfHdr.Parent = %d\n", hdr.Count, hdr.Parent)
+		for i, ent := range hdr.Entries {
+			fmt.Fprintf(db.out, "entry[%d] = ino %d, name %q\n", i, ent.Ino, string(ent.Name))
+		}
+	}
+	if ctx.extents != nil {
+		fmt.Fprintf(db.out, "DExtentList.Count = %d\n", ctx.extents.Count)
+		for i, ext := range ctx.extents.Extents {
+			fmt.Fprintf(db.out, "extent[%d] = off %d, start %d, len %d\n", i, ext.Off, ext.Start, ext.Len)
+		}
+	}
+	return nil
+}
+
+func (db *DbSession) rootIno() (uint64, error) {
+	if db.sb == nil {
+		return 0, fmt.Errorf("primary superblock is damaged")
+	}
+	agi := NewAgMetaCtx[Agi](db.dev, 0, db.sb.AgBlocks)
+	if err := agi.Load(); err != nil {
+		return 0, err
+	}
+	return uint64(agi.Meta.Root), nil
+}
+
+func (db *DbSession) walkPath(path string) error {
+	ino, err := db.rootIno()
+	if err != nil {
+		return err
+	}
+	ctx := NewInoContext(db.dev, ino)
+	if err := ctx.LoadInode(); err != nil {
+		return err
+	}
+	fmt.Fprintf(db.out, "/ => %d\n", ino)
+	walked := ""
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		walked += "/" + name
+		child, err := ctx.GetChild(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", walked, err)
+		}
+		fmt.Fprintf(db.out, "%s => %d\n", walked, child.ino)
+		ctx = child
+	}
+	return nil
+}
+
+func (db *DbSession) printBmap(ino uint64) error {
+	ctx, err := db.loadInode(ino)
+	if err != nil {
+		return err
+	}
+	n := ctx.coreCache.NLocBlk
+	if n == 0 {
+		fmt.Fprintln(db.out, "no data blocks")
+		return nil
+	}
+	// 合并连续的映射
+	var startV, startP, prevP uint64
+	for v := uint64(0); v <= n; v++ {
+		var p uint64
+		if v < n {
+			if p, err = ctx.Bmap(v); err != nil {
+				return err
+			}
+			if v > 0 && p == prevP+1 {
+				prevP = p
+				continue
+			}
+		}
+		if v > 0 {
+			fmt.Fprintf(db.out, "%d-%d => %d-%d (%d blocks)\n", startV, v-1, startP, prevP, v-startV)
+		}
+		startV, startP, prevP = v, p, p
+	}
+	return nil
+}
+
+// printFields 以 "名称 = 值" 的形式打印结构体的每个字段
+func printFields(w io.Writer, v any) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rv.Field(i)
+		name := rt.Field(i).Name
+		switch field.Kind() {
+		case reflect.Slice:
+			continue
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if strings.Contains(name, "Magic") {
+				fmt.Fprintf(w, "%s = 0x%x\n", name, field.Uint())
+				continue
+			}
+		}
+		fmt.Fprintf(w, "%s = %v\n", name, field.Interface())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestDbSession(t *testing.T) {
+	// 10MB
+	blockcount := uint64(10 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out fuse.CreateOut
+	code := fs.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: RootIno}, Mode: S_IFREG | 0644}, "file", &out)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+
+	var buf bytes.Buffer
+	db := NewDbSession(dev, &buf)
+	cases := map[string]string{
+		"sb 1":       "SeqNo = 1",
+		"agf 0":      "CntRoot = 6",
+		"agi 0":      "Root = 7",
+		"agfl 3":     "MagicNum = 0x4c464741",
+		"btree 5":    "rec[0] = start ",
+		"inode 7":    `name "file"`,
+		"path /file": "/file =>",
+		"help":       "bmap INO",
+		"inode 0x7":  "DirSfHdr.Count = 1",
+		"sb":         "AgCount = 4",
+		"path /":     "/ => 7",
+		"agf 0x0":    "BnoRoot = 5",
+		"btree 0x6":  "NumRecs = 1\n",
+		"sb 0":       "BlockSize = 512",
+		"agi 2":      "SeqNo = 2",
+		"bmap 7":     "no data blocks",
+	}
+	ino := out.NodeId
+	cases[fmt.Sprintf("bmap %d", ino)] = fmt.Sprintf("0-15 => %d-%d (16 blocks)", ino+1, ino+16)
+	cases[fmt.Sprintf("inode %d", ino)] = "mode: -rw-r--r--"
+	cases["path //file/"] = fmt.Sprintf("/file => %d", ino)
+	for cmd, want := range cases {
+		buf.Reset()
+		if err := db.Exec(cmd); err != nil {
+			t.Errorf("%s: %v", cmd, err)
+			continue
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s: output does not contain %q:\n%s", cmd, want, buf.String())
+		}
+	}
+	for _, cmd := range []string{"agf 4", "nope", "path /missing", "inode"} {
+		if err := db.Exec(cmd); err == nil {
+			t.Errorf("%s: expected error", cmd)
+		}
+	}
+}
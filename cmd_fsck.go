@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// poundfs fsck [-repair] -device IMAGE
+func cmdFsck(args []string) error {
+	fset := flag.NewFlagSet("fsck", flag.ExitOnError)
+	device := fset.String("device", "", "image path")
+	repair := fset.Bool("repair", false, "repair the problems found")
+	debug := fset.Bool("debug", false, "print debug data")
+	fset.Parse(args)
+	if *device == "" {
+		return fmt.Errorf("usage: %s", commandUsage("fsck"))
+	}
+	setupLogLevel(*debug, log.WarnLevel)
+
+	dev, err := OpenFileBlockDevice(*device, !*repair)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	report, err := Fsck(dev, FsckOptions{Repair: *repair})
+	if report != nil {
+		printFsckReport(report)
+	}
+	if err != nil {
+		return err
+	}
+	if report.Clean() {
+		return nil
+	}
+	if !*repair {
+		return fmt.Errorf("%d problems found", len(report.Problems))
+	}
+	// 修复后再检查一遍
+	report, err = Fsck(dev, FsckOptions{})
+	if err != nil {
+		return err
+	}
+	if !report.Clean() {
+		fmt.Println("problems remaining after repair:")
+		printFsckReport(report)
+		return fmt.Errorf("%d problems remain", len(report.Problems))
+	}
+	fmt.Println("filesystem is clean after repair")
+	return nil
+}
+
+func printFsckReport(report *FsckReport) {
+	if report.Dirty {
+		fmt.Fprintln(os.Stdout, "filesystem was not cleanly unmounted")
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintln(os.Stdout, Red("problem: ")+p)
+	}
+	for _, r := range report.Repairs {
+		fmt.Fprintln(os.Stdout, Green("repaired: ")+r)
+	}
+	fmt.Printf("%d inodes (%d directories), %d used blocks, %d free blocks, %d problems\n",
+		report.Inodes, report.Dirs, report.UsedBlocks, report.FreeBlocks, len(report.Problems))
+}
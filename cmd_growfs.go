@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FUSE 文件系统的 statfs f_type
+const fuseSuperMagic = 0x65735546
+
+// poundfs growfs -size SIZE -device IMAGE    离线扩容
+// poundfs growfs -size SIZE MOUNTPOINT       通过挂载中的 poundfs 在线扩容
+func cmdGrowfs(args []string) error {
+	fset := flag.NewFlagSet("growfs", flag.ExitOnError)
+	sizeStr := fset.String("size", "", "new filesystem size, e.g. 128M, 2G")
+	device := fset.String("device", "", "image path (offline)")
+	debug := fset.Bool("debug", false, "print debug data")
+	fset.Parse(args)
+	setupLogLevel(*debug, log.WarnLevel)
+
+	if *sizeStr == "" || (*device == "") == (fset.NArg() == 0) || fset.NArg() > 1 {
+		return fmt.Errorf("usage: %s", commandUsage("growfs"))
+	}
+	size, err := ParseSize(*sizeStr)
+	if err != nil {
+		return err
+	}
+
+	if *device == "" {
+		mountpoint := fset.Arg(0)
+		// 普通目录也可能接受 user.* 扩展属性，必须确认是 FUSE 挂载点
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(mountpoint, &st); err != nil {
+			return fmt.Errorf("%s: %v", mountpoint, err)
+		}
+		if st.Type != fuseSuperMagic {
+			return fmt.Errorf("%s is not a mounted poundfs, use -device for an image", mountpoint)
+		}
+		// 块大小只有挂载中的 poundfs 知道，因此传递字节数
+		value := []byte(strconv.FormatUint(size, 10))
+		if err := syscall.Setxattr(mountpoint, GrowfsXAttr, value, 0); err != nil {
+			return fmt.Errorf("%s: %v", mountpoint, err)
+		}
+		fmt.Printf("%s: grown to %s\n", mountpoint, FormatSize(size))
+		return nil
+	}
+
+	dev, err := OpenFileBlockDevice(*device, false)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	newBlocks := size / uint64(dev.GetBlockSize())
+	if newBlocks > uint64(^uint32(0)) {
+		return fmt.Errorf("size %s is too large", FormatSize(size))
+	}
+	res, err := Growfs(dev, uint32(newBlocks))
+	if err == ErrOutOfRange {
+		return fmt.Errorf("%s: new size must be larger than the current size", *device)
+	}
+	if err == ErrAgToSmall {
+		return fmt.Errorf("%s: growing by less than %d blocks adds nothing", *device, MinAgBlocks)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d => %d blocks (%s), agcount %d => %d, agsize %d blks\n", *device,
+		res.OldBlocks, res.NewBlocks, FormatSize(uint64(res.NewBlocks)*uint64(dev.GetBlockSize())),
+		res.OldAgCount, res.NewAgCount, res.AgBlocks)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// poundfs info -device IMAGE
+func cmdInfo(args []string) error {
+	fset := flag.NewFlagSet("info", flag.ExitOnError)
+	device := fset.String("device", "", "image path")
+	debug := fset.Bool("debug", false, "print debug data")
+	fset.Parse(args)
+	if *device == "" || fset.NArg() != 0 {
+		return fmt.Errorf("usage: %s", commandUsage("info"))
+	}
+	setupLogLevel(*debug, log.WarnLevel)
+
+	dev, err := OpenFileBlockDevice(*device, true)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *device, err)
+	}
+	return printInfo(os.Stdout, mp)
+}
+
+// printInfo 打印主超级块中的文件系统信息
+func printInfo(w io.Writer, mp *MountPoint) error {
+	sb := mp.sb
+	total, err := FsTotalBlocks(mp.dev, sb)
+	if err != nil {
+		return err
+	}
+	uuid := sb.UUIDString()
+	if uuid == "" {
+		uuid = "none"
+	}
+	fmt.Fprintf(w, "uuid:        %s\n", uuid)
+	fmt.Fprintf(w, "label:       %s\n", sb.LabelString())
+	fmt.Fprintf(w, "version:     %d\n", sb.Version)
+	fmt.Fprintf(w, "features:    %v\n", sb.Features())
+	fmt.Fprintf(w, "blocksize:   %d\n", sb.BlockSize)
+	fmt.Fprintf(w, "blocks:      %d (%s)\n", total, FormatSize(uint64(total)*uint64(sb.BlockSize)))
+	fmt.Fprintf(w, "agcount:     %d\n", sb.AgCount)
+	fmt.Fprintf(w, "agsize:      %d blks\n", sb.AgBlocks)
+	st := mp.Statfs()
+	fmt.Fprintf(w, "free:        %d blks (%s), longest extent %d blks\n",
+		st.FreeBlocks, FormatSize(st.FreeBlocks*uint64(sb.BlockSize)), st.Longest)
+	fmt.Fprintf(w, "inodes:      %d used, %d free\n", st.Inodes, st.FreeInodes)
+	state := "clean"
+	if mp.Dirty() {
+		state = "dirty (not cleanly unmounted)"
+	}
+	fmt.Fprintf(w, "state:       %s\n", state)
+	fmt.Fprintf(w, "created:     %s\n", formatNsec(sb.Ctime))
+	fmt.Fprintf(w, "mounted:     %s\n", formatNsec(sb.MountTime))
+	fmt.Fprintf(w, "mount count: %d\n", sb.MountCount)
+	fmt.Fprintf(w, "written:     %s\n", formatNsec(sb.WriteTime))
+	return nil
+}
+
+// poundfs label -device IMAGE [LABEL]
+// 不给出 LABEL 时打印当前卷标
+func cmdLabel(args []string) error {
+	fset := flag.NewFlagSet("label", flag.ExitOnError)
+	device := fset.String("device", "", "image path")
+	debug := fset.Bool("debug", false, "print debug data")
+	fset.Parse(args)
+	if *device == "" || fset.NArg() > 1 {
+		return fmt.Errorf("usage: %s", commandUsage("label"))
+	}
+	setupLogLevel(*debug, log.WarnLevel)
+
+	readonly := fset.NArg() == 0
+	dev, err := OpenFileBlockDevice(*device, readonly)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	if readonly {
+		sb, err := loadSuperblock(dev)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *device, err)
+		}
+		fmt.Println(sb.LabelString())
+		return nil
+	}
+	label := fset.Arg(0)
+	if len(label) > SbLabelLen {
+		return fmt.Errorf("label %q is longer than %d bytes", label, SbLabelLen)
+	}
+	if err := SetFsLabel(dev, label); err != nil {
+		return fmt.Errorf("%s: %v", *device, err)
+	}
+	return dev.Sync()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// poundfs mkfs [-size SIZE] [-blocksize SIZE] [-agcount N] [-features LIST] [-L LABEL] [-root DIR] [-f] -o IMAGE
+func cmdMkfs(args []string) error {
+	fset := flag.NewFlagSet("mkfs", flag.ExitOnError)
+	sizeStr := fset.String("size", "", "image size, e.g. 64M, 1G (default: size of the existing image)")
+	bsStr := fset.String("blocksize", "512", "block size: 512, 1K, 2K or 4K")
+	agcount := fset.Uint("agcount", 0, "number of allocation groups (default: chosen from image size)")
+	featStr := fset.String("features", "", "comma separated features to enable, ^NAME disables one, none disables all (default: "+DefaultFeatures.String()+")")
+	label := fset.String("L", "", fmt.Sprintf("filesystem label, at most %d bytes", SbLabelLen))
+	rootDir := fset.String("root", "", "copy this host directory tree into the new image (default size: fitted to the tree)")
+	output := fset.String("o", "", "image path")
+	force := fset.Bool("f", false, "overwrite an existing non-empty image file")
+	debug := fset.Bool("debug", false, "print debug data")
+	fset.Parse(args)
+	setupLogLevel(*debug, log.WarnLevel)
+
+	if *output == "" {
+		return fmt.Errorf("usage: %s", commandUsage("mkfs"))
+	}
+	bs, err := ParseSize(*bsStr)
+	if err != nil {
+		return err
+	}
+	if bs > MaxBlockSize || !ValidBlockSize(uint32(bs)) {
+		return fmt.Errorf("%v: %s, must be one of 512, 1K, 2K, 4K", ErrBadBlockSize, *bsStr)
+	}
+	features, err := ParseFeatures(DefaultFeatures, *featStr)
+	if err != nil {
+		return err
+	}
+	if len(*label) > SbLabelLen {
+		return fmt.Errorf("label %q is longer than %d bytes", *label, SbLabelLen)
+	}
+	var usage *TreeUsage
+	if *rootDir != "" {
+		if usage, err = MeasureTree(*rootDir, uint32(bs)); err != nil {
+			return err
+		}
+	}
+	size, err := mkfsImageSize(*output, *sizeStr, *force, usage != nil)
+	if err != nil {
+		return err
+	}
+	opts := MkfsOptions{AgCount: uint32(*agcount), BlockSize: uint32(bs), Features: &features, Label: *label}
+	blockcount := size / bs
+	if size == 0 {
+		// 根据目录树自动选择大小
+		n, err := EstimateImageBlocks(usage, opts)
+		if err != nil {
+			return fmt.Errorf("%s: tree of %d blocks is too large", *rootDir, usage.Blocks)
+		}
+		blockcount = uint64(n)
+	}
+	if blockcount > uint64(^uint32(0)) {
+		return fmt.Errorf("image size %s is too large", FormatSize(blockcount*bs))
+	}
+	// 先校验布局，避免留下半成品镜像
+	if _, err := ComputeGeometry(uint32(blockcount), opts); err != nil {
+		if err == ErrAgToSmall && *agcount == 0 {
+			return fmt.Errorf("%v: %d blocks is smaller than the minimum AG size of %d blocks",
+				err, blockcount, MinAgBlocks)
+		}
+		if err == ErrAgToSmall {
+			return fmt.Errorf("%v: %d blocks cannot hold %d AGs of at least %d blocks",
+				err, blockcount, *agcount, MinAgBlocks)
+		}
+		return err
+	}
+
+	dev, err := NewFileBlockDevice(*output, blockcount, uint32(bs))
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	geo, err := Makefs(dev, opts)
+	if err != nil {
+		return err
+	}
+	if *rootDir != "" {
+		if err := PopulateFromDir(dev, *rootDir); err != nil {
+			return err
+		}
+	}
+	printGeometry(os.Stdout, *output, geo)
+	return nil
+}
+
+// mkfsImageSize 确定镜像大小，未指定 -f 时拒绝覆盖已有的非空文件。
+// autosize 为 true 且未指定大小时返回 0，由调用者根据内容决定大小
+func mkfsImageSize(path string, sizeStr string, force bool, autosize bool) (uint64, error) {
+	var size uint64
+	if sizeStr != "" {
+		var err error
+		size, err = ParseSize(sizeStr)
+		if err != nil {
+			return 0, err
+		}
+	}
+	fsize, err := GetFileSize(path)
+	if os.IsNotExist(err) {
+		if size == 0 && !autosize {
+			return 0, fmt.Errorf("%s does not exist, -size is required", path)
+		}
+		return size, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !force && hasSuperblockMagic(path) {
+		return 0, fmt.Errorf("%s already contains a poundfs filesystem, use -f to overwrite", path)
+	}
+	if !force && fsize > 0 {
+		return 0, fmt.Errorf("%s already exists and is not empty, use -f to overwrite", path)
+	}
+	if size == 0 && !autosize {
+		size = uint64(fsize)
+	}
+	return size, nil
+}
+
+func hasSuperblockMagic(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return CheckMagic(magic, SuperBlockMagicNum)
+}
+
+func printGeometry(w io.Writer, path string, geo *MkfsGeometry) {
+	fmt.Fprintf(w, "image=%s blocksize=%d blocks=%d (%s)\n",
+		path, geo.BlockSize, geo.TotalBlocks, FormatSize(uint64(geo.TotalBlocks)*uint64(geo.BlockSize)))
+	fmt.Fprintf(w, "uuid=%s version=%d features=%v\n", FormatUUID(geo.UUID), SbVersion, geo.Features)
+	fmt.Fprintf(w, "agcount=%d agsize=%d blks, last agsize=%d blks, free extents per AG=%d\n",
+		geo.AgCount, geo.AgBlocks, geo.AgBlocksLast, geo.FreeSplit)
+	fmt.Fprintf(w, "%-6s %-12s %-12s %-12s %s\n", "AG", "START", "BLOCKS", "DATA START", "FREE BLOCKS")
+	for agno := uint32(0); agno < geo.AgCount; agno++ {
+		start := agno * geo.AgBlocks
+		agsize := geo.AgSize(agno)
+		fmt.Fprintf(w, "%-6d %-12d %-12d %-12d %d\n",
+			agno, start, agsize, start+AgHeaderBlocks, agsize-AgHeaderBlocks)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// poundfs mount (-device IMAGE | -tmpfs SIZE) [-o OPTIONS] [-cache SIZE] [-writeback DURATION] [-force] [-logconf FILE] MOUNTPOINT
+func cmdMount(args []string) error {
+	fset := flag.NewFlagSet("mount", flag.ExitOnError)
+	device := fset.String("device", "", "image path")
+	tmpfs := fset.String("tmpfs", "", "mount a new in-memory filesystem of this size instead of an image")
+	optStr := fset.String("o", "", "mount options: ro,allow_other,uid=N,gid=N,fsname=NAME")
+	cacheStr := fset.String("cache", "16M", "block cache size, 0 disables the cache")
+	writeback := fset.Duration("writeback", 5*time.Second, "interval of writing dirty cached blocks back to the image")
+	force := fset.Bool("force", false, "mount read-write even if the filesystem was not cleanly unmounted")
+	logconf := fset.String("logconf", "", "log configuration file, reloaded on SIGHUP")
+	debug := fset.Bool("debug", false, "print debug data")
+	fset.Parse(args)
+	if (*device == "") == (*tmpfs == "") || fset.NArg() != 1 {
+		return fmt.Errorf("usage: %s", commandUsage("mount"))
+	}
+	setupLogLevel(*debug, log.InfoLevel)
+	defaultLevel := log.GetLevel()
+	if err := reloadLogConf(*logconf, defaultLevel); err != nil {
+		return err
+	}
+	opts, err := ParseMountOptions(*optStr)
+	if err != nil {
+		return err
+	}
+	opts.Force = *force
+
+	var dev BlockDevice
+	if *tmpfs != "" {
+		if opts.FsName == "" {
+			opts.FsName = "tmpfs"
+		}
+		// 内存设备不需要缓存，卸载后内容丢弃
+		dev, err = newTmpfsDevice(*tmpfs)
+		if err != nil {
+			return err
+		}
+	} else {
+		if opts.FsName == "" {
+			opts.FsName = *device
+		}
+		cacheSize, err := ParseSize(*cacheStr)
+		if err != nil {
+			return err
+		}
+		fileDev, err := OpenFileBlockDevice(*device, opts.ReadOnly)
+		if err != nil {
+			return err
+		}
+		defer fileDev.Close()
+		dev = fileDev
+		if cacheSize > 0 {
+			cache := NewCachedBlockDevice(fileDev, cacheSize)
+			cache.StartWriteback(*writeback)
+			// 在关闭镜像文件之前写回所有脏块
+			defer func() {
+				if err := cache.Close(); err != nil {
+					log.Errorf("%s: writing back cached blocks failed: %v", *device, err)
+				}
+				stats := cache.Stats()
+				log.Infof("block cache: %d hits, %d misses, %d blocks written back", stats.Hits, stats.Misses, stats.Writebacks)
+			}()
+			dev = cache
+		}
+	}
+	fs, err := NewPoundFS(dev, opts)
+	if err == ErrDirty {
+		return fmt.Errorf("%s: %v, run `poundfs fsck -repair`, mount with -o ro, or use -force", opts.FsName, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", opts.FsName, err)
+	}
+	fs.SetDebug(*debug)
+	mountpoint := fset.Arg(0)
+	server, err := fuse.NewServer(fs, mountpoint, fs.opts.FuseOptions(*debug))
+	if err != nil {
+		fs.Close()
+		return err
+	}
+	server.SetDebug(*debug)
+
+	// 在挂载之前注册，避免挂载期间收到的信号直接杀死进程
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigc)
+
+	served := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(served)
+	}()
+	if err := server.WaitMount(); err != nil {
+		fs.Close()
+		return err
+	}
+	log.Infof("%s mounted on %s", opts.FsName, mountpoint)
+
+	// 一直服务到被卸载（fusermount -u 或收到 SIGINT/SIGTERM）
+	for stop := false; !stop; {
+		select {
+		case <-served:
+			stop = true
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				if err := reloadLogConf(*logconf, defaultLevel); err != nil {
+					log.Errorf("reloading log settings failed: %v", err)
+				} else {
+					log.Infof("log settings reloaded")
+				}
+				continue
+			}
+			// Unmount 让内核停止发送新请求，并等待处理中的请求完成
+			log.Infof("received %v, unmounting %s", sig, mountpoint)
+			if err := server.Unmount(); err != nil {
+				log.Errorf("unmounting %s failed: %v, close the files in use and try again", mountpoint, err)
+			}
+		}
+	}
+
+	// 卸载后写回缓存、同步超级块并标记为 clean，进程被杀死时保持 dirty
+	if err := fs.Close(); err != nil {
+		return fmt.Errorf("%s: marking filesystem clean failed: %v", opts.FsName, err)
+	}
+	log.Infof("%s unmounted cleanly", opts.FsName)
+	return nil
+}
+
+// reloadLogConf 读取并应用日志配置文件，path 为空时只恢复 defaultLevel
+func reloadLogConf(path string, defaultLevel log.Level) error {
+	var conf LogConf
+	if path != "" {
+		var err error
+		if conf, err = LoadLogConf(path); err != nil {
+			return err
+		}
+	}
+	return applyLogConf(conf, defaultLevel)
+}
+
+// newTmpfsDevice 创建 sizeStr 大小的内存设备并格式化
+func newTmpfsDevice(sizeStr string) (*MemBlockDevice, error) {
+	size, err := ParseSize(sizeStr)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := NewMemBlockDevice(size/DefaultBlockSize, DefaultBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		return nil, fmt.Errorf("tmpfs: %v", err)
+	}
+	return dev, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 离线操作镜像的工具命令，不经过 FUSE，直接调用 PoundFS 中与 FUSE 处理函数相同的实现
+
+// withToolFS 解析工具命令的参数并打开镜像，用剩余的位置参数调用 fn。
+// 可写的命令结束后把文件系统标记为 clean
+func withToolFS(name string, args []string, nargs int, readonly bool, fn func(fs *PoundFS, pos []string) error) error {
+	fset := flag.NewFlagSet(name, flag.ExitOnError)
+	device := fset.String("device", "", "image path")
+	debug := fset.Bool("debug", false, "print debug data")
+	fset.Parse(args)
+	if *device == "" || fset.NArg() != nargs {
+		return fmt.Errorf("usage: %s", commandUsage(name))
+	}
+	setupLogLevel(*debug, log.WarnLevel)
+	dev, err := OpenFileBlockDevice(*device, readonly)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	fs, err := NewPoundFS(dev, MountOptions{ReadOnly: readonly})
+	if err != nil {
+		return fmt.Errorf("%s: %v", *device, err)
+	}
+	if !readonly && fs.opts.ReadOnly {
+		return fmt.Errorf("%s: %v", *device, ErrRoCompatFeature)
+	}
+	err = fn(fs, fset.Args())
+	if cerr := fs.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("%s: %v", *device, cerr)
+	}
+	return err
+}
+
+// lookupParent 查找 path 的父目录，并返回最后一级的名称
+func (fs *PoundFS) lookupParent(path string) (*InoContext, string, error) {
+	dir, name := pathpkg.Split(pathpkg.Clean("/" + path))
+	if name == "" {
+		return nil, "", ErrEntryExists
+	}
+	parent, err := fs.lookupPath(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.IsDir() {
+		return nil, "", ErrNotDirectory
+	}
+	return parent, name, nil
+}
+
+// poundfs ls -device IMAGE PATH
+func cmdLs(args []string) error {
+	return withToolFS("ls", args, 1, true, func(fs *PoundFS, pos []string) error {
+		ctx, err := fs.lookupPath(pos[0])
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[0], err)
+		}
+		if !ctx.IsDir() {
+			printLsLine(ctx, pathpkg.Base(pos[0]))
+			return nil
+		}
+		ents, err := ctx.GetEntries()
+		if err != nil {
+			return err
+		}
+		for _, ent := range ents {
+			child, err := ctx.GetChild(string(ent.Name))
+			if err != nil {
+				fmt.Printf("?????????? %s: %v\n", string(ent.Name), err)
+				continue
+			}
+			printLsLine(child, string(ent.Name))
+		}
+		return nil
+	})
+}
+
+func printLsLine(ctx *InoContext, name string) {
+	inode := ctx.coreCache
+	mtime := time.Unix(0, int64(inode.Mtime)).Format("2006-01-02 15:04")
+	fmt.Printf("%s %3d %5d %5d %8d %s %8d %s\n", StrMode(inode.Mode), inode.Nlink,
+		inode.Uid, inode.Gid, inode.Size, mtime, ctx.ino, name)
+}
+
+// poundfs cat -device IMAGE PATH
+func cmdCat(args []string) error {
+	return withToolFS("cat", args, 1, true, func(fs *PoundFS, pos []string) error {
+		ctx, err := fs.lookupPath(pos[0])
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[0], err)
+		}
+		if ctx.IsDir() {
+			return fmt.Errorf("%s: is a directory", pos[0])
+		}
+		ctx.noatime = true
+		data, err := readAll(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	})
+}
+
+// poundfs get -device IMAGE PATH HOSTFILE
+func cmdGet(args []string) error {
+	return withToolFS("get", args, 2, true, func(fs *PoundFS, pos []string) error {
+		ctx, err := fs.lookupPath(pos[0])
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[0], err)
+		}
+		if ctx.IsDir() {
+			return fmt.Errorf("%s: is a directory", pos[0])
+		}
+		ctx.noatime = true
+		data, err := readAll(ctx)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(pos[1], data, os.FileMode(ctx.coreCache.Mode&0777))
+	})
+}
+
+// poundfs put -device IMAGE HOSTFILE PATH
+func cmdPut(args []string) error {
+	return withToolFS("put", args, 2, false, func(fs *PoundFS, pos []string) error {
+		src, err := os.Open(pos[0])
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		fi, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s: not a regular file", pos[0])
+		}
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		parent, name, err := fs.lookupParent(pos[1])
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[1], err)
+		}
+		ctx, err := fs.createFile(parent, name, S_IFREG|uint32(fi.Mode().Perm()),
+			uint32(os.Getuid()), uint32(os.Getgid()), O_CREAT|O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[1], err)
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		_, err = fs.write(ctx, 0, data)
+		return err
+	})
+}
+
+// poundfs mkdir -device IMAGE PATH
+func cmdMkdir(args []string) error {
+	return withToolFS("mkdir", args, 1, false, func(fs *PoundFS, pos []string) error {
+		parent, name, err := fs.lookupParent(pos[0])
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[0], err)
+		}
+		_, err = fs.mkdir(parent, name, 0755, uint32(os.Getuid()), uint32(os.Getgid()))
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[0], err)
+		}
+		return nil
+	})
+}
+
+// poundfs rm -device IMAGE PATH，PATH 为目录时必须为空
+func cmdRm(args []string) error {
+	return withToolFS("rm", args, 1, false, func(fs *PoundFS, pos []string) error {
+		parent, name, err := fs.lookupParent(pos[0])
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[0], err)
+		}
+		child, err := parent.GetChild(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[0], err)
+		}
+		if child.IsDir() {
+			err = fs.rmdir(parent, name)
+		} else {
+			err = fs.unlink(parent, name)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", pos[0], err)
+		}
+		return nil
+	})
+}
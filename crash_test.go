@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// crashWorkload 通过 FUSE 接口执行一组会修改多个块的操作
+func crashWorkload(t *testing.T, fs *PoundFS) {
+	var dirOut fuse.EntryOut
+	if code := fs.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: RootIno}, Mode: 0755}, "dir", &dirOut); !code.Ok() {
+		t.Fatal("Mkdir", code)
+	}
+	var fileOut fuse.CreateOut
+	if code := fs.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: dirOut.NodeId}, Mode: S_IFREG | 0644}, "file", &fileOut); !code.Ok() {
+		t.Fatal("Create", code)
+	}
+	if _, code := fs.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: fileOut.NodeId}, Size: 5}, []byte("hello")); !code.Ok() {
+		t.Fatal("Write", code)
+	}
+	var nodeOut fuse.EntryOut
+	if code := fs.Mknod(nil, &fuse.MknodIn{InHeader: fuse.InHeader{NodeId: RootIno}, Mode: S_IFREG | 0600}, "node", &nodeOut); !code.Ok() {
+		t.Fatal("Mknod", code)
+	}
+	if code := fs.Rename(nil, &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: dirOut.NodeId}, Newdir: RootIno}, "file", "moved"); !code.Ok() {
+		t.Fatal("Rename", code)
+	}
+	if code := fs.Unlink(nil, &fuse.InHeader{NodeId: RootIno}, "node"); !code.Ok() {
+		t.Fatal("Unlink", code)
+	}
+}
+
+// TestCrashConsistency 记录工作负载的所有写入，在每一个写入前缀处模拟崩溃，
+// 检查得到的镜像能否被 fsck 读取，以及 fsck -repair 之后是否一致
+func TestCrashConsistency(t *testing.T) {
+	blockcount := uint64(1024 * 1024 / DefaultBlockSize)
+	mem, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(mem, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	base := mem.Snapshot()
+	rec := NewRecordingBlockDevice(mem)
+	fs, err := NewPoundFS(rec, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashWorkload(t, fs)
+	log := rec.Log()
+	if len(log) == 0 {
+		t.Fatal("workload wrote nothing")
+	}
+
+	inconsistent := 0
+	for n := 0; n <= len(log); n++ {
+		dev, err := ReplayWrites(base, DefaultBlockSize, log[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := Fsck(dev, FsckOptions{})
+		if err != nil {
+			t.Errorf("prefix %d/%d: fsck failed: %v", n, len(log), err)
+			continue
+		}
+		if report.Clean() {
+			continue
+		}
+		inconsistent++
+		t.Logf("prefix %d/%d: %v", n, len(log), report.Problems)
+		if _, err = Fsck(dev, FsckOptions{Repair: true}); err != nil {
+			t.Errorf("prefix %d/%d: repair failed: %v", n, len(log), err)
+			continue
+		}
+		if report, err = Fsck(dev, FsckOptions{}); err != nil || !report.Clean() {
+			t.Errorf("prefix %d/%d: not clean after repair: %v %v", n, len(log), err, report.Problems)
+		}
+	}
+	t.Logf("%d writes, %d inconsistent crash states", len(log), inconsistent)
+}
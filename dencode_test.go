@@ -1,6 +1,7 @@
 package main
 
 import (
+	"path/filepath"
 	"testing"
 )
 
@@ -31,5 +32,7 @@ func TestBytesOf(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	WriteBytesToFile(b, "test.bin")
+	if err = WriteBytesToFile(b, filepath.Join(t.TempDir(), "test.bin")); err != nil {
+		t.Error(err)
+	}
 }
@@ -64,24 +64,38 @@ type DirSfHdr struct {
 	Entries []DirSfEntry
 }
 
+// MaxNameLen 是文件名的最大长度，受 DirSfEntry.Namelen 限制
+const MaxNameLen = 255
+
 type DirSfEntry struct {
 	Ino     uint64 `struct:"uint64"`            // inode number
 	Namelen uint8  `struct:"uint8,sizeof=Name"` // 文件名长度
 	Name    []uint8
 }
 
+// inode 块内 datafork 的起始偏移
+const dataforkOff = 256
+
+// 目录项头部（Count 和 Parent）以及每个目录项固定部分（Ino 和 Namelen）的大小
+const (
+	dirSfHdrSize   = 1 + 8
+	dirSfEntrySize = 8 + 1
+)
+
 type InoContext struct {
 	dev       BlockDevice
 	ino       uint64 // inode blockno
 	coreCache *DInode
 	dirSfHdr  *DirSfHdr
+	extents   *DExtentList // FMT_EXTENTS 的区间列表，见 extent.go
+	noatime   bool // 为 true 时 Read 不更新 atime（只读挂载）
 }
 
 // const nreserve = 16 * 16
 
 func NewInoContext(dev BlockDevice, ino uint64) *InoContext {
 	return &InoContext{
-		dev, ino, nil, nil,
+		dev, ino, nil, nil, nil, false,
 	}
 }
 func (ctx *InoContext) InitInode(mode uint16) error {
@@ -109,10 +123,15 @@ func (ctx *InoContext) InitInode(mode uint16) error {
 	return ctx.SyncInode()
 }
 
+// blockSize 返回 inode 所在设备的块大小
+func (ctx *InoContext) blockSize() uint64 {
+	return uint64(ctx.dev.GetBlockSize())
+}
+
 func (ctx *InoContext) InitDataBlock() error {
-	databytes := make([]byte, BlockSize)
+	databytes := make([]byte, ctx.blockSize())
 	// fill 0xff
-	for i := 0; i < BlockSize; i++ {
+	for i := range databytes {
 		databytes[i] = EOF
 	}
 	for i := uint64(0); i < ctx.coreCache.NLocBlk; i++ {
@@ -148,7 +167,7 @@ func (ctx *InoContext) SetParent(parentIno uint64) error {
 	return ctx.SyncInode()
 }
 func (ctx *InoContext) ToBytes() ([]byte, error) {
-	blkBuf := make([]byte, BlockSize)
+	blkBuf := make([]byte, ctx.blockSize())
 	// 序列化 core
 	ino := ctx.coreCache
 	inoBytes, err := BytesOf(ino)
@@ -157,8 +176,7 @@ func (ctx *InoContext) ToBytes() ([]byte, error) {
 	}
 	copy(blkBuf, inoBytes)
 	// 序列化 datafork
-	// 从第 16 字节开始写 datafork
-	dataforkOff := 256
+	// 从第 256 字节开始写 datafork
 	// 仅针对目录
 	if ctx.dirSfHdr != nil {
 		// 写入 header 到 datafork
@@ -169,12 +187,19 @@ func (ctx *InoContext) ToBytes() ([]byte, error) {
 		}
 		copy(blkBuf[dataforkOff:], dirSfHdrBytes)
 	}
+	if ctx.extents != nil {
+		extBytes, err := BytesOf(ctx.extents)
+		if err != nil {
+			return nil, err
+		}
+		copy(blkBuf[dataforkOff:], extBytes)
+	}
 	return blkBuf, nil
 }
 
 func (ctx *InoContext) LoadInode() error {
-	blkBuf, err := ctx.dev.ReadBlock(ctx.ino)
-	logrus.Debugf("LoadInode of ino: %d loc=0x%x", ctx.ino, ctx.ino*BlockSize)
+	blkBuf, err := readMetaBlock(ctx.dev, ctx.ino)
+	logrus.Debugf("LoadInode of ino: %d loc=0x%x", ctx.ino, ctx.ino*ctx.blockSize())
 	if err != nil {
 		return err
 	}
@@ -207,7 +232,6 @@ func (ctx *InoContext) fromBytes(blkBuf []byte) error {
 	if ino.Mode&S_IFMT == S_IFDIR {
 		// 反序列化 datafork
 		// 从第 nreserve 字节开始读 datafork
-		dataforkOff := 256
 		// 读入 header 到 datafork
 		dirSfHdr := DirSfHdr{}
 		err = StructOf(blkBuf[dataforkOff:], &dirSfHdr)
@@ -216,6 +240,13 @@ func (ctx *InoContext) fromBytes(blkBuf []byte) error {
 		}
 		ctx.dirSfHdr = &dirSfHdr
 	}
+	if ino.Format == FMT_EXTENTS {
+		list := DExtentList{}
+		if err = StructOf(blkBuf[dataforkOff:], &list); err != nil {
+			return err
+		}
+		ctx.extents = &list
+	}
 	return nil
 }
 
@@ -297,25 +328,40 @@ func (ctx *InoContext) SyncInode() error {
 	if err != nil {
 		return err
 	}
-	logrus.Debugf("sync ino %d (loc: 0x%x) mode=%s", ctx.ino, ctx.ino*BlockSize, StrMode(ctx.coreCache.Mode))
-	return ctx.dev.WriteBlock(ctx.ino, Pad(blkBuf, BlockSize))
+	logrus.Debugf("sync ino %d (loc: 0x%x) mode=%s", ctx.ino, ctx.ino*ctx.blockSize(), StrMode(ctx.coreCache.Mode))
+	return writeMetaBlock(ctx.dev, ctx.ino, blkBuf)
 }
 
 func (ctx *InoContext) AddEntry(name string, ino uint64) error {
-	logrus.Debugf("add entry %s of ino %d loc 0x%x", name, ctx.ino, ctx.ino*BlockSize)
+	logrus.Debugf("add entry %s of ino %d loc 0x%x", name, ctx.ino, ctx.ino*ctx.blockSize())
 	if ctx.coreCache.Mode&S_IFMT != S_IFDIR {
 		return ErrNotDirectory
 	}
-	_, err := ctx.GetEntry(name)
-	if err == nil {
-		// return ErrEntryExists
+	// Namelen 只有一个字节，块较大时空间检查挡不住过长的文件名
+	if len(name) > MaxNameLen {
+		return ErrNameTooLong
+	}
+	dirSfHdr := ctx.dirSfHdr
+	// 短格式目录必须放得下 inode 块的 datafork，不能占用末尾的校验和。
+	// 同名的 entry 会被替换，不计入已用空间；先检查空间再修改，放不下时目录保持不变
+	used, count, exists := dirSfHdrSize, 0, false
+	for _, ent := range dirSfHdr.Entries {
+		if string(ent.Name) == name {
+			exists = true
+			continue
+		}
+		used += dirSfEntrySize + len(ent.Name)
+		count++
+	}
+	if count >= int(^uint8(0)) || used+dirSfEntrySize+len(name) > int(ctx.blockSize())-metaCrcSize-dataforkOff {
+		return ErrNoSpace
+	}
+	if exists {
 		// 删除原有的 entry
-		err = ctx.RemoveEntry(name)
-		if err != nil {
+		if err := ctx.RemoveEntry(name); err != nil {
 			return err
 		}
 	}
-	dirSfHdr := ctx.dirSfHdr
 	dirSfHdr.Count++
 	dirSfHdr.Entries = append(dirSfHdr.Entries, DirSfEntry{
 		Namelen: uint8(len(name)), Name: []uint8(name),
@@ -340,18 +386,16 @@ func (ctx *InoContext) GetEntry(name string) (uint64, error) {
 	return 0, ErrNoEntry
 }
 
-func locateEof(blkBuf []byte) (uint64, bool) {
-	for i := 0; i < len(blkBuf); i++ {
-		if blkBuf[i] == EOF {
-			return uint64(i), true
-		}
-	}
-	return 0, false
-}
-
+// Bmap 把文件内的块号转换为物理块号，超出已分配的数据块时返回 ErrOutOfRange
 func (ctx *InoContext) Bmap(blkno uint64) (uint64, error) {
-	if ctx.coreCache.Format == FMT_LOCAL {
+	if blkno >= ctx.coreCache.NLocBlk {
+		return 0, ErrOutOfRange
+	}
+	switch ctx.coreCache.Format {
+	case FMT_LOCAL:
 		return ctx.ino + 1 + blkno, nil
+	case FMT_EXTENTS:
+		return ctx.lookupExtent(blkno)
 	}
 	return 0, ErrNotImplemented
 }
@@ -359,203 +403,117 @@ func (ctx *InoContext) Bmap(blkno uint64) (uint64, error) {
 // Read 从当前文件 offset 开始读取 size 个字节到 bytes. 其中 size 不能超过 bytes 的长度.
 //  	如果 size 超过文件长度，则只读文件长度部分
 func (ctx *InoContext) Read(off uint64, bytes []byte) (uint64, error) {
-	fsize := ctx.coreCache.Size
-	if ctx.coreCache.Format == FMT_LOCAL {
-		vstartBlk := off / BlockSize
-		vendBlk := (off + uint64(len(bytes))) / BlockSize
-		// virtual file final block
-		vffinalBlk := fsize / BlockSize
-		if vendBlk > vffinalBlk {
-			logrus.Warn("read beyond file size")
-		}
-		// 已读字节数
-		readLen := uint64(0)
-		for vblk := vstartBlk; vblk <= vffinalBlk; vblk++ {
-			blk, err := ctx.Bmap(vblk)
-			if err != nil {
-				return 0, err
-			}
-			blkBuf, err := ctx.dev.ReadBlock(blk)
-			if err != nil {
-				return 0, err
-			}
-			// 如果是读第一个块，则要从偏移处截取
-			if vblk == vstartBlk {
-				start := uint64(off % BlockSize)
-				// 避免多读
-				end := Min(uint64(len(bytes)), BlockSize, fsize)
-				copy(bytes[0:0+end], blkBuf[start:end])
-				readLen += uint64(end - start)
-			} else if vblk == vendBlk {
-				// 如果是读取范围的最后一个块
-				// 有两种情况：是或不是此文件的最后一个块
-				if vblk == vffinalBlk {
-					// 是文件最后一个块，则不能超过 eof
-					end := fsize % BlockSize
-					copy(bytes[readLen:readLen+end], blkBuf[0:end])
-					readLen += uint64(end)
-				} else {
-					end := len(bytes) % BlockSize
-					copy(bytes[readLen:readLen+BlockSize], blkBuf[:end])
-					readLen += uint64(end)
-				}
-			} else {
-				// 对于中间块，可以直接全部读入
-				copy(bytes[readLen:], blkBuf)
-				readLen += BlockSize
-			}
+	bs := ctx.blockSize()
+	end := Min(off+uint64(len(bytes)), ctx.coreCache.Size)
+	// 已读字节数
+	readLen := uint64(0)
+	for pos := off; pos < end; pos = off + readLen {
+		blk, err := ctx.Bmap(pos / bs)
+		if err != nil {
+			return 0, err
 		}
-
-		// blkBytes, err := ctx.dev.ReadBlock(datablk)
-		// if err != nil {
-		// 	return 0, err
-		// }
-		// readLen = uint64(len(bytes))
-		// fsize := ctx.coreCache.Size
-		// if readLen > fsize {
-		// 	readLen = fsize
-		// }
-		// eof, hasEof := locateEof(blkBytes[off:])
-		// if hasEof {
-		// 	readLen = Min(readLen, uint64(eof))
-		// }
-		// copy(bytes, blkBytes[off:off+readLen])
-
-		// update atime
-		ctx.coreCache.Atime = GetTimestampNsec()
-		err := ctx.SyncInode()
+		blkBuf, err := ctx.dev.ReadBlock(blk)
 		if err != nil {
 			return 0, err
 		}
+		// 第一块从偏移处开始，最后一块不能超过 EOF
+		readLen += uint64(copy(bytes[readLen:end-off], blkBuf[pos%bs:]))
+	}
+	// update atime
+	if ctx.noatime {
 		return readLen, nil
 	}
-	return 0, ErrNotImplemented
+	ctx.coreCache.Atime = GetTimestampNsec()
+	err := ctx.SyncInode()
+	if err != nil {
+		return 0, err
+	}
+	return readLen, nil
 }
 
-// off 是文件内偏移
+// Write 把 bytes 写到文件偏移 off 处（文件内偏移）。写入的范围必须已经分配了数据块，
+// 否则返回 ErrOutOfRange，文件需要扩展时由 PoundFS.write 先分配。off 超过文件末尾时中间的部分填 0
 func (ctx *InoContext) Write(off uint64, bytes []byte) (length uint64, err error) {
-	eof, ok := locateEof(bytes)
-	if ok {
-		logrus.Warnf("write eof at offset %d", eof)
-	}
-
-	if ctx.coreCache.Format == FMT_LOCAL {
-		vstartBlk := off / BlockSize
-		vendBlk := (off + uint64(len(bytes))) / BlockSize
-		// TODO: 判断是否需要扩充文件
-		// 使用 offRead 指针指向下一次要从 bytes 中读的位置。它是对 bytes 而言的指针。
-		/*
-			分三种情况讨论
-			bytes:      |<------------->|
-			blocks:  |<----->|<----->|<----->|
-			            |offRead              读开头时，offRead 位于 0，读大小为 blocksize - off % blocksize。（BlockSize-start）
-						                      block 内的写入位置为：off % blocksize:blocksize
-			                 |offRead         读中间前，将 offRead 增加上次读取量，则对齐。读大小：往后读一个 block 即可（offRead:BlockSize）
-			                         |offRead 读结尾前和读中间的情况一样，只不过读大小为 bytes 中剩余的长度
-		*/
-		offRead := uint64(0)
-		// 此处的 vblk 是虚拟块号，这是因为实际文件可能处于一个绝对位置，或者分散在不同的磁盘位置
-		for vblk := vstartBlk; vblk <= vendBlk; vblk++ {
-			if offRead == uint64(len(bytes)) {
-				break
-			}
-			if offRead > uint64(len(bytes)) {
-				return 0, ErrUnreachable
-			}
-			// 转换为实际块号
-			blk, err := ctx.Bmap(vblk)
-			if err != nil {
-				return 0, err
-			}
-			startBlk, err := ctx.Bmap(vstartBlk)
-			if err != nil {
-				return 0, err
-			}
-			endBlk, err := ctx.Bmap(vendBlk)
-			if err != nil {
-				return 0, err
-			}
+	end := off + uint64(len(bytes))
+	if dataBlocks(end, ctx.dev.GetBlockSize()) > ctx.coreCache.NLocBlk {
+		return 0, ErrOutOfRange
+	}
+	if off > ctx.coreCache.Size {
+		if err := ctx.writeAt(ctx.coreCache.Size, off, nil); err != nil {
+			return 0, err
+		}
+	}
+	if err := ctx.writeAt(off, end, bytes); err != nil {
+		return 0, err
+	}
+	now := GetTimestampNsec()
+	ctx.coreCache.Atime = now
+	ctx.coreCache.Mtime = now
+	// update file size
+	if end > ctx.coreCache.Size {
+		ctx.coreCache.Size = end
+	}
+	err = ctx.SyncInode()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(bytes)), nil
+}
 
-			// 对于头尾的块，可能只需要写入一部分，因此先读再写
-			blkCur, err := ctx.dev.ReadBlock(blk)
-			if err != nil {
-				return 0, err
-			}
-			if blk == startBlk {
-				inBlockStart := off % BlockSize
-				inBytesEnd := Min(BlockSize-inBlockStart, uint64(len(bytes)))
-				copy(blkCur[inBlockStart:], bytes[0:inBytesEnd])
-				offRead += uint64(inBytesEnd)
-			} else if blk == endBlk {
-				inBlockEnd := off + uint64(len(bytes)) - offRead
-				copy(blkCur[:inBlockEnd], bytes[offRead:])
-				offRead += uint64(len(bytes[offRead:]))
-			} else {
-				copy(blkCur[:], bytes[offRead:offRead+BlockSize])
-				offRead += BlockSize
-			}
-			// 写回到磁盘块
-			err = ctx.dev.WriteBlock(blk, blkCur)
-			if err != nil {
-				return 0, err
-			}
+// writeAt 把 bytes 写到文件的 [off, end) 中，bytes 为 nil 时写 0。不修改 inode
+func (ctx *InoContext) writeAt(off uint64, end uint64, bytes []byte) error {
+	bs := ctx.blockSize()
+	for pos := off; pos < end; {
+		// 转换为实际块号
+		blk, err := ctx.Bmap(pos / bs)
+		if err != nil {
+			return err
 		}
-		// update atime
-		ctx.coreCache.Atime = GetTimestampNsec()
-		// update file size
-		if off+offRead > ctx.coreCache.Size {
-			ctx.coreCache.Size = off + offRead
+		inBlock := pos % bs
+		n := Min(bs-inBlock, end-pos)
+		// 对于头尾的块，可能只需要写入一部分，因此先读再写
+		var blkCur []byte
+		if n == bs {
+			blkCur = make([]byte, bs)
+		} else if blkCur, err = ctx.dev.ReadBlock(blk); err != nil {
+			return err
 		}
-		err = ctx.SyncInode()
-		if err != nil {
-			return 0, err
+		if bytes != nil {
+			copy(blkCur[inBlock:inBlock+n], bytes[pos-off:])
+		} else {
+			for i := inBlock; i < inBlock+n; i++ {
+				blkCur[i] = 0
+			}
+		}
+		// 写回到磁盘块
+		if err := ctx.dev.WriteBlock(blk, blkCur); err != nil {
+			return err
 		}
-		return offRead, nil
-
-		// totalLen := uint64(len(bytes))
-		// writtenLen := uint64(0)
-		// writeToBlk := ctx.ino + 1
-		// for writtenLen < totalLen {
-		// 	// 写块缓冲
-		// 	blkBytes := make([]byte, BlockSize)
-		// 	// 写入本块长度
-		// 	blkLen := Min(totalLen-writtenLen, BlockSize)
-		// 	copy(blkBytes, bytes[writtenLen:writtenLen+blkLen])
-		// 	err = ctx.dev.WriteBlock(writeToBlk, blkBytes)
-		// 	if err != nil {
-		// 		return 0, err
-		// 	}
-		// 	writtenLen += blkLen
-		// 	writeToBlk++
-		// }
-		// // 更新文件大小
-		// ctx.coreCache.Size = uint64(len(bytes) + int(off))
-		// err = ctx.dev.WriteBlock(datablk, blkBytes)
-		// if err != nil {
-		// 	return 0, err
-		// }
-		// err = ctx.SyncInode()
-		// if err != nil {
-		// 	return 0, err
-		// }
-		// // update mtime
-		// ctx.coreCache.Mtime = GetTimestampNsec()
-		// err = ctx.SyncInode()
-		// return totalLen, err
+		pos += n
 	}
-	return 0, ErrNotImplemented
+	return nil
 }
 
 // Truncate truncates the file to a given length.
 // We will not update it to the block device , you nede to call SyncInode to update it.
+// 变长时新的部分填 0，需要的数据块必须已经分配，否则返回 ErrOutOfRange；变短时不释放数据块，见 PoundFS.truncate
 func (ctx *InoContext) Truncate(size uint64) error {
-	if ctx.coreCache.Mode&S_IFMT == S_IFREG {
-		// 更新文件大小
-		ctx.coreCache.Size = uint64(size)
-		return nil
+	if ctx.coreCache.Mode&S_IFMT != S_IFREG {
+		return ErrNotImplemented
+	}
+	if size > ctx.coreCache.Size {
+		if dataBlocks(size, ctx.dev.GetBlockSize()) > ctx.coreCache.NLocBlk {
+			return ErrOutOfRange
+		}
+		if err := ctx.writeAt(ctx.coreCache.Size, size, nil); err != nil {
+			return err
+		}
 	}
-	return ErrNotImplemented
+	// 更新文件大小
+	ctx.coreCache.Size = uint64(size)
+	return nil
 }
+
 func (ctx *InoContext) GetChild(name string) (*InoContext, error) {
 	childIno, err := ctx.GetEntry(name)
 	if err != nil {
@@ -564,7 +522,7 @@ func (ctx *InoContext) GetChild(name string) (*InoContext, error) {
 	childCtx := NewInoContext(ctx.dev, childIno)
 	err = childCtx.LoadInode()
 	if err != nil {
-		logrus.Errorf("load inode %d (0x%x) failed: %v", childIno, childIno*BlockSize, err)
+		logrus.Errorf("load inode %d (0x%x) failed: %v", childIno, childIno*ctx.blockSize(), err)
 		return nil, err
 	}
 	return childCtx, nil
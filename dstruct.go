@@ -1,6 +1,9 @@
 package main
 
-import "reflect"
+import (
+	"reflect"
+	"sync"
+)
 
 // ======== 每个 AG 的前几部分 ========
 
@@ -12,6 +15,19 @@ type Superblock struct {
 	SeqNo     uint32 // AgNo
 	AgBlocks  uint32 // 表示一个 AG 有多少 blocks
 	AgCount   uint32 // 表示一共有多少 AG
+	// 以下字段在版本 0 的镜像中都是 0，见 features.go
+	Version      uint32 // 格式版本
+	FeatCompat   uint32 // 不认识也可以读写的特性
+	FeatRoCompat uint32 // 不认识时只能只读挂载的特性
+	FeatIncompat uint32 // 不认识时不能挂载的特性
+	// 以下字段在版本 0 的镜像中都是 0，见 fsinfo.go
+	UUID       [16]byte         // 文件系统 UUID，所有 AG 相同
+	Label      [SbLabelLen]byte // 卷标，不足时以 0 填充
+	Ctime      uint64           // 创建时间，纳秒
+	MountTime  uint64           // 最近一次读写挂载的时间，纳秒
+	MountCount uint32           // 读写挂载的次数
+	WriteTime  uint64           // 最近一次写入超级块的时间，纳秒
+	State      uint32           // SbStateClean 或 SbStateDirty，只在主超级块中维护
 }
 
 const AgfBtNum = 3
@@ -20,22 +36,33 @@ const AgiMagicNum = 0x494741    // "AGI"
 const AgflMagicNum = 0x4C464741 // "AGFL"
 
 type Agf struct {
-	MagicNum uint32
-	SeqNo    uint32
-	BnoRoot  uint32
-	CntRoot  uint32
+	MagicNum   uint32
+	SeqNo      uint32
+	BnoRoot    uint32
+	CntRoot    uint32
+	FreeBlocks uint32 // 空闲空间树中的块数，不包括 AGFL
+	Longest    uint32 // 最长的空闲区间的块数
 }
 
 type Agi struct {
-	MagicNum uint32
-	SeqNo    uint32
-	Root     uint32 // 根节点 inode root block
-	FreeRoot uint32
+	MagicNum  uint32
+	SeqNo     uint32
+	Root      uint32 // 根节点 inode root block
+	FreeRoot  uint32
+	Count     uint32 // 数据区中已分配的 inode 数，不包括 AG 头部的根目录 inode
+	FreeCount uint32 // 已分配但未使用的 inode 数。inode 逐个从空闲空间分配，目前总是 0
 }
 
+// AgflSize 是 AGFL 最多能保存的块数
+const AgflSize = 64
+
+// Agfl 保存为空闲空间 B+ 树预留的块，节点分裂时从这里取块，合并时放回，见 freespace.go。
+// 没有 btree 特性的镜像中 Count 总是 0
 type Agfl struct {
 	MagicNum uint32
 	SeqNo    uint32
+	Count    uint32
+	Blocks   [AgflSize]uint32
 }
 
 type AgMetaType interface{ Superblock | Agf | Agi | Agfl }
@@ -75,7 +102,7 @@ func getBlkOff[T AgMetaType](value T) uint64 {
 func (ctx *AgMetaCtx[T]) Load() error {
 	var instance T
 	blkoff := getBlkOff(instance)
-	bytes, err := ctx.Dev.ReadBlock(uint64(ctx.AgBlocks)*uint64(ctx.AgNo) + blkoff)
+	bytes, err := readMetaBlock(ctx.Dev, uint64(ctx.AgBlocks)*uint64(ctx.AgNo)+blkoff)
 	if err != nil {
 		return err
 	}
@@ -83,17 +110,33 @@ func (ctx *AgMetaCtx[T]) Load() error {
 	if err != nil {
 		return err
 	}
+	// 超级块自己记录了是否启用校验和
+	if sb, ok := any(&instance).(*Superblock); ok && sb.FeatRoCompat&FeatRoCompatMetaCrc != 0 && !verifyMetaCrc(bytes) {
+		return ErrBadChecksum
+	}
 	ctx.Meta = &instance
 	return nil
 
 }
 
+// Sync 把 Meta 写回磁盘
+func (ctx *AgMetaCtx[T]) Sync() error {
+	var instance T
+	blkoff := getBlkOff(instance)
+	bytes, err := BytesOf(ctx.Meta)
+	if err != nil {
+		return err
+	}
+	return writeMetaBlock(ctx.Dev, uint64(ctx.AgBlocks)*uint64(ctx.AgNo)+blkoff, bytes)
+}
+
 type AgCtx struct {
 	Superblock AgMetaCtx[Superblock]
 	Agf        AgMetaCtx[Agf]
 	Agi        AgMetaCtx[Agi]
 	Agfl       AgMetaCtx[Agfl]
 	agblocks   uint32
+	mu         sync.Mutex // 保护 AGF、AGI、AGFL 和空闲空间树，见 lock.go
 }
 
 func NewAgCtx(dev BlockDevice, agno uint32, agblocks uint32) *AgCtx {
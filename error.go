@@ -21,6 +21,21 @@ var ErrInvalidStructBytes = NewPdErr(5, "invalid struct bytes")
 var ErrNotImplemented = NewPdErr(6, "not implemented")
 var ErrNoSpace = NewPdErr(7, "no space")
 var ErrOutOfRange = NewPdErr(8, "out of range")
+var ErrNotEmpty = NewPdErr(9, "directory not empty")
+var ErrIsDirectory = NewPdErr(10, "is a directory")
+var ErrInvalidArgument = NewPdErr(11, "invalid argument")
+var ErrBadBlockSize = NewPdErr(12, "unsupported block size")
+var ErrIO = NewPdErr(13, "input/output error")
+var ErrShortIO = NewPdErr(14, "short read or write")
+var ErrBadChecksum = NewPdErr(15, "metadata checksum mismatch")
+var ErrBadVersion = NewPdErr(16, "unsupported format version")
+var ErrIncompatFeature = NewPdErr(17, "unsupported incompatible feature")
+var ErrRoCompatFeature = NewPdErr(18, "unsupported read-only compatible feature")
+var ErrDirty = NewPdErr(19, "filesystem was not cleanly unmounted")
+var ErrBadBtree = NewPdErr(20, "corrupted btree node")
+var ErrDoubleFree = NewPdErr(21, "freeing blocks that are already free")
+var ErrNameTooLong = NewPdErr(22, "file name too long")
+var ErrFileTooBig = NewPdErr(23, "file too large")
 
 func NewPdErr(code int, msg string) PdErr {
 	return PdErr{
@@ -0,0 +1,119 @@
+package main
+
+import "fmt"
+
+// FMT_EXTENTS 的文件用区间列表记录数据块，列表保存在 inode 块的 datafork 中。
+// 区间按文件内的块号排序、首尾相接，覆盖文件的全部 NLocBlk 个数据块，中间没有空洞。
+// 新建的普通文件仍然是 FMT_LOCAL，数据块紧跟在 inode 块之后；写入超出预分配的部分时
+// 转换为 FMT_EXTENTS，原来的数据块成为第一个区间，不需要复制数据。
+// 区间列表只占一个 inode 块，512 字节的块最多 12 个区间（见 maxExtents），不会合并或搬移已有的区间；
+// 空闲空间零碎时文件可能在磁盘还有空闲块时就无法增长，此时返回 ErrFileTooBig（EFBIG）
+
+// DExtent 是一段连续的数据块：文件内从 Off 开始的 Len 块存放在从 Start 开始的物理块中
+type DExtent struct {
+	Off   uint64 `struct:"uint64"` // 文件内的块号
+	Start uint64 `struct:"uint64"` // 物理块号
+	Len   uint32 `struct:"uint32"` // 块数
+}
+
+type DExtentList struct {
+	Count   uint8 `struct:"uint8,sizeof=Extents"` // 区间数
+	Extents []DExtent
+}
+
+// 区间列表头部（Count）和每个区间的大小
+const (
+	extentListHdrSize = 1
+	extentSize        = 8 + 8 + 4
+)
+
+// maxExtents 返回 datafork 中最多能保存的区间数，不能占用末尾的校验和
+func (ctx *InoContext) maxExtents() int {
+	return (int(ctx.blockSize()) - metaCrcSize - dataforkOff - extentListHdrSize) / extentSize
+}
+
+// convertToExtents 把 FMT_LOCAL 的 inode 转换为 FMT_EXTENTS，紧跟在 inode 块之后的数据块作为第一个区间。
+// 不写回 inode
+func (ctx *InoContext) convertToExtents() {
+	list := &DExtentList{Extents: make([]DExtent, 0)}
+	if n := ctx.coreCache.NLocBlk; n > 0 {
+		list.Extents = append(list.Extents, DExtent{Off: 0, Start: ctx.ino + 1, Len: uint32(n)})
+		list.Count = 1
+	}
+	ctx.extents = list
+	ctx.coreCache.Format = FMT_EXTENTS
+}
+
+// appendExtent 把从 start 开始的 n 个物理块追加到文件末尾，与最后一个区间相邻时合并。
+// 区间列表已满时返回 ErrFileTooBig。不写回 inode
+func (ctx *InoContext) appendExtent(start uint64, n uint64) error {
+	list := ctx.extents
+	if k := len(list.Extents); k > 0 {
+		last := &list.Extents[k-1]
+		if last.Start+uint64(last.Len) == start && uint64(last.Len)+n <= uint64(^uint32(0)) {
+			last.Len += uint32(n)
+			ctx.coreCache.NLocBlk += n
+			return nil
+		}
+	}
+	if len(list.Extents) >= ctx.maxExtents() {
+		return ErrFileTooBig
+	}
+	list.Extents = append(list.Extents, DExtent{Off: ctx.coreCache.NLocBlk, Start: start, Len: uint32(n)})
+	list.Count++
+	ctx.coreCache.NLocBlk += n
+	return nil
+}
+
+// trimExtents 只保留文件的前 keep 个数据块，返回被截掉的物理块区间，由调用者释放。不写回 inode
+func (ctx *InoContext) trimExtents(keep uint64) []DExtent {
+	var removed []DExtent
+	list := ctx.extents
+	kept := list.Extents[:0]
+	for _, ext := range list.Extents {
+		switch {
+		case ext.Off >= keep:
+			removed = append(removed, ext)
+		case ext.Off+uint64(ext.Len) > keep:
+			n := keep - ext.Off
+			removed = append(removed, DExtent{Off: keep, Start: ext.Start + n, Len: ext.Len - uint32(n)})
+			ext.Len = uint32(n)
+			kept = append(kept, ext)
+		default:
+			kept = append(kept, ext)
+		}
+	}
+	list.Extents = kept
+	list.Count = uint8(len(kept))
+	ctx.coreCache.NLocBlk = Min(ctx.coreCache.NLocBlk, keep)
+	return removed
+}
+
+// lookupExtent 返回包含文件内块号 blkno 的物理块
+func (ctx *InoContext) lookupExtent(blkno uint64) (uint64, error) {
+	for _, ext := range ctx.extents.Extents {
+		if blkno >= ext.Off && blkno < ext.Off+uint64(ext.Len) {
+			return ext.Start + blkno - ext.Off, nil
+		}
+	}
+	return 0, ErrOutOfRange
+}
+
+// checkExtents 检查区间列表首尾相接并且覆盖全部 NLocBlk 个数据块
+func (ctx *InoContext) checkExtents() error {
+	list := ctx.extents
+	if len(list.Extents) > ctx.maxExtents() {
+		return fmt.Errorf("%d extents, at most %d", len(list.Extents), ctx.maxExtents())
+	}
+	next := uint64(0)
+	for i, ext := range list.Extents {
+		if ext.Off != next || ext.Len == 0 {
+			return fmt.Errorf("extent %d [%d, +%d) does not follow block %d", i, ext.Off, ext.Len, next)
+		}
+		next += uint64(ext.Len)
+	}
+	if next != ctx.coreCache.NLocBlk {
+		return fmt.Errorf("extents cover %d blocks, inode has %d", next, ctx.coreCache.NLocBlk)
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestExtentWrite(t *testing.T) {
+	// 10MB
+	blockcount := uint64(10 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeBefore := fs.mp.Statfs().FreeBlocks
+	// b 紧跟在 a 的预分配数据块之后，a 扩展时不能覆盖它
+	a, err := fs.createFile(root, "a", S_IFREG|0644, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.createFile(root, "b", S_IFREG|0644, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ino != a.ino+1+a.coreCache.NLocBlk {
+		t.Fatalf("b is at %d, a's data ends at %d", b.ino, a.ino+1+a.coreCache.NLocBlk)
+	}
+	if _, err = fs.write(b, 0, []byte("bbbb")); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(off uint64, data []byte) {
+		t.Helper()
+		var in fuse.WriteIn
+		in.NodeId, in.Offset, in.Size = a.ino, off, uint32(len(data))
+		if n, code := fs.Write(nil, &in, data); !code.Ok() || n != uint32(len(data)) {
+			t.Fatalf("write %d bytes at %d: %d, %v", len(data), off, n, code)
+		}
+	}
+	read := func(ctx *InoContext, off uint64, n int) []byte {
+		t.Helper()
+		if err := ctx.LoadInode(); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, n)
+		got, err := ctx.Read(off, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:got]
+	}
+
+	// 分多次写 100KB，文件从预分配的 8KB 开始扩展
+	want := make([]byte, 100*1024)
+	for i := range want {
+		want[i] = byte(i*7 + i/512)
+	}
+	for off := 0; off < len(want); off += 3000 {
+		write(uint64(off), want[off:Min(off+3000, len(want))])
+	}
+	if got := read(a, 0, len(want)+10); !bytes.Equal(got, want) {
+		t.Errorf("read back %d bytes, differ from what was written", len(got))
+	}
+	if got := read(b, 0, 100); string(got) != "bbbb" {
+		t.Errorf("b is %q", got)
+	}
+	if a.coreCache.Format != FMT_EXTENTS || len(a.extents.Extents) > 6 {
+		t.Errorf("format %d, %d extents", a.coreCache.Format, len(a.extents.Extents))
+	}
+	if a.extents.Extents[0].Start != a.ino+1 {
+		t.Errorf("preallocated blocks moved to %d", a.extents.Extents[0].Start)
+	}
+
+	// 跳过文件末尾写入，中间是 0
+	write(150*1024, []byte("tail"))
+	if got := read(a, 100*1024, 50*1024+4); !bytes.Equal(got[:50*1024], make([]byte, 50*1024)) || string(got[50*1024:]) != "tail" {
+		t.Errorf("hole is not zeroed")
+	}
+
+	// 截短后释放末尾的区间，再变长时新的部分是 0
+	setSize := func(size uint64) {
+		t.Helper()
+		in := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: fuse.InHeader{NodeId: a.ino}, Valid: fuse.FATTR_SIZE, Size: size}}
+		var out fuse.AttrOut
+		if code := fs.SetAttr(nil, &in, &out); !code.Ok() {
+			t.Fatalf("truncate to %d: %v", size, code)
+		}
+	}
+	setSize(10000)
+	if err = a.LoadInode(); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.coreCache.NLocBlk; n != dataBlocks(10000, DefaultBlockSize) {
+		t.Errorf("%d blocks after truncate", n)
+	}
+	setSize(20000)
+	got := read(a, 0, 30000)
+	if len(got) != 20000 || !bytes.Equal(got[:10000], want[:10000]) || !bytes.Equal(got[10000:], make([]byte, 10000)) {
+		t.Errorf("bad content after truncate")
+	}
+
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Fatalf("fsck: %v %v", err, report.Problems)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err = fs.unlink(root, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// AGFL 中的块也算作空闲
+	if free := fs.mp.Statfs().FreeBlocks; free != freeBefore {
+		t.Errorf("%d blocks free after unlink, was %d", free, freeBefore)
+	}
+	if report, err = Fsck(dev, FsckOptions{}); err != nil || !report.Clean() {
+		t.Errorf("fsck after unlink: %v %v", err, report.Problems)
+	}
+}
+
+func TestBadExtentList(t *testing.T) {
+	blockcount := uint64(1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.createFile(root, "file", S_IFREG|0644, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.write(file, 0, make([]byte, FilePreallocBytes+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file.extents.Extents[0].Len++
+	if err = file.SyncInode(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) == 0 || !strings.Contains(report.Problems[0], "bad extent list") {
+		t.Errorf("fsck: %v", report.Problems)
+	}
+}
+
+func TestPutFragmented(t *testing.T) {
+	// 数据区初始划分成 16 份，最长的空闲区间放不下整个文件，put 时文件分成多个区间
+	tmp := t.TempDir()
+	image := filepath.Join(tmp, "image.bin")
+	dev, err := NewFileBlockDevice(image, 2048, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{FreeSplit: 16}); err != nil {
+		t.Fatal(err)
+	}
+	dev.Close()
+	data := make([]byte, 100*1024)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	host := filepath.Join(tmp, "big")
+	if err = os.WriteFile(host, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = cmdPut([]string{"-device", image, host, "/big"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if dev, err = OpenFileBlockDevice(image, false); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	fs, err := NewPoundFS(dev, MountOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longest := fs.mp.Statfs().Longest; longest >= dataBlocks(uint64(len(data)), DefaultBlockSize) {
+		t.Fatalf("longest free extent %d holds the whole file", longest)
+	}
+	big, err := fs.lookupPath("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if big.coreCache.Format != FMT_EXTENTS || len(big.extents.Extents) < 2 {
+		t.Errorf("format %d, %d extents", big.coreCache.Format, len(big.extents.Extents))
+	}
+	if got, err := readAll(big); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("content differs: %v", err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
+
+func TestExtentListFull(t *testing.T) {
+	// 空闲空间只剩零散的单个块，区间列表装满后文件不能再增长，返回 EFBIG 而不是 ENOSPC
+	dev, err := NewMemBlockDevice(2048, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.createFile(root, "f", S_IFREG|0644, 0, 0, O_CREAT|O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.write(f, 0, make([]byte, FilePreallocBytes)); err != nil {
+		t.Fatal(err)
+	}
+	// 占满所有 AG，再隔一块释放一块
+	var used []uint64
+	for agno := range fs.mp.AgCtx {
+		for {
+			blk, err := fs.mp.AllocBlock(uint32(agno), 1)
+			if err == ErrNoSpace {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			used = append(used, blk)
+		}
+	}
+	holes := 2 * f.maxExtents()
+	if len(used) < 2*holes {
+		t.Fatalf("only %d free blocks", len(used))
+	}
+	for i := 0; i < holes; i++ {
+		blk := used[2*i]
+		if err = fs.mp.FreeBlocks(fs.mp.BlockAg(blk), blk, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	free := fs.mp.Statfs().FreeBlocks
+	size := f.coreCache.NLocBlk*uint64(DefaultBlockSize) + uint64(holes)*uint64(DefaultBlockSize)
+	// truncate 失败时文件大小不变，分配的块都还回去
+	if err = fs.truncate(f, size); err != ErrFileTooBig {
+		t.Errorf("err is %v not %v", err, ErrFileTooBig)
+	}
+	if got := fs.mp.Statfs().FreeBlocks; got != free {
+		t.Errorf("%d blocks free after a failed truncate, was %d", got, free)
+	}
+	if _, err = fs.write(f, 0, make([]byte, size)); toFuseStatus(err) != fuse.Status(syscall.EFBIG) {
+		t.Errorf("write: err is %v", err)
+	}
+	if n := len(f.extents.Extents); n != f.maxExtents() {
+		t.Errorf("%d extents, want %d", n, f.maxExtents())
+	}
+	for i := 2 * holes; i < len(used); i++ {
+		if err = fs.mp.FreeBlocks(fs.mp.BlockAg(used[i]), used[i], 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < holes; i++ {
+		blk := used[2*i+1]
+		if err = fs.mp.FreeBlocks(fs.mp.BlockAg(blk), blk, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
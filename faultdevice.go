@@ -0,0 +1,214 @@
+package main
+
+import (
+	"sync"
+)
+
+// FaultOp 是故障规则匹配的操作类型
+type FaultOp int
+
+const (
+	FaultOpRead FaultOp = iota
+	FaultOpWrite
+)
+
+// FaultKind 是注入的故障类型
+type FaultKind int
+
+const (
+	// FaultFail 让操作失败并返回 ErrIO
+	FaultFail FaultKind = iota
+	// FaultDrop 丢弃写入但报告成功
+	FaultDrop
+	// FaultTear 只写入前 Keep 字节（撕裂写）但报告成功
+	FaultTear
+	// FaultShortRead 只读入前 Keep 字节，其余置 0，返回 ErrShortIO
+	FaultShortRead
+)
+
+// FaultRule 描述一条故障规则。读写按块拆分后逐块匹配计数，
+// 第 Nth 次匹配时开始触发，共触发 Times 次
+type FaultRule struct {
+	Op    FaultOp
+	Kind  FaultKind
+	Nth   uint64                    // 从 1 开始，0 与 1 相同
+	Times uint64                    // 0 表示此后一直触发
+	Match func(blockno uint64) bool // 为 nil 时匹配所有块
+	Keep  int                       // FaultTear/FaultShortRead 实际读写的字节数，0 表示半块
+
+	seen  uint64
+	fired uint64
+}
+
+// Fired 返回规则已经触发的次数
+func (r *FaultRule) Fired() uint64 {
+	return r.fired
+}
+
+// hit 判断本次操作是否触发规则，并更新计数
+func (r *FaultRule) hit(op FaultOp, blockno uint64) bool {
+	if r.Op != op || (r.Match != nil && !r.Match(blockno)) {
+		return false
+	}
+	r.seen++
+	if r.seen < r.Nth || (r.Times > 0 && r.fired >= r.Times) {
+		return false
+	}
+	r.fired++
+	return true
+}
+
+// FaultyBlockDevice 在另一个块设备之上按规则注入故障，用于测试磁盘出错或崩溃时的行为。
+// 按字节读写会拆分为逐块的操作，因此规则总是以块为单位匹配
+type FaultyBlockDevice struct {
+	mu     sync.Mutex
+	dev    BlockDevice
+	rules  []*FaultRule
+	reads  uint64
+	writes uint64
+}
+
+// NewFaultyBlockDevice 包装 dev，没有规则时所有操作原样转发
+func NewFaultyBlockDevice(dev BlockDevice) *FaultyBlockDevice {
+	return &FaultyBlockDevice{dev: dev}
+}
+
+// AddRule 添加一条规则并返回它，可以通过 Fired 查看触发次数。
+// 规则按添加顺序检查，第一条触发的规则生效，之后的规则不计数
+func (f *FaultyBlockDevice) AddRule(rule FaultRule) *FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := &rule
+	r.seen, r.fired = 0, 0
+	f.rules = append(f.rules, r)
+	return r
+}
+
+// FailNthWrite 让第 n 次块写入返回 ErrIO
+func (f *FaultyBlockDevice) FailNthWrite(n uint64) *FaultRule {
+	return f.AddRule(FaultRule{Op: FaultOpWrite, Kind: FaultFail, Nth: n, Times: 1})
+}
+
+// DropWritesFrom 从第 n 次块写入开始丢弃所有写入，模拟掉电
+func (f *FaultyBlockDevice) DropWritesFrom(n uint64) *FaultRule {
+	return f.AddRule(FaultRule{Op: FaultOpWrite, Kind: FaultDrop, Nth: n})
+}
+
+// ClearRules 删除所有规则
+func (f *FaultyBlockDevice) ClearRules() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = nil
+}
+
+// Counts 返回已转发或拦截的块读、块写次数
+func (f *FaultyBlockDevice) Counts() (reads uint64, writes uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reads, f.writes
+}
+
+func (f *FaultyBlockDevice) ReadBlock(blockno uint64) ([]byte, error) {
+	data := make([]byte, f.dev.GetBlockSize())
+	if err := f.Read(blockno*uint64(len(data)), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (f *FaultyBlockDevice) WriteBlock(blockno uint64, data []byte) error {
+	if len(data) != int(f.dev.GetBlockSize()) {
+		return ErrInvalidArgument
+	}
+	return f.Write(blockno*uint64(len(data)), data)
+}
+
+func (f *FaultyBlockDevice) Read(offset uint64, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.split(offset, data, func(blockno uint64, pos uint64, part []byte) error {
+		f.reads++
+		rule := f.match(FaultOpRead, blockno)
+		if rule == nil {
+			return f.dev.Read(pos, part)
+		}
+		switch rule.Kind {
+		case FaultShortRead:
+			keep := f.keep(rule, len(part))
+			if err := f.dev.Read(pos, part[:keep]); err != nil {
+				return err
+			}
+			for i := keep; i < len(part); i++ {
+				part[i] = 0
+			}
+			return ErrShortIO
+		case FaultFail:
+			return ErrIO
+		}
+		return f.dev.Read(pos, part)
+	})
+}
+
+func (f *FaultyBlockDevice) Write(offset uint64, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.split(offset, data, func(blockno uint64, pos uint64, part []byte) error {
+		f.writes++
+		rule := f.match(FaultOpWrite, blockno)
+		if rule == nil {
+			return f.dev.Write(pos, part)
+		}
+		switch rule.Kind {
+		case FaultFail:
+			return ErrIO
+		case FaultDrop:
+			return nil
+		case FaultTear:
+			return f.dev.Write(pos, part[:f.keep(rule, len(part))])
+		}
+		return f.dev.Write(pos, part)
+	})
+}
+
+func (f *FaultyBlockDevice) GetTotalBlockCount() uint32 {
+	return f.dev.GetTotalBlockCount()
+}
+
+func (f *FaultyBlockDevice) GetBlockSize() uint32 {
+	return f.dev.GetBlockSize()
+}
+
+// split 把 [offset, offset+len(data)) 按块拆开，依次调用 fn
+func (f *FaultyBlockDevice) split(offset uint64, data []byte, fn func(blockno uint64, pos uint64, part []byte) error) error {
+	bs := uint64(f.dev.GetBlockSize())
+	if offset+uint64(len(data)) > uint64(f.dev.GetTotalBlockCount())*bs {
+		return ErrOutOfRange
+	}
+	for done := uint64(0); done < uint64(len(data)); {
+		pos := offset + done
+		n := Min(bs-pos%bs, uint64(len(data))-done)
+		if err := fn(pos/bs, pos, data[done:done+n]); err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
+
+func (f *FaultyBlockDevice) match(op FaultOp, blockno uint64) *FaultRule {
+	for _, r := range f.rules {
+		if r.hit(op, blockno) {
+			return r
+		}
+	}
+	return nil
+}
+
+// keep 返回撕裂写或短读实际处理的字节数
+func (f *FaultyBlockDevice) keep(rule *FaultRule, n int) int {
+	keep := rule.Keep
+	if keep <= 0 {
+		keep = int(f.dev.GetBlockSize()) / 2
+	}
+	return Min(keep, n)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestFaultyBlockDevice(t *testing.T) {
+	mem, err := NewMemBlockDevice(16, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := NewFaultyBlockDevice(mem)
+	blk := bytes.Repeat([]byte{0xff}, DefaultBlockSize)
+
+	rule := dev.FailNthWrite(2)
+	for i, want := range []error{nil, ErrIO, nil} {
+		if err = dev.WriteBlock(uint64(i), blk); err != want {
+			t.Errorf("write %d: err is %v not %v", i+1, err, want)
+		}
+	}
+	if rule.Fired() != 1 {
+		t.Errorf("rule fired %d times", rule.Fired())
+	}
+	dev.ClearRules()
+
+	// 撕裂写只落盘前 100 字节
+	dev.AddRule(FaultRule{Op: FaultOpWrite, Kind: FaultTear, Keep: 100, Match: func(blockno uint64) bool { return blockno == 5 }})
+	if err = dev.WriteBlock(4, blk); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.WriteBlock(5, blk); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := mem.ReadBlock(5)
+	if data[99] != 0xff || data[100] != 0 {
+		t.Errorf("block 5 was not torn at 100")
+	}
+
+	// 跨块写入时只有第二块被丢弃
+	dev.ClearRules()
+	dev.AddRule(FaultRule{Op: FaultOpWrite, Kind: FaultDrop, Nth: 2})
+	if err = dev.Write(7*DefaultBlockSize-2, []byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	mem.Read(7*DefaultBlockSize-2, buf)
+	if string(buf) != "ab\x00\x00" {
+		t.Errorf("read %q", buf)
+	}
+
+	dev.ClearRules()
+	dev.AddRule(FaultRule{Op: FaultOpRead, Kind: FaultShortRead, Keep: 10})
+	if err = dev.Read(0, make([]byte, 20)); err != ErrShortIO {
+		t.Errorf("err is %v not %v", err, ErrShortIO)
+	}
+	if _, err = dev.ReadBlock(16); err != ErrOutOfRange {
+		t.Errorf("err is %v not %v", err, ErrOutOfRange)
+	}
+	if reads, writes := dev.Counts(); reads != 1 || writes != 7 {
+		t.Errorf("counted %d reads, %d writes", reads, writes)
+	}
+}
+
+func TestMakefsWriteErrors(t *testing.T) {
+	blockcount := uint64(1024 * 1024 / DefaultBlockSize)
+	mem, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := NewFaultyBlockDevice(mem)
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, total := dev.Counts()
+	// 格式化过程中的任何一次写入失败都必须报告出来
+	for n := uint64(1); n <= total; n++ {
+		dev.ClearRules()
+		dev.FailNthWrite(n)
+		if _, err = Makefs(dev, MkfsOptions{}); err == nil {
+			t.Errorf("Makefs succeeded although write %d of %d failed", n, total)
+		}
+	}
+}
+
+func TestFsOpsDiskErrors(t *testing.T) {
+	blockcount := uint64(1024 * 1024 / DefaultBlockSize)
+	mem, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(mem, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dev := NewFaultyBlockDevice(mem)
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 空闲空间树写入失败时不能交出块
+	cntroot := uint64(fs.mp.AgCtx[0].Agf.Meta.CntRoot)
+	dev.AddRule(FaultRule{Op: FaultOpWrite, Kind: FaultFail, Match: func(blockno uint64) bool { return blockno == cntroot }})
+	if _, err = fs.mp.AllocBlock(0, 1); err != ErrIO {
+		t.Errorf("AllocBlock: err is %v not %v", err, ErrIO)
+	}
+	var mkdirOut fuse.EntryOut
+	code := fs.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: RootIno}, Mode: 0755}, "dir", &mkdirOut)
+	if code != fuse.EIO {
+		t.Errorf("Mkdir returned %v", code)
+	}
+	dev.ClearRules()
+	report, err := Fsck(mem, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() || report.Inodes != 1 {
+		t.Errorf("fsck after failed mkdir: %d inodes, %v", report.Inodes, report.Problems)
+	}
+
+	// 读 inode 出错时返回 EIO，而不是使用未加载的 inode
+	dev.AddRule(FaultRule{Op: FaultOpRead, Kind: FaultFail})
+	var attrOut fuse.AttrOut
+	if code = fs.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: RootIno}}, &attrOut); code != fuse.EIO {
+		t.Errorf("GetAttr returned %v", code)
+	}
+	var entryOut fuse.EntryOut
+	if code = fs.Lookup(nil, &fuse.InHeader{NodeId: RootIno}, "dir", &entryOut); code != fuse.EIO {
+		t.Errorf("Lookup returned %v", code)
+	}
+	dev.ClearRules()
+	dev.AddRule(FaultRule{Op: FaultOpRead, Kind: FaultShortRead})
+	if code = fs.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: RootIno}}, &attrOut); code != fuse.EIO {
+		t.Errorf("GetAttr after short read returned %v", code)
+	}
+}
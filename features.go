@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 超级块格式版本和特性标志，语义与 ext4 相同：
+//   - compat：不认识的特性不影响读写
+//   - ro-compat：有不认识的特性时只能只读挂载
+//   - incompat：有不认识的特性时拒绝挂载
+// 版本 0 是没有特性标志之前的镜像，这些字段都是 0
+
+// SbVersion 是当前的超级块格式版本
+const SbVersion = uint32(1)
+
+// FeatRoCompatMetaCrc 表示元数据块带有 CRC32C 校验和。
+// 不认识它的实现写入元数据时不会更新校验和，因此只能只读挂载
+const FeatRoCompatMetaCrc = uint32(1 << 0)
+
+// FeatIncompatBtree 表示空闲空间树是多层的 B+ 树，节点使用 DBtreeNode 格式，
+// 分裂所需的块来自 AGFL。没有此特性的镜像只有一个 DBtreeBlock 格式的根节点
+const FeatIncompatBtree = uint32(1 << 0)
+
+// 本实现支持的特性
+const (
+	FeatCompatSupp   = uint32(0)
+	FeatRoCompatSupp = FeatRoCompatMetaCrc
+	FeatIncompatSupp = FeatIncompatBtree
+)
+
+// FeatureSet 是超级块中的三组特性标志
+type FeatureSet struct {
+	Compat   uint32
+	RoCompat uint32
+	Incompat uint32
+}
+
+// DefaultFeatures 是 mkfs 默认启用的特性
+var DefaultFeatures = FeatureSet{RoCompat: FeatRoCompatMetaCrc, Incompat: FeatIncompatBtree}
+
+// featureNames 是特性在命令行和输出中的名称
+var featureNames = []struct {
+	name  string
+	field func(f *FeatureSet) *uint32
+	mask  uint32
+}{
+	{"metacrc", func(f *FeatureSet) *uint32 { return &f.RoCompat }, FeatRoCompatMetaCrc},
+	{"btree", func(f *FeatureSet) *uint32 { return &f.Incompat }, FeatIncompatBtree},
+}
+
+// featureDevice 记录其上文件系统启用的特性，元数据的读写路径据此选择格式、计算和校验校验和
+type featureDevice struct {
+	BlockDevice
+	features FeatureSet
+}
+
+// withFeatures 按超级块中的特性包装 dev，所有访问元数据的代码都应使用返回的设备
+func withFeatures(dev BlockDevice, sb *Superblock) BlockDevice {
+	if _, ok := dev.(*featureDevice); ok || sb.Features() == (FeatureSet{}) {
+		return dev
+	}
+	return &featureDevice{dev, sb.Features()}
+}
+
+// devFeatures 返回 dev 上的文件系统启用的特性
+func devFeatures(dev BlockDevice) FeatureSet {
+	if d, ok := dev.(*featureDevice); ok {
+		return d.features
+	}
+	return FeatureSet{}
+}
+
+// btreeEnabled 判断 dev 上的空闲空间树是否是多层的 B+ 树
+func btreeEnabled(dev BlockDevice) bool {
+	return devFeatures(dev).Incompat&FeatIncompatBtree != 0
+}
+
+// Sync 转发给下层设备
+func (d *featureDevice) Sync() error {
+	if dev, ok := d.BlockDevice.(Syncer); ok {
+		return dev.Sync()
+	}
+	return nil
+}
+
+// Resize 转发给下层设备，下层设备不支持时返回 ErrNotImplemented
+func (d *featureDevice) Resize(blockcount uint64) error {
+	if dev, ok := d.BlockDevice.(ResizableBlockDevice); ok {
+		return dev.Resize(blockcount)
+	}
+	return ErrNotImplemented
+}
+
+// Features 返回超级块中的特性标志
+func (sb *Superblock) Features() FeatureSet {
+	return FeatureSet{Compat: sb.FeatCompat, RoCompat: sb.FeatRoCompat, Incompat: sb.FeatIncompat}
+}
+
+// setFeatures 把版本和特性标志写入超级块
+func (sb *Superblock) setFeatures(f FeatureSet) {
+	sb.Version = SbVersion
+	sb.FeatCompat = f.Compat
+	sb.FeatRoCompat = f.RoCompat
+	sb.FeatIncompat = f.Incompat
+}
+
+// Unsupported 返回 f 中本实现不认识的特性
+func (f FeatureSet) Unsupported() FeatureSet {
+	return FeatureSet{
+		Compat:   f.Compat &^ FeatCompatSupp,
+		RoCompat: f.RoCompat &^ FeatRoCompatSupp,
+		Incompat: f.Incompat &^ FeatIncompatSupp,
+	}
+}
+
+// String 返回逗号分隔的特性名称，不认识的特性以十六进制掩码表示
+func (f FeatureSet) String() string {
+	var names []string
+	rest := f
+	for _, feat := range featureNames {
+		if *feat.field(&f)&feat.mask != 0 {
+			names = append(names, feat.name)
+			*feat.field(&rest) &^= feat.mask
+		}
+	}
+	if rest.Compat != 0 {
+		names = append(names, fmt.Sprintf("compat:0x%x", rest.Compat))
+	}
+	if rest.RoCompat != 0 {
+		names = append(names, fmt.Sprintf("ro_compat:0x%x", rest.RoCompat))
+	}
+	if rest.Incompat != 0 {
+		names = append(names, fmt.Sprintf("incompat:0x%x", rest.Incompat))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseFeatures 在 base 的基础上应用逗号分隔的特性列表，名称前加 ^ 表示关闭，
+// "none" 表示清空所有特性。例如 "^metacrc"
+func ParseFeatures(base FeatureSet, spec string) (FeatureSet, error) {
+	f := base
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "none" {
+			f = FeatureSet{}
+			continue
+		}
+		clear := strings.HasPrefix(name, "^")
+		name = strings.TrimPrefix(name, "^")
+		found := false
+		for _, feat := range featureNames {
+			if feat.name != name {
+				continue
+			}
+			found = true
+			if clear {
+				*feat.field(&f) &^= feat.mask
+			} else {
+				*feat.field(&f) |= feat.mask
+			}
+		}
+		if !found {
+			return f, fmt.Errorf("unknown feature %q", name)
+		}
+	}
+	return f, nil
+}
+
+// checkFeatures 检查超级块的版本和特性标志。
+// 版本过新或有不认识的 incompat 特性时返回错误；有不认识的 ro-compat 特性时返回 readonly 为 true
+func checkFeatures(sb *Superblock) (readonly bool, err error) {
+	if sb.Version > SbVersion {
+		return false, ErrBadVersion
+	}
+	unsupp := sb.Features().Unsupported()
+	if unsupp.Incompat != 0 {
+		return false, ErrIncompatFeature
+	}
+	return unsupp.RoCompat != 0, nil
+}
+
+// checkWritable 用于离线修改镜像的操作（growfs、fsck -repair），不能写入时返回错误
+func checkWritable(sb *Superblock) error {
+	readonly, err := checkFeatures(sb)
+	if err != nil {
+		return err
+	}
+	if readonly {
+		return ErrRoCompatFeature
+	}
+	return nil
+}
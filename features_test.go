@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestParseFeatures(t *testing.T) {
+	cases := []struct {
+		spec string
+		want FeatureSet
+	}{
+		{"", DefaultFeatures},
+		{"^metacrc", FeatureSet{Incompat: FeatIncompatBtree}},
+		{"^metacrc,^btree", FeatureSet{}},
+		{"none", FeatureSet{}},
+		{"none, metacrc", FeatureSet{RoCompat: FeatRoCompatMetaCrc}},
+	}
+	for _, c := range cases {
+		got, err := ParseFeatures(DefaultFeatures, c.spec)
+		if err != nil {
+			t.Errorf("%q: %v", c.spec, err)
+		} else if got != c.want {
+			t.Errorf("%q: got %v, want %v", c.spec, got, c.want)
+		}
+	}
+	if _, err := ParseFeatures(DefaultFeatures, "metacrc,bogus"); err == nil {
+		t.Error("unknown feature accepted")
+	}
+	f := FeatureSet{RoCompat: FeatRoCompatMetaCrc | 1<<4, Incompat: FeatIncompatBtree | 1<<31}
+	if s := f.String(); s != "metacrc,btree,ro_compat:0x10,incompat:0x80000000" {
+		t.Errorf("String() is %q", s)
+	}
+}
+
+// setSuperblock 修改主超级块，保持校验和正确
+func setSuperblock(t *testing.T, dev BlockDevice, modify func(sb *Superblock)) {
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify(mp.sb)
+	if err = mp.SyncSuperblock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFeatureChecks(t *testing.T) {
+	blockcount := uint64(1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	base := dev.Snapshot()
+
+	// 不认识的 incompat 特性和过新的版本拒绝挂载
+	setSuperblock(t, dev, func(sb *Superblock) { sb.FeatIncompat |= 1 << 31 })
+	if _, err = NewPoundFS(dev, MountOptions{}); err != ErrIncompatFeature {
+		t.Errorf("incompat: err is %v not %v", err, ErrIncompatFeature)
+	}
+	if _, err = Fsck(dev, FsckOptions{}); err != ErrIncompatFeature {
+		t.Errorf("fsck incompat: err is %v not %v", err, ErrIncompatFeature)
+	}
+	dev.Restore(base)
+	setSuperblock(t, dev, func(sb *Superblock) { sb.Version = SbVersion + 1 })
+	if _, err = NewPoundFS(dev, MountOptions{}); err != ErrBadVersion {
+		t.Errorf("version: err is %v not %v", err, ErrBadVersion)
+	}
+
+	// 不认识的 compat 特性不影响读写
+	dev.Restore(base)
+	setSuperblock(t, dev, func(sb *Superblock) { sb.FeatCompat |= 1 << 31 })
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.opts.ReadOnly {
+		t.Error("compat feature forced a read-only mount")
+	}
+
+	// 不认识的 ro-compat 特性只能只读
+	dev.Restore(base)
+	setSuperblock(t, dev, func(sb *Superblock) { sb.FeatRoCompat |= 1 << 31 })
+	fs, err = NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fs.opts.ReadOnly {
+		t.Error("ro-compat feature did not force a read-only mount")
+	}
+	var out fuse.EntryOut
+	if code := fs.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: RootIno}, Mode: 0755}, "dir", &out); code != fuse.EROFS {
+		t.Errorf("Mkdir returned %v", code)
+	}
+	if _, err = fs.lookupPath("/"); err != nil {
+		t.Errorf("lookup on read-only mount: %v", err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report)
+	}
+	if _, err = Fsck(dev, FsckOptions{Repair: true}); err != ErrRoCompatFeature {
+		t.Errorf("fsck -repair: err is %v not %v", err, ErrRoCompatFeature)
+	}
+	if _, err = Growfs(dev, uint32(blockcount*2)); err != ErrRoCompatFeature {
+		t.Errorf("growfs: err is %v not %v", err, ErrRoCompatFeature)
+	}
+
+	// 没有版本和特性字段的旧镜像照常挂载
+	legacy, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(legacy, MkfsOptions{Features: &FeatureSet{}}); err != nil {
+		t.Fatal(err)
+	}
+	setSuperblock(t, legacy, func(sb *Superblock) { sb.Version = 0 })
+	if _, err = NewPoundFS(legacy, MountOptions{}); err != nil {
+		t.Errorf("version 0: %v", err)
+	}
+}
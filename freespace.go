@@ -0,0 +1,242 @@
+package main
+
+// 每个 AG 的空闲空间记录在两棵 B+ 树中，与 XFS 的 bnobt 和 cntbt 相同：
+//   - cnt 树（Agf.CntRoot）按大小排序，分配时找最合适的区间
+//   - bno 树（Agf.BnoRoot）按起始块号排序，释放时找到左右相邻的区间合并
+// 两棵树中的区间总是相同的。没有 btree 特性的镜像只有 cnt 树，也不合并区间。
+//
+// 树的节点从 AG 自己的空闲空间分配。为了避免在修改树的过程中再去修改同一棵树，
+// 节点块预先从树中取出放进 AGFL：分裂时从 AGFL 取块，合并时放回 AGFL。
+// 每次修改树之前由 fixFreelist 保证 AGFL 中的块足够最坏情况下的分裂，太多时还给树。
+// AGF 中的空闲块数随记录的插入和删除更新，最长的空闲区间在每次分配和释放之后更新
+
+// agFreeSpace 管理一个 AG 的空闲空间，实现 BtreeAllocator
+type agFreeSpace struct {
+	dev BlockDevice
+	ag  *AgCtx
+}
+
+func newAgFreeSpace(ag *AgCtx) *agFreeSpace {
+	return &agFreeSpace{dev: ag.Agf.Dev, ag: ag}
+}
+
+// cntTree 返回按大小排序的空闲空间树
+func (fsp *agFreeSpace) cntTree() *BtreeContext[uint64, DFreeBlockBtRec] {
+	return NewBtreeContext[uint64, DFreeBlockBtRec](fsp.dev, uint64(fsp.ag.Agf.Meta.CntRoot)).WithAllocator(fsp)
+}
+
+// bnoTree 返回按起始块号排序的空闲空间树，没有 btree 特性时为 nil
+func (fsp *agFreeSpace) bnoTree() *BtreeContext[uint64, DFreeBnoBtRec] {
+	if !btreeEnabled(fsp.dev) {
+		return nil
+	}
+	return NewBtreeContext[uint64, DFreeBnoBtRec](fsp.dev, uint64(fsp.ag.Agf.Meta.BnoRoot)).WithAllocator(fsp)
+}
+
+// AllocNode 从 AGFL 取一块作为树的节点
+func (fsp *agFreeSpace) AllocNode() (uint64, error) {
+	agfl := fsp.ag.Agfl.Meta
+	if agfl.Count == 0 {
+		return 0, ErrNoSpace
+	}
+	agfl.Count--
+	blkno := agfl.Blocks[agfl.Count]
+	agfl.Blocks[agfl.Count] = 0
+	return uint64(blkno), fsp.ag.Agfl.Sync()
+}
+
+// FreeNode 把树不再使用的节点放回 AGFL
+func (fsp *agFreeSpace) FreeNode(blkno uint64) error {
+	agfl := fsp.ag.Agfl.Meta
+	if agfl.Count >= AgflSize {
+		return ErrNoSpace
+	}
+	agfl.Blocks[agfl.Count] = uint32(blkno)
+	agfl.Count++
+	return fsp.ag.Agfl.Sync()
+}
+
+// insertExtent 把区间插入两棵树
+func (fsp *agFreeSpace) insertExtent(rec DFreeBlockBtRec) error {
+	if err := fsp.cntTree().Set(rec); err != nil {
+		return err
+	}
+	fsp.ag.Agf.Meta.FreeBlocks += uint32(rec.BlockCount)
+	if bt := fsp.bnoTree(); bt != nil {
+		return bt.Set(DFreeBnoBtRec(rec))
+	}
+	return nil
+}
+
+// removeExtent 从两棵树中删除区间
+func (fsp *agFreeSpace) removeExtent(rec DFreeBlockBtRec) error {
+	if err := fsp.cntTree().Delete(rec); err != nil {
+		return err
+	}
+	fsp.ag.Agf.Meta.FreeBlocks -= uint32(rec.BlockCount)
+	if bt := fsp.bnoTree(); bt != nil {
+		return bt.Delete(DFreeBnoBtRec(rec))
+	}
+	return nil
+}
+
+// mergeExtent 把 [start, start+n) 与左右相邻的空闲区间合并后插入两棵树，
+// 与已有的空闲区间重叠时返回 ErrDoubleFree。没有 btree 特性时只有一个块的 cnt 树，
+// 逐条检查重叠，不合并
+func (fsp *agFreeSpace) mergeExtent(start uint64, n uint64) error {
+	bt := fsp.bnoTree()
+	if bt == nil {
+		recs, err := fsp.cntTree().Records()
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if rec.StartBlock < start+n && start < rec.StartBlock+rec.BlockCount {
+				return ErrDoubleFree
+			}
+		}
+		return fsp.insertExtent(DFreeBlockBtRec{BlockCount: n, StartBlock: start})
+	}
+	// 起始块号不大于 start 的最后一个区间
+	prev, err, _ := bt.Get(start)
+	if err != nil {
+		return err
+	}
+	next, err := bt.GetFirstMeet(start + 1)
+	if err != nil {
+		return err
+	}
+	if (prev != nil && prev.StartBlock+prev.BlockCount > start) || (next != nil && next.StartBlock < start+n) {
+		return ErrDoubleFree
+	}
+	if prev != nil && prev.StartBlock+prev.BlockCount == start {
+		if err := fsp.removeExtent(DFreeBlockBtRec(*prev)); err != nil {
+			return err
+		}
+		start, n = prev.StartBlock, n+prev.BlockCount
+	}
+	if next != nil && next.StartBlock == start+n {
+		if err := fsp.removeExtent(DFreeBlockBtRec(*next)); err != nil {
+			return err
+		}
+		n += next.BlockCount
+	}
+	return fsp.insertExtent(DFreeBlockBtRec{BlockCount: n, StartBlock: start})
+}
+
+// fixFreelist 让 AGFL 中的块数保持在 [need, 2*need]，need 是一次修改最多需要的新节点数：
+// 每棵树插入一条记录，每一层分裂一次，根节点再长高一层
+func (fsp *agFreeSpace) fixFreelist() error {
+	if !btreeEnabled(fsp.dev) {
+		return nil
+	}
+	t := fsp.cntTree()
+	cntHeight, err := t.Height()
+	if err != nil {
+		return err
+	}
+	bnoHeight, err := fsp.bnoTree().Height()
+	if err != nil {
+		return err
+	}
+	agfl := fsp.ag.Agfl.Meta
+	need := uint32(cntHeight + bnoHeight + 2)
+	target := 2 * need
+	for agfl.Count < need {
+		// 优先取一个刚好够用的区间，没有时取最大的
+		rec, err := t.GetFirstMeet(uint64(target - agfl.Count))
+		if err == nil && rec == nil {
+			rec, err = t.Last()
+		}
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return ErrNoSpace
+		}
+		if err := fsp.removeExtent(*rec); err != nil {
+			return err
+		}
+		// 先放进 AGFL，剩余部分插回树时可能要分裂
+		for rec.BlockCount > 0 && agfl.Count < target {
+			agfl.Blocks[agfl.Count] = uint32(rec.StartBlock)
+			agfl.Count++
+			rec.StartBlock++
+			rec.BlockCount--
+		}
+		if err := fsp.ag.Agfl.Sync(); err != nil {
+			return err
+		}
+		if rec.BlockCount > 0 {
+			if err := fsp.insertExtent(*rec); err != nil {
+				return err
+			}
+		}
+	}
+	// 合并释放了很多节点时还给树，保留 target 块
+	if agfl.Count <= AgflSize/2 {
+		return nil
+	}
+	for agfl.Count > target {
+		blkno, err := fsp.AllocNode()
+		if err != nil {
+			return err
+		}
+		if err := fsp.mergeExtent(blkno, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocExtent 分配 n 个连续的块，返回第一块的块号
+func (fsp *agFreeSpace) allocExtent(n uint64) (uint64, error) {
+	if err := fsp.fixFreelist(); err != nil {
+		return 0, err
+	}
+	rec, err := fsp.cntTree().GetFirstMeet(n)
+	if err != nil {
+		return 0, err
+	}
+	if rec == nil {
+		// fixFreelist 可能已经从空闲空间树中取出块补充 AGFL，AGF 中的计数也要写回
+		if err := fsp.syncAgf(); err != nil {
+			return 0, err
+		}
+		return 0, ErrNoSpace
+	}
+	// 空闲记录没有更新时不能交出这些块，否则会被重复分配
+	if err := fsp.removeExtent(*rec); err != nil {
+		return 0, err
+	}
+	if rec.BlockCount > n {
+		if err := fsp.insertExtent(DFreeBlockBtRec{BlockCount: rec.BlockCount - n, StartBlock: rec.StartBlock + n}); err != nil {
+			return 0, err
+		}
+	}
+	return rec.StartBlock, fsp.syncAgf()
+}
+
+// addExtent 把 [start, start+n) 加入空闲空间，与相邻的空闲区间合并
+func (fsp *agFreeSpace) addExtent(start uint64, n uint64) error {
+	if err := fsp.fixFreelist(); err != nil {
+		return err
+	}
+	if err := fsp.mergeExtent(start, n); err != nil {
+		return err
+	}
+	return fsp.syncAgf()
+}
+
+// syncAgf 更新最长的空闲区间后写回 AGF
+func (fsp *agFreeSpace) syncAgf() error {
+	rec, err := fsp.cntTree().Last()
+	if err != nil {
+		return err
+	}
+	fsp.ag.Agf.Meta.Longest = 0
+	if rec != nil {
+		fsp.ag.Agf.Meta.Longest = uint32(rec.BlockCount)
+	}
+	return fsp.ag.Agf.Sync()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// freeBlocks 返回 AG 中空闲空间树和 AGFL 的块数
+func freeBlocks(t *testing.T, fsp *agFreeSpace) uint64 {
+	recs, err := fsp.bnoTree().Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := uint64(fsp.ag.Agfl.Meta.Count)
+	for _, rec := range recs {
+		n += rec.BlockCount
+	}
+	return n
+}
+
+func TestCoalesceExtents(t *testing.T) {
+	dev, err := NewMemBlockDevice(4096, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{AgCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsp := newAgFreeSpace(mp.AgCtx[0])
+	total := freeBlocks(t, fsp)
+
+	// 分配很多小区间后乱序释放，相邻的区间应当合并回来
+	var blks []uint64
+	var used uint64
+	for i := 0; i < 500; i++ {
+		n := uint64(i%3 + 1)
+		blk, err := mp.AllocBlock(0, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk, n)
+		used += n
+	}
+	if free := freeBlocks(t, fsp); free+used != total {
+		t.Errorf("%d blocks free after allocating %d of %d", free, used, total)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, i := range rng.Perm(500) {
+		if err = fsp.addExtent(blks[2*i], blks[2*i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if free := freeBlocks(t, fsp); free != total {
+		t.Errorf("%d blocks free after freeing everything, want %d", free, total)
+	}
+	// AGFL 中的块可能把空闲空间隔开，除此之外都应当合并成整块
+	recs, err := fsp.bnoTree().Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) > int(fsp.ag.Agfl.Meta.Count)+1 {
+		t.Errorf("%d free extents with %d blocks in the AGFL", len(recs), fsp.ag.Agfl.Meta.Count)
+	}
+
+	// 与空闲区间重叠的释放
+	rec, err := fsp.cntTree().Last()
+	if err != nil || rec == nil {
+		t.Fatal(rec, err)
+	}
+	for _, ext := range [][2]uint64{{rec.StartBlock, 1}, {rec.StartBlock - 1, 2}, {rec.StartBlock + rec.BlockCount - 1, 5}} {
+		if err = fsp.addExtent(ext[0], ext[1]); err != ErrDoubleFree {
+			t.Errorf("free [%d, +%d): err is %v not %v", ext[0], ext[1], err, ErrDoubleFree)
+		}
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Errorf("fsck: %v", report.Problems)
+	}
+}
+
+func TestDoubleFreeWithoutBtree(t *testing.T) {
+	// 没有 btree 特性时也要发现重复释放
+	dev, err := NewMemBlockDevice(4096, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{AgCount: 1, Features: &FeatureSet{}}); err != nil {
+		t.Fatal(err)
+	}
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := mp.AllocBlock(0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mp.FreeBlocks(0, blk, 4); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range [][2]uint64{{blk, 4}, {blk + 1, 1}, {blk + 3, 2}} {
+		if err = mp.FreeBlocks(0, ext[0], ext[1]); err != ErrDoubleFree {
+			t.Errorf("free [%d, +%d): err is %v not %v", ext[0], ext[1], err, ErrDoubleFree)
+		}
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
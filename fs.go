@@ -8,6 +8,7 @@ package main
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/sirupsen/logrus"
@@ -17,26 +18,96 @@ type PoundFS struct {
 	fuse.RawFileSystem
 	dev        BlockDevice
 	mp         *MountPoint
+	opts       MountOptions
 	openfiles  *OpenfileMap
+	ilocks     *inodeLockTable
+	rootIno    uint64     // 根目录真实的 inode 号，挂载时从 AGI 读出，在线扩容会重新加载 AGI
+	renameMu   sync.Mutex // 跨目录 rename 时持有，检查祖先链期间目录树不会被其他 rename 改变
+	xattrMu    sync.Mutex
 	xattrCache map[string][]byte
 }
 
 const RootIno = 1
 
-func NewPoundFS(dev BlockDevice) *PoundFS {
-
+// NewPoundFS 加载 dev 上的文件系统，超级块校验失败时返回错误。
+// 读写挂载时把文件系统标记为 dirty，上次没有正常卸载时返回 ErrDirty，除非指定了 opts.Force。
+// 读写挂载结束后必须调用 Close
+func NewPoundFS(dev BlockDevice, opts MountOptions) (*PoundFS, error) {
 	mp, err := NewMountPoint(dev)
 	if err != nil {
 		logrus.Errorf("op=%s, err=%v", "Init", err)
-		return nil
+		return nil, err
+	}
+	if mp.ReadOnly && !opts.ReadOnly {
+		logrus.Warnf("filesystem has unsupported read-only compatible features %v, mounting read-only",
+			mp.sb.Features().Unsupported())
+		opts.ReadOnly = true
+	}
+	if mp.BackupAg != 0 {
+		// 重建的超级块是 dirty，读写挂载会把它写回块 0
+		logrus.Warnf("mounting with the backup superblock in AG %d", mp.BackupAg)
+	}
+	if mp.Dirty() {
+		if !opts.ReadOnly && !opts.Force {
+			logrus.Errorf("filesystem was not cleanly unmounted, run fsck or mount read-only")
+			return nil, ErrDirty
+		}
+		logrus.Warnf("filesystem was not cleanly unmounted")
+	}
+	if !opts.ReadOnly {
+		if err := mp.Mount(opts.Force); err != nil {
+			logrus.Errorf("op=%s, err=%v", "Init", err)
+			return nil, err
+		}
+	}
+	if err := mp.checkCounters(!opts.ReadOnly); err != nil {
+		logrus.Errorf("op=%s, err=%v", "Init", err)
+		return nil, err
 	}
 	return &PoundFS{
 		RawFileSystem: fuse.NewDefaultRawFileSystem(),
-		dev:           dev,
+		dev:           mp.dev,
 		mp:            mp,
+		opts:          opts,
 		openfiles:     NewOpenfileMap(),
+		ilocks:        newInodeLockTable(),
+		rootIno:       uint64(mp.AgCtx[0].Agi.Meta.Root),
 		xattrCache:    make(map[string][]byte),
+	}, nil
+}
+
+// Close 结束读写挂载：写回所有缓存后把文件系统标记为 clean。只读挂载时什么也不做
+func (fs *PoundFS) Close() error {
+	if fs.opts.ReadOnly {
+		return nil
+	}
+	if err := syncDevice(fs.dev); err != nil {
+		return err
+	}
+	return fs.mp.Unmount()
+}
+
+// owner 返回展示给内核的文件所有者，挂载选项 uid=/gid= 会覆盖 inode 中的值
+func (fs *PoundFS) owner(inode *DInode) fuse.Owner {
+	owner := fuse.Owner{Uid: inode.Uid, Gid: inode.Gid}
+	if fs.opts.Uid != nil {
+		owner.Uid = *fs.opts.Uid
+	}
+	if fs.opts.Gid != nil {
+		owner.Gid = *fs.opts.Gid
 	}
+	return owner
+}
+
+func (fs *PoundFS) convertAttr(inodeCtx *InoContext) fuse.Attr {
+	attr := convertAttr(inodeCtx)
+	attr.Owner = fs.owner(inodeCtx.coreCache)
+	return attr
+}
+
+// isWriteFlags 判断 open 标志是否需要写权限
+func isWriteFlags(flags uint32) bool {
+	return flags&(O_WRONLY|O_RDWR|O_TRUNC|O_APPEND|O_CREAT) != 0
 }
 
 func (fs *PoundFS) Init(server *fuse.Server) {
@@ -53,12 +124,22 @@ func (fs *PoundFS) SetDebug(dbg bool) {
 	logrus.Debugf("op=%s", "SetDebug")
 }
 
+// StatFs 返回文件系统的容量信息。
+// FUSE 的 StatfsOut 没有 fsid 字段，文件系统的 UUID 通过根目录上的 UUIDXAttr 提供
 func (fs *PoundFS) StatFs(cancel <-chan struct{}, header *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
 	logrus.Debugf("[in ] op=%s", "StatFs")
-	logrus.Debugf("[out] op=%s", "StatFs")
-	// out = &fuse.StatfsOut{
-	// }
-	return fuse.ENOSYS
+	st := fs.mp.Statfs()
+	bs := fs.dev.GetBlockSize()
+	out.Blocks = st.Blocks
+	out.Bfree = st.FreeBlocks
+	out.Bavail = st.FreeBlocks
+	out.Files = st.Inodes + st.FreeInodes
+	out.Ffree = st.FreeInodes
+	out.Bsize = bs
+	out.Frsize = bs
+	out.NameLen = MaxNameLen
+	logrus.Debugf("[out] op=%s, out=%s", "StatFs", JsonStringify(out))
+	return fuse.OK
 }
 
 func (c *PoundFS) internalLookup(cancel <-chan struct{}, out *fuse.Attr, parent *InoContext, name string, header *fuse.InHeader) (node *InoContext, code fuse.Status) {
@@ -66,10 +147,7 @@ func (c *PoundFS) internalLookup(cancel <-chan struct{}, out *fuse.Attr, parent
 	child, err := parent.GetChild(name)
 	if err != nil {
 		logrus.Errorf("op=%s, err=%v, name=%s", "internalLookup", err, name)
-		if ErrNoEntry == err {
-			return nil, fuse.ENOENT
-		}
-		return nil, fuse.ENOSYS
+		return nil, toFuseStatus(err)
 	}
 	code = fuse.OK
 	return child, code
@@ -78,7 +156,11 @@ func (c *PoundFS) internalLookup(cancel <-chan struct{}, out *fuse.Attr, parent
 // Lookup 根据文件名查找文件
 func (fs *PoundFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, ino=%v, name=%s", "Lookup", header.NodeId, name)
-	parent := fs.getInode(header.NodeId)
+	parent, err := fs.getInode(header.NodeId)
+	if err != nil {
+		logrus.Errorf("Lookup %q failed: %v", name, err)
+		return toFuseStatus(err)
+	}
 	if !parent.IsDir() {
 		logrus.Errorf("Lookup %q called on non-Directory node %d", name, header.NodeId)
 		return fuse.ENOTDIR
@@ -108,9 +190,9 @@ func (fs *PoundFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name st
 	out.Ctimensec = TimestampNsecPart(inode.Ctime)
 	out.Mode = uint32(inode.Mode)
 	out.Nlink = inode.Nlink
-	out.Owner = fuse.Owner{Uid: inode.Uid, Gid: inode.Gid}
+	out.Owner = fs.owner(inode)
 	// out.Rdev = inode.Rdev
-	out.Blksize = BlockSize
+	out.Blksize = fs.dev.GetBlockSize()
 	// out.Padding = inode.Padding
 	logrus.Infof("[out] op=%s, ino=%v, name=%s", "Lookup", header.NodeId, name)
 	return fuse.OK
@@ -123,20 +205,26 @@ func (fs *PoundFS) Forget(nodeID, nlookup uint64) {
 }
 
 // getInode 根据 ino 获取 inode 对象
-func (fs *PoundFS) getInode(ino uint64) *InoContext {
+func (fs *PoundFS) getInode(ino uint64) (*InoContext, error) {
 	if ino == RootIno {
 		// 将 inode 1 转换为真实 根节点 inode
-		ino = uint64(fs.mp.AgCtx[0].Agi.Meta.Root)
+		ino = fs.rootIno
 	}
 	inodeCtx := NewInoContext(fs.dev, ino)
-	inodeCtx.LoadInode()
-	return inodeCtx
+	if err := inodeCtx.LoadInode(); err != nil {
+		return nil, err
+	}
+	return inodeCtx, nil
 }
 
 // GetAttr 获取文件属性
 func (fs *PoundFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, ino=%v", "GetAttr", input.NodeId)
-	inodeCtx := fs.getInode(input.NodeId)
+	inodeCtx, err := fs.getInode(input.NodeId)
+	if err != nil {
+		logrus.Errorf("GetAttr failed: %v", err)
+		return toFuseStatus(err)
+	}
 	inode := inodeCtx.coreCache
 
 	if inode.Nlink == 0 {
@@ -155,9 +243,9 @@ func (fs *PoundFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *f
 	out.Ctimensec = TimestampNsecPart(inode.Ctime)
 	out.Mode = uint32(inode.Mode)
 	out.Nlink = inode.Nlink
-	out.Owner = fuse.Owner{Uid: inode.Uid, Gid: inode.Gid}
+	out.Owner = fs.owner(inode)
 	// out.Rdev = inode.Rdev
-	out.Blksize = BlockSize
+	out.Blksize = fs.dev.GetBlockSize()
 	// out.Padding = inode.Padding
 	logrus.Infof("[out] op=%s", "GetAttr")
 	return fuse.OK
@@ -167,6 +255,9 @@ func (fs *PoundFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *f
 func (fs *PoundFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) (status fuse.Status) {
 	logrus.Infof("[in ] op=%s, ino=%v, flags=%v, mode=%v", "Open",
 		input.NodeId, DecodeFlags(input.Flags), DecodeFlags(input.Mode))
+	if fs.opts.ReadOnly && isWriteFlags(input.Flags) {
+		return fuse.EROFS
+	}
 	logrus.Debugf("[out] op=%s, in=%s", "Open", JsonStringify(out))
 	out.Fh = fs.openfiles.Register(input.NodeId, input.Flags)
 	// out.OpenFlags = input.Flags
@@ -178,8 +269,16 @@ func (fs *PoundFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.Op
 // SetAttr 设置文件属性
 func (fs *PoundFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, ino=%v, valid=%v", "SetAttr", input.NodeId, input.Valid)
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
+	}
 
-	inodeCtx := fs.getInode(input.NodeId)
+	inodeCtx, unlock, err := fs.lockInode(input.NodeId)
+	if err != nil {
+		logrus.Errorf("SetAttr failed: %v", err)
+		return toFuseStatus(err)
+	}
+	defer unlock()
 	inode := inodeCtx.coreCache
 	if input.Valid&fuse.FATTR_MODE != 0 {
 		inode.Mode = uint16(input.Mode)
@@ -195,10 +294,10 @@ func (fs *PoundFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *f
 	}
 	if input.Valid&fuse.FATTR_SIZE != 0 {
 		// 注意，此处相当于 truncate 操作
-		err := inodeCtx.Truncate(input.Size)
+		err := fs.truncate(inodeCtx, input.Size)
 		if err != nil {
 			logrus.Errorf("Truncate failed: %v", err)
-			return fuse.EIO
+			return toFuseStatus(err)
 		}
 		logrus.Infof("Truncate %v size to %v", inode.Ino, input.Size)
 		out.Size = input.Size
@@ -229,12 +328,12 @@ func (fs *PoundFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *f
 
 	// out.Ino = inode.Ino
 
-	err := inodeCtx.SyncInode()
+	err = inodeCtx.SyncInode()
 	if err != nil {
 		logrus.Errorf("SetAttr failed: %v", err)
 		return fuse.EIO
 	}
-	out.Attr = convertAttr(inodeCtx)
+	out.Attr = fs.convertAttr(inodeCtx)
 	logrus.Infof("[out] op=%s", "SetAttr")
 	return fuse.OK
 }
@@ -255,54 +354,45 @@ func convertAttr(inodeCtx *InoContext) fuse.Attr {
 		Nlink:     inode.Nlink,
 		Owner:     fuse.Owner{Uid: inode.Uid, Gid: inode.Gid},
 		// Rdev:      inode.Rdev,
-		Blksize: BlockSize,
+		Blksize: inodeCtx.dev.GetBlockSize(),
 		// Padding:   inode.Padding,
 		Padding: 0,
 	}
 }
 
 func (fs *PoundFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, code fuse.Status) {
-	logrus.Infof("[in ] op=%s", "Readlink")
-	logrus.Debugf("[out] op=%s", "Readlink")
-	return nil, fuse.ENOSYS
+	logrus.Infof("[in ] op=%s, ino=%v", "Readlink", header.NodeId)
+	inodeCtx, err := fs.getInode(header.NodeId)
+	if err != nil {
+		logrus.Errorf("Readlink failed: %v", err)
+		return nil, toFuseStatus(err)
+	}
+	out, err = fs.readlink(inodeCtx)
+	if err != nil {
+		logrus.Errorf("Readlink failed: %v", err)
+		return nil, toFuseStatus(err)
+	}
+	logrus.Debugf("[out] op=%s, target=%s", "Readlink", out)
+	return out, fuse.OK
 }
 
 // Mknod 创建文件（另一种方式）
 func (fs *PoundFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, name=%s, parent_ino=%v, mode=%v, flags=nil", "Mknod", name, input.NodeId, input.Mode)
-	parentInodeCtx := fs.getInode(input.NodeId)
-	parentInodeCtx.LoadInode()
-	newBlk, err := fs.mp.AllocBlock(0, 5)
-	if err != nil {
-		logrus.Errorf("Mknod failed: %v", err)
-		return fuse.EIO
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
 	}
-	newInodeCtx := NewInoContext(fs.dev, newBlk)
-	err = newInodeCtx.InitInode(uint16(input.Mode))
-	inode := newInodeCtx.coreCache
-	inode.Uid = input.Uid
-	inode.Gid = input.Gid
+	parentInodeCtx, err := fs.getInode(input.NodeId)
 	if err != nil {
 		logrus.Errorf("Mknod failed: %v", err)
-		return fuse.EIO
+		return toFuseStatus(err)
 	}
-	err = newInodeCtx.InitDataBlock()
+	newInodeCtx, err := fs.mknod(parentInodeCtx, name, input.Mode, input.Uid, input.Gid)
 	if err != nil {
 		logrus.Errorf("Mknod failed: %v", err)
-		return fuse.EIO
+		return toFuseStatus(err)
 	}
-	err = newInodeCtx.SyncInode()
-	if err != nil {
-		logrus.Errorf("Mknod failed: %v", err)
-		return fuse.EIO
-	}
-	// 放到父目录
-	err = parentInodeCtx.AddEntry(name, inode.Ino)
-	if err != nil {
-		logrus.Errorf("Mknod failed: %v", err)
-		return fuse.EIO
-	}
-	parentInodeCtx.SyncInode()
+	inode := newInodeCtx.coreCache
 	logrus.Debugf("[out] op=%s", "Mknod")
 
 	out.NodeId = inode.Ino
@@ -318,54 +408,30 @@ func (fs *PoundFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name strin
 	out.Ctimensec = TimestampNsecPart(inode.Ctime)
 	out.Mode = uint32(inode.Mode)
 	out.Nlink = inode.Nlink
-	out.Owner = fuse.Owner{Uid: inode.Uid, Gid: inode.Gid}
+	out.Owner = fs.owner(inode)
 	return fuse.OK
 }
 
 // Mkdir 根据名称在 inode 下创建目录
 func (fs *PoundFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, ino=%v, name=%v", "Mkdir", input.NodeId, name)
-	parentInodeCtx := fs.getInode(input.NodeId)
-
-	newBlk, err := fs.mp.AllocBlock(0, 1)
-	if err != nil {
-		logrus.Errorf("Mkdir failed: %v", err)
-		return fuse.EIO
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
 	}
-	newDirInodeCtx := NewInoContext(fs.dev, newBlk)
-	err = newDirInodeCtx.InitInode(uint16(fuse.S_IFDIR | input.Mode))
+	parentInodeCtx, err := fs.getInode(input.NodeId)
 	if err != nil {
 		logrus.Errorf("Mkdir failed: %v", err)
-		return fuse.EIO
+		return toFuseStatus(err)
 	}
-	inode := newDirInodeCtx.coreCache
-	inode.Uid = input.Uid
-	inode.Gid = input.Gid
+	newDirInodeCtx, err := fs.mkdir(parentInodeCtx, name, input.Mode, input.Uid, input.Gid)
 	if err != nil {
 		logrus.Errorf("Mkdir failed: %v", err)
-		return fuse.EIO
+		return toFuseStatus(err)
 	}
-	err = newDirInodeCtx.InitDataBlock()
-	if err != nil {
-		logrus.Errorf("Mkdir failed: %v", err)
-		return fuse.EIO
-	}
-	err = newDirInodeCtx.SyncInode()
-	if err != nil {
-		logrus.Errorf("Mkdir failed: %v", err)
-		return fuse.EIO
-	}
-	// 放到父目录
-	err = parentInodeCtx.AddEntry(name, inode.Ino)
-	if err != nil {
-		logrus.Errorf("Mkdir failed: %v", err)
-		return fuse.EIO
-	}
-	parentInodeCtx.SyncInode()
 
-	out.Attr = convertAttr(newDirInodeCtx)
+	out.Attr = fs.convertAttr(newDirInodeCtx)
 	out.Generation = NextGen()
-	out.NodeId = inode.Ino
+	out.NodeId = newDirInodeCtx.ino
 
 	logrus.Debugf("[out] op=%s", "Mkdir")
 	return fuse.OK
@@ -374,32 +440,21 @@ func (fs *PoundFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name strin
 // Unlink 删除文件
 func (fs *PoundFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, name=%s, ino=%v", "Unlink", name, header.NodeId)
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
+	}
 	logrus.Debugf("[out] op=%s", "Unlink")
 
 	// 删除条目、删除文件、回收空间
-	dirInoCtx := fs.getInode(header.NodeId)
-	fileIno, err := dirInoCtx.GetEntry(name)
-	if err != nil {
-		logrus.Errorf("Unlink failed when get entry by name: %v %s", err, name)
-		return fuse.EIO
-	}
-	fileInode := fs.getInode(fileIno)
-	err = dirInoCtx.RemoveEntry(name)
+	dirInoCtx, err := fs.getInode(header.NodeId)
 	if err != nil {
-		logrus.Errorf("Unlink failed when remove entry by name: %v", err)
-		return fuse.EIO
+		logrus.Errorf("Unlink failed: %v %s", err, name)
+		return toFuseStatus(err)
 	}
-	err = dirInoCtx.SyncInode()
+	err = fs.unlink(dirInoCtx, name)
 	if err != nil {
-		logrus.Errorf("Unlink failed when sync inode of dir: %v", err)
-		return fuse.EIO
-	}
-	// 减少硬链接计数
-	fileInode.coreCache.Nlink--
-	err = fileInode.SyncInode()
-	if err != nil {
-		logrus.Errorf("Unlink failed when sync inode of file: %v", err)
-		return fuse.EIO
+		logrus.Errorf("Unlink failed: %v %s", err, name)
+		return toFuseStatus(err)
 	}
 	return fuse.OK
 }
@@ -407,16 +462,18 @@ func (fs *PoundFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name st
 // Rmdir 根据文件名删除目录
 func (fs *PoundFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, name=%s, in=%s", "Rmdir", name, JsonStringify(header))
-	out := &fuse.EntryOut{}
-	code = fs.Lookup(cancel, header, name, out)
-	if code != fuse.OK {
-		logrus.Errorf("Rmdir failed when lookup: %v", code)
-		return fuse.ENOENT
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
 	}
-	code = fs.Unlink(cancel, header, name)
-	if code != fuse.OK {
-		logrus.Errorf("Rmdir failed when unlink: %v", code)
-		return code
+	dirInoCtx, err := fs.getInode(header.NodeId)
+	if err != nil {
+		logrus.Errorf("Rmdir failed: %v %s", err, name)
+		return toFuseStatus(err)
+	}
+	err = fs.rmdir(dirInoCtx, name)
+	if err != nil {
+		logrus.Errorf("Rmdir failed: %v %s", err, name)
+		return toFuseStatus(err)
 	}
 	logrus.Debugf("[out] op=%s", "Rmdir")
 	return fuse.OK
@@ -424,75 +481,80 @@ func (fs *PoundFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name str
 
 func (fs *PoundFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, pointedTo=%s, linkName=%s, in=%s", "Symlink", pointedTo, linkName, JsonStringify(header))
-	logrus.Debugf("[out] op=%s", "Symlink")
-	return fuse.ENOSYS
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
+	}
+	parentInodeCtx, err := fs.getInode(header.NodeId)
+	if err != nil {
+		logrus.Errorf("Symlink failed: %v", err)
+		return toFuseStatus(err)
+	}
+	newInodeCtx, err := fs.symlink(parentInodeCtx, linkName, pointedTo, header.Uid, header.Gid)
+	if err != nil {
+		logrus.Errorf("Symlink failed: %v", err)
+		return toFuseStatus(err)
+	}
+	out.NodeId = newInodeCtx.ino
+	out.Generation = NextGen()
+	out.Attr = fs.convertAttr(newInodeCtx)
+	logrus.Debugf("[out] op=%s, ino=%v", "Symlink", newInodeCtx.ino)
+	return fuse.OK
 }
 
 // Rename 将文件或目录从一个目录移动到另一个目录
 func (fs *PoundFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, old_dir_ino=%v, old_name=%s, new_dir_ino=%v, new_name=%s", "Rename", input.NodeId, oldName, input.Newdir, newName)
-	var err error
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
+	}
 	// 获取旧目录 inode
-	oldDirInoCtx := fs.getInode(input.NodeId)
-	err = oldDirInoCtx.LoadInode()
+	oldDirInoCtx, err := fs.getInode(input.NodeId)
 	if err != nil {
 		logrus.Errorf("Rename failed when load inode of old dir: %v", err)
 		return fuse.EIO
 	}
-	// 获取文件 inode
-	fileIno, err := oldDirInoCtx.GetEntry(oldName)
-	if err != nil {
-		logrus.Errorf("Rename failed when get entry by name: %v %s", err, oldName)
-		return fuse.EIO
-	}
-	fileInodeCtx := fs.getInode(fileIno)
-	err = fileInodeCtx.LoadInode()
-	if err != nil {
-		logrus.Errorf("Rename failed when load inode: %v", err)
-		return fuse.EIO
-	}
 	// 获取新目录 inode
-	newDirInoCtx := fs.getInode(input.Newdir)
-	err = newDirInoCtx.LoadInode()
+	newDirInoCtx, err := fs.getInode(input.Newdir)
 	if err != nil {
-		logrus.Errorf("Rename failed when load inode: %v", err)
+		logrus.Errorf("Rename failed when load inode of new dir: %v", err)
 		return fuse.EIO
 	}
-	// 删除旧目录中的条目
-	err = oldDirInoCtx.RemoveEntry(oldName)
-	if err != nil {
-		logrus.Errorf("Rename failed when remove entry by name: %v", err)
-		return fuse.EIO
+	if err = fs.rename(oldDirInoCtx, oldName, newDirInoCtx, newName); err != nil {
+		logrus.Errorf("Rename failed: %v", err)
+		return toFuseStatus(err)
+	}
+
+	logrus.Debugf("[out] op=%s", "Rename")
+	return fuse.OK
+}
+
+func (fs *PoundFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string, out *fuse.EntryOut) (code fuse.Status) {
+	logrus.Infof("[in ] op=%s, name=%s, parent_ino=%v, ino=%v", "Link", name, input.NodeId, input.Oldnodeid)
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
 	}
-	// 向新目录中添加条目
-	err = newDirInoCtx.AddEntry(newName, fileInodeCtx.coreCache.Ino)
+	parentInodeCtx, err := fs.getInode(input.NodeId)
 	if err != nil {
-		logrus.Errorf("Rename failed when add entry by name: %v", err)
-		return fuse.EIO
+		logrus.Errorf("Link failed: %v", err)
+		return toFuseStatus(err)
 	}
-	// 更新旧目录 inode
-	err = oldDirInoCtx.SyncInode()
+	targetInodeCtx, err := fs.getInode(input.Oldnodeid)
 	if err != nil {
-		logrus.Errorf("Rename failed when sync inode of old dir: %v", err)
-		return fuse.EIO
+		logrus.Errorf("Link failed: %v", err)
+		return toFuseStatus(err)
 	}
-	// 更新新目录 inode
-	err = newDirInoCtx.SyncInode()
+	err = fs.link(parentInodeCtx, name, targetInodeCtx)
 	if err != nil {
-		logrus.Errorf("Rename failed when sync inode of new dir: %v", err)
-		return fuse.EIO
+		logrus.Errorf("Link failed: %v", err)
+		return toFuseStatus(err)
 	}
-
-	logrus.Debugf("[out] op=%s", "Rename")
+	out.NodeId = targetInodeCtx.ino
+	out.Generation = NextGen()
+	out.Attr = fs.convertAttr(targetInodeCtx)
+	logrus.Debugf("[out] op=%s, ino=%v", "Link", targetInodeCtx.ino)
 	return fuse.OK
 }
 
-func (fs *PoundFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string, out *fuse.EntryOut) (code fuse.Status) {
-	logrus.Infof("[in ] op=%s", "Link")
-	logrus.Debugf("[out] op=%s", "Link")
-	return fuse.ENOSYS
-}
-
 func getXAttrCacheKey(ino uint64, key string) string {
 	return fmt.Sprintf("%d_%s", ino, key)
 }
@@ -501,7 +563,19 @@ func getXAttrCacheKey(ino uint64, key string) string {
 func (fs *PoundFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (size uint32, code fuse.Status) {
 	logrus.Infof("[in ] op=%s, ino=%v, attr=%s ", "GetXAttr", header.NodeId, attr)
 	logrus.Debugf("[out] op=%s", "GetXAttr")
+	if attr == UUIDXAttr && header.NodeId == RootIno {
+		uuid := fs.mp.sb.UUIDString()
+		if uuid == "" {
+			return 0, fuse.ENODATA
+		}
+		if len(dest) < len(uuid) {
+			return uint32(len(uuid)), fuse.ERANGE
+		}
+		return uint32(copy(dest, uuid)), fuse.OK
+	}
+	fs.xattrMu.Lock()
 	item, ok := fs.xattrCache[getXAttrCacheKey(header.NodeId, attr)]
+	fs.xattrMu.Unlock()
 	if !ok {
 		return 0, fuse.ENODATA
 	} else {
@@ -513,8 +587,19 @@ func (fs *PoundFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr
 // SetXAttr 设置文件的扩展属性
 func (fs *PoundFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
 	logrus.Infof("[in ] op=%s, attr=%s, value=%v", "SetXAttr", attr, data)
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
+	}
+	if attr == GrowfsXAttr && input.NodeId == RootIno {
+		return fs.setGrowfsXAttr(data)
+	}
+	if attr == UUIDXAttr && input.NodeId == RootIno {
+		return fuse.EPERM
+	}
 	logrus.Debugf("[out] op=%s", "SetXAttr")
+	fs.xattrMu.Lock()
 	fs.xattrCache[getXAttrCacheKey(input.InHeader.NodeId, attr)] = data
+	fs.xattrMu.Unlock()
 
 	return fuse.ENOSYS
 }
@@ -529,6 +614,9 @@ func (fs *PoundFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest
 // RemoveXAttr 删除文件的扩展属性
 func (fs *PoundFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
 	logrus.Infof("[in ] op=%s, attr=%s", "RemoveXAttr", attr)
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
+	}
 	logrus.Debugf("[out] op=%s", "RemoveXAttr")
 	return fuse.ENOSYS
 }
@@ -544,46 +632,21 @@ func (fs *PoundFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) (code fu
 func (fs *PoundFS) Create(cancel <-chan struct{}, input *fuse.CreateIn,
 	name string, out *fuse.CreateOut) (code fuse.Status) {
 	logrus.Infof("[in ] op=%s, name=%s, parent_ino=%v, mode=%v, flags=%v", "Create", name, input.NodeId, StrMode(uint16(input.Mode)), DecodeFlags(input.Flags))
+	if fs.opts.ReadOnly {
+		return fuse.EROFS
+	}
 
-	parentInodeCtx := fs.getInode(input.NodeId)
-	parentInodeCtx.LoadInode()
-	newInodeBlkno, err := fs.mp.AllocBlock(0, 8192/BlockSize)
+	parentInodeCtx, err := fs.getInode(input.NodeId)
 	if err != nil {
 		logrus.Errorf("Create failed: %v", err)
-		return fuse.EIO
+		return toFuseStatus(err)
 	}
-	newInodeCtx := NewInoContext(fs.dev, newInodeBlkno)
-	err = newInodeCtx.InitInode(uint16(input.Mode))
+	newInodeCtx, err := fs.createFile(parentInodeCtx, name, input.Mode, input.Uid, input.Gid, input.Flags, 0)
 	if err != nil {
 		logrus.Errorf("Create failed: %v", err)
-		return fuse.EIO
+		return toFuseStatus(err)
 	}
 	inode := newInodeCtx.coreCache
-	inode.Flags = uint32(input.Flags)
-	inode.Uid = input.Uid
-	inode.Gid = input.Gid
-	inode.NLocBlk = 8192 / BlockSize
-	err = newInodeCtx.SyncInode()
-	if err != nil {
-		logrus.Errorf("Create failed: %v", err)
-		return fuse.EIO
-	}
-	err = newInodeCtx.InitDataBlock()
-	if err != nil {
-		logrus.Errorf("Create failed: %v", err)
-		return fuse.EIO
-	}
-	if err != nil {
-		logrus.Errorf("Create failed: %v", err)
-		return fuse.EIO
-	}
-	// 放到父目录
-	err = parentInodeCtx.AddEntry(name, inode.Ino)
-	if err != nil {
-		logrus.Errorf("Create failed: %v", err)
-		return fuse.EIO
-	}
-	parentInodeCtx.SyncInode()
 
 	out.NodeId = inode.Ino
 	// Generation: 同一个文件， nodeid和gen的组合，必须在整个文件系统的生命周期中唯一
@@ -591,7 +654,7 @@ func (fs *PoundFS) Create(cancel <-chan struct{}, input *fuse.CreateIn,
 	out.EntryOut = fuse.EntryOut{
 		NodeId:     inode.Ino,
 		Generation: 1,
-		Attr:       convertAttr(newInodeCtx),
+		Attr:       fs.convertAttr(newInodeCtx),
 	}
 
 	out.OpenOut = fuse.OpenOut{
@@ -606,10 +669,10 @@ func (fs *PoundFS) Create(cancel <-chan struct{}, input *fuse.CreateIn,
 // OpenDir 打开目录，返回一个文件句柄
 func (fs *PoundFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) (status fuse.Status) {
 	logrus.Infof("[in ] op=%s, ino=%v, flags=%v", "OpenDir", input.NodeId, DecodeFlags(input.Flags))
-	inodeCtx := fs.getInode(input.NodeId)
-	if inodeCtx == nil {
-		logrus.Error("OpenDir failed: inode not found")
-		return fuse.ENOENT
+	inodeCtx, err := fs.getInode(input.NodeId)
+	if err != nil {
+		logrus.Errorf("OpenDir failed: %v", err)
+		return toFuseStatus(err)
 	}
 	out.Fh = fs.openfiles.Register(inodeCtx.ino, input.Flags)
 	// out.OpenFlags = input.Flags
@@ -621,13 +684,18 @@ func (fs *PoundFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse
 // Read 从指定偏移量读取指定长度的文件内容
 func (fs *PoundFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
 	logrus.Infof("[in ] op=%s, ino=%v, off=%d", "Read", input.NodeId, input.Offset)
-	inodeCtx := fs.getInode(input.NodeId)
-	if inodeCtx == nil {
-		return nil, fuse.ENOENT
+	// 读取时会更新 atime
+	inodeCtx, unlock, err := fs.lockInode(input.NodeId)
+	if err != nil {
+		logrus.Errorf("Read failed: %v", err)
+		return nil, toFuseStatus(err)
 	}
+	defer unlock()
+	inodeCtx.noatime = fs.opts.ReadOnly
 	nbytes, err := inodeCtx.Read(input.Offset, buf)
 	if err != nil {
-		return nil, fuse.EIO
+		logrus.Errorf("Read failed: %v", err)
+		return nil, toFuseStatus(err)
 	}
 	logrus.Infof("[out] op=%s, ino=%v, nbytes=%v, out=%s", "Read", inodeCtx.ino, nbytes, PreviewBuffer(buf, int(Min(nbytes, 512))))
 	return fuse.ReadResultData(buf), fuse.OK
@@ -668,22 +736,28 @@ func (fs *PoundFS) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 	logrus.Infof("[in ] op=%s, ino=%v, fh=%v, flags=%v", "Release", input.NodeId, input.Fh, DecodeFlags(input.Flags))
 	// input.Flags
 	// input.NodeId
-	fs.openfiles.Remove(input.Fh)
+	if err := fs.release(input.Fh); err != nil {
+		logrus.Errorf("Release failed: %v", err)
+	}
 	logrus.Debugf("[out] op=%s", "Release")
 }
 
 // Write 在指定偏移写入文件内容
 func (fs *PoundFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, code fuse.Status) {
 	logrus.Infof("[in ] op=%s, ino=%v, data=%s, len=%d", "Write", input.NodeId, PreviewBuffer(data, int(input.Size)), input.Size)
-	inoCtx := fs.getInode(input.NodeId)
-	if inoCtx == nil {
-		logrus.Errorf("Write failed: inode ino=%v not found", input.NodeId)
-		return 0, fuse.ENOENT
+	if fs.opts.ReadOnly {
+		return 0, fuse.EROFS
+	}
+	inoCtx, unlock, err := fs.lockInode(input.NodeId)
+	if err != nil {
+		logrus.Errorf("Write failed: %v", err)
+		return 0, toFuseStatus(err)
 	}
-	nbytes, err := inoCtx.Write(input.Offset, data)
+	defer unlock()
+	nbytes, err := fs.write(inoCtx, input.Offset, data)
 	if err != nil {
 		logrus.Errorf("Write failed: %v", err)
-		return 0, fuse.EIO
+		return 0, toFuseStatus(err)
 	}
 	logrus.Infof("[out] op=%s "+Yellow("n=%v"), "Write", nbytes)
 	return uint32(nbytes), fuse.OK
@@ -692,14 +766,29 @@ func (fs *PoundFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byt
 // Flush 将 Write 刷新到磁盘
 func (fs *PoundFS) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
 	logrus.Infof("[in ] op=%s, ino=%v, fh=%v", "Flush", input.NodeId, input.Fh)
-	logrus.Debugf("[out] op=%s", "Flush")
-	return fuse.OK
+	code := fs.sync()
+	logrus.Debugf("[out] op=%s, code=%v", "Flush", code)
+	return code
 }
 
 // Fsync 将文件所有更改刷新到磁盘
 func (fs *PoundFS) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) (code fuse.Status) {
-	logrus.Infof("[in ] op=%s", "Fsync")
-	logrus.Debugf("[out] op=%s", "Fsync")
+	logrus.Infof("[in ] op=%s, ino=%v", "Fsync", input.NodeId)
+	code = fs.sync()
+	logrus.Debugf("[out] op=%s, code=%v", "Fsync", code)
+	return code
+}
+
+// sync 把缓存中的脏块写回并持久化，设备不支持时什么也不做
+func (fs *PoundFS) sync() fuse.Status {
+	dev, ok := fs.dev.(Syncer)
+	if !ok || fs.opts.ReadOnly {
+		return fuse.OK
+	}
+	if err := dev.Sync(); err != nil {
+		logrus.Errorf("sync failed: %v", err)
+		return fuse.EIO
+	}
 	return fuse.OK
 }
 
@@ -708,7 +797,7 @@ func (fs *PoundFS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, l *fuse.D
 	logrus.Infof("[in ] op=%s, ino=%v, off=%d", "ReadDir", input.NodeId, input.Offset)
 	ino := input.InHeader.NodeId
 	if ino == RootIno {
-		ino = uint64(fs.mp.AgCtx[0].Agi.Meta.Root)
+		ino = fs.rootIno
 	}
 	inodeCtx := NewInoContext(fs.dev, ino)
 	err := inodeCtx.LoadInode()
@@ -767,7 +856,7 @@ func (fs *PoundFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, l *fu
 	logrus.Infof("op=%s, ino=%v, flags=%v, offset=%v, size=%v", "ReadDirPlus", input.NodeId, DecodeFlags(input.Flags), input.Offset, input.Size)
 	ino := input.InHeader.NodeId
 	if ino == RootIno {
-		ino = uint64(fs.mp.AgCtx[0].Agi.Meta.Root)
+		ino = fs.rootIno
 	}
 	inodeCtx := NewInoContext(fs.dev, ino)
 	err := inodeCtx.LoadInode()
@@ -820,14 +909,17 @@ func (fs *PoundFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, l *fu
 // ReleaseDir 释放目录句柄
 func (fs *PoundFS) ReleaseDir(input *fuse.ReleaseIn) {
 	logrus.Infof("[in ] op=%s, ino=%v, fh=%d flags=%v", "ReleaseDir", input.NodeId, input.Fh, DecodeFlags(input.Flags))
-	fs.openfiles.Remove(input.Fh)
+	if err := fs.release(input.Fh); err != nil {
+		logrus.Errorf("ReleaseDir failed: %v", err)
+	}
 	logrus.Debugf("[out]op=%s", "ReleaseDir")
 }
 
 func (fs *PoundFS) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) (code fuse.Status) {
-	logrus.Debugf("[in ] op=%s", "FsyncDir")
-	logrus.Debugf("[out] op=%s", "FsyncDir")
-	return fuse.ENOSYS
+	logrus.Debugf("[in ] op=%s, ino=%v", "FsyncDir", input.NodeId)
+	code = fs.sync()
+	logrus.Debugf("[out] op=%s, code=%v", "FsyncDir", code)
+	return code
 }
 
 func (fs *PoundFS) Fallocate(cancel <-chan struct{}, in *fuse.FallocateIn) (code fuse.Status) {
@@ -1,6 +1,11 @@
 package main
 
-import "github.com/sirupsen/logrus"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
 
 // 打开文件表，管理系统级别的文件把手
 
@@ -11,6 +16,7 @@ type FileHandle struct {
 }
 
 type OpenfileMap struct {
+	mu sync.Mutex
 	// key: fh
 	files map[uint64]*FileHandle
 }
@@ -23,11 +29,15 @@ func NewOpenfileMap() *OpenfileMap {
 }
 
 func (m *OpenfileMap) Get(fh uint64) *FileHandle {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.files[fh]
 }
 
 func (m *OpenfileMap) Register(ino uint64, flags uint32) uint64 {
 	fh := NextGen()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.files[fh] = &FileHandle{
 		fh:    fh,
 		ino:   ino,
@@ -37,18 +47,29 @@ func (m *OpenfileMap) Register(ino uint64, flags uint32) uint64 {
 	return fh
 }
 
+// IsOpen 判断 ino 是否还有打开的文件把手
+func (m *OpenfileMap) IsOpen(ino uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.files {
+		if f.ino == ino {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *OpenfileMap) Remove(fh uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	logrus.Infof(Red("[FS_HANDLE] Remove fh=%v, ino=%v"), fh, m.files[fh].ino)
 	delete(m.files, fh)
 }
 
-var nextgen = 1
+var nextgen uint64
 
 func NextGen() uint64 {
-	defer func() {
-		nextgen++
-	}()
-	return uint64(nextgen)
+	return atomic.AddUint64(&nextgen, 1)
 }
 
 /*
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sirupsen/logrus"
+)
+
+// 文件系统操作的公共实现。
+// FUSE 处理函数和离线工具（poundfs ls/put/mkdir/rm 等）都调用这里的方法，
+// 因此两种方式生成的镜像是一样的
+
+// 新建普通文件时在 inode 块之后预分配的字节数
+const FilePreallocBytes = 8192
+
+// dataBlocks 返回容纳 size 字节需要的 bs 字节块数
+func dataBlocks(size uint64, bs uint32) uint64 {
+	return (size + uint64(bs) - 1) / uint64(bs)
+}
+
+// toFuseStatus 把 PdErr 转换为 FUSE 的错误码
+func toFuseStatus(err error) fuse.Status {
+	switch err {
+	case nil:
+		return fuse.OK
+	case ErrNoEntry:
+		return fuse.ENOENT
+	case ErrEntryExists:
+		return fuse.Status(syscall.EEXIST)
+	case ErrNotDirectory:
+		return fuse.ENOTDIR
+	case ErrNotEmpty:
+		return fuse.Status(syscall.ENOTEMPTY)
+	case ErrNoSpace:
+		return fuse.Status(syscall.ENOSPC)
+	case ErrIsDirectory:
+		return fuse.Status(syscall.EISDIR)
+	case ErrNameTooLong:
+		return fuse.Status(syscall.ENAMETOOLONG)
+	case ErrFileTooBig:
+		return fuse.Status(syscall.EFBIG)
+	case ErrInvalidArgument, ErrOutOfRange, ErrAgToSmall:
+		return fuse.EINVAL
+	case ErrNotImplemented:
+		return fuse.ENOSYS
+	case ErrIO, ErrShortIO, ErrBadChecksum, ErrBadBtree, ErrDoubleFree:
+		return fuse.EIO
+	}
+	return fuse.EIO
+}
+
+// newInode 分配 inode 块及其后 ndata 个数据块，初始化后加入父目录。
+// setup 不为 nil 时在加入父目录之前调用，加入之后其他请求就能找到这个 inode
+func (fs *PoundFS) newInode(parent *InoContext, name string, mode uint16, uid uint32, gid uint32, ndata uint64,
+	setup func(ctx *InoContext) error) (_ *InoContext, err error) {
+	unlock, err := fs.lockInodes(parent)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if !parent.IsDir() {
+		return nil, ErrNotDirectory
+	}
+	if _, err := parent.GetEntry(name); err == nil {
+		return nil, ErrEntryExists
+	}
+	if len(name) > MaxNameLen {
+		return nil, ErrNameTooLong
+	}
+	// 目录轮流放在各个 AG 中，其他 inode 靠近父目录
+	agno := fs.mp.BlockAg(parent.ino)
+	if mode&S_IFMT == S_IFDIR {
+		agno = fs.mp.NextDirAg()
+	}
+	blk, err := fs.mp.AllocInode(agno, 1+ndata)
+	if err != nil {
+		return nil, err
+	}
+	// 之后出错时父目录中还没有写回目录项，清除 inode 块并还回分配的块
+	defer func() {
+		if err == nil {
+			return
+		}
+		if werr := fs.dev.WriteBlock(blk, make([]byte, fs.dev.GetBlockSize())); werr != nil {
+			logrus.Warnf("clear inode %d: %v", blk, werr)
+		}
+		if ferr := fs.mp.FreeInode(blk, 1+ndata); ferr != nil {
+			logrus.Warnf("free inode %d: %v", blk, ferr)
+		}
+	}()
+	ctx := NewInoContext(fs.dev, blk)
+	err = ctx.InitInode(mode)
+	if err != nil {
+		return nil, err
+	}
+	inode := ctx.coreCache
+	inode.Uid = uid
+	inode.Gid = gid
+	inode.NLocBlk = ndata
+	if ctx.IsDir() {
+		ctx.dirSfHdr.Parent = parent.ino
+	}
+	err = ctx.SyncInode()
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.InitDataBlock()
+	if err != nil {
+		return nil, err
+	}
+	if setup != nil {
+		if err = setup(ctx); err != nil {
+			return nil, err
+		}
+	}
+	// 放到父目录
+	err = parent.AddEntry(name, blk)
+	if err != nil {
+		return nil, err
+	}
+	err = parent.SyncInode()
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// mknod 创建一个没有数据块的 inode
+func (fs *PoundFS) mknod(parent *InoContext, name string, mode uint32, uid uint32, gid uint32) (*InoContext, error) {
+	return fs.newInode(parent, name, uint16(mode), uid, gid, 0, nil)
+}
+
+// mkdir 创建目录
+func (fs *PoundFS) mkdir(parent *InoContext, name string, mode uint32, uid uint32, gid uint32) (*InoContext, error) {
+	return fs.newInode(parent, name, uint16(S_IFDIR|mode), uid, gid, 0, nil)
+}
+
+// createFile 创建普通文件，预分配能容纳 size 字节且不少于 FilePreallocBytes 的数据块
+func (fs *PoundFS) createFile(parent *InoContext, name string, mode uint32, uid uint32, gid uint32, flags uint32, size uint64) (*InoContext, error) {
+	ndata := dataBlocks(Max(size, FilePreallocBytes), fs.dev.GetBlockSize())
+	return fs.newInode(parent, name, uint16(mode), uid, gid, ndata, func(ctx *InoContext) error {
+		ctx.coreCache.Flags = flags
+		return ctx.SyncInode()
+	})
+}
+
+// symlink 创建符号链接，链接目标保存在数据块中
+func (fs *PoundFS) symlink(parent *InoContext, name string, target string, uid uint32, gid uint32) (*InoContext, error) {
+	if target == "" {
+		return nil, ErrNoEntry
+	}
+	ndata := dataBlocks(uint64(len(target)), fs.dev.GetBlockSize())
+	return fs.newInode(parent, name, S_IFLNK|0777, uid, gid, ndata, func(ctx *InoContext) error {
+		_, err := ctx.Write(0, []byte(target))
+		return err
+	})
+}
+
+// readlink 读取符号链接的目标
+func (fs *PoundFS) readlink(ctx *InoContext) ([]byte, error) {
+	if ctx.coreCache.Mode&S_IFMT != S_IFLNK {
+		return nil, ErrInvalidArgument
+	}
+	ctx.noatime = true
+	return readAll(ctx)
+}
+
+// link 为已有的 inode 创建硬链接，不允许链接目录
+func (fs *PoundFS) link(parent *InoContext, name string, target *InoContext) error {
+	unlock, err := fs.lockInodes(parent, target)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !parent.IsDir() {
+		return ErrNotDirectory
+	}
+	if target.IsDir() {
+		return ErrIsDirectory
+	}
+	if _, err := parent.GetEntry(name); err == nil {
+		return ErrEntryExists
+	}
+	// 最后一个链接已经删除，inode 正在等待回收
+	if target.coreCache.Nlink == 0 {
+		return ErrNoEntry
+	}
+	err = parent.AddEntry(name, target.ino)
+	if err != nil {
+		return err
+	}
+	err = parent.SyncInode()
+	if err != nil {
+		return err
+	}
+	target.coreCache.Nlink++
+	return target.SyncInode()
+}
+
+// unlink 删除目录项并减少 inode 的硬链接计数
+func (fs *PoundFS) unlink(parent *InoContext, name string) error {
+	fileInode, unlock, err := fs.lockEntry(parent, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fs.removeEntry(parent, name, fileInode)
+}
+
+// removeEntry 删除 parent 中指向 fileInode 的目录项，硬链接计数为 0 时回收 fileInode。
+// 调用者持有两者的锁
+func (fs *PoundFS) removeEntry(parent *InoContext, name string, fileInode *InoContext) error {
+	err := parent.RemoveEntry(name)
+	if err != nil {
+		return err
+	}
+	err = parent.SyncInode()
+	if err != nil {
+		return err
+	}
+	return fs.dropLink(fileInode)
+}
+
+// dropLink 减少 fileInode 的硬链接计数，为 0 且没有打开时回收它。调用者持有 fileInode 的锁
+func (fs *PoundFS) dropLink(fileInode *InoContext) error {
+	fileInode.coreCache.Nlink--
+	if err := fileInode.SyncInode(); err != nil {
+		return err
+	}
+	// 文件还打开着时等到最后一个把手释放再回收
+	if fileInode.coreCache.Nlink > 0 || fs.openfiles.IsOpen(fileInode.ino) {
+		return nil
+	}
+	return fs.freeInode(fileInode)
+}
+
+// freeInode 回收已经没有硬链接的 inode 占用的 inode 块和数据块
+func (fs *PoundFS) freeInode(ctx *InoContext) error {
+	nblk := 1 + ctx.coreCache.NLocBlk
+	var extents []DExtent
+	switch ctx.coreCache.Format {
+	case FMT_LOCAL:
+	case FMT_EXTENTS:
+		nblk = 1
+		extents = ctx.extents.Extents
+	default:
+		return ErrNotImplemented
+	}
+	// 清除 inode 块，避免 fsck 把它当作未回收的 inode
+	if err := ctx.dev.WriteBlock(ctx.ino, make([]byte, ctx.blockSize())); err != nil {
+		return err
+	}
+	if err := fs.freeExtents(extents); err != nil {
+		return err
+	}
+	return fs.mp.FreeInode(ctx.ino, nblk)
+}
+
+// freeExtents 释放区间中的物理块，区间可能位于不同的 AG
+func (fs *PoundFS) freeExtents(extents []DExtent) error {
+	for _, ext := range extents {
+		if err := fs.mp.FreeBlocks(fs.mp.BlockAg(ext.Start), ext.Start, uint64(ext.Len)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write 在 off 处写入 data，超出已分配的数据块时先扩展文件。调用者持有 ctx 的锁
+func (fs *PoundFS) write(ctx *InoContext, off uint64, data []byte) (uint64, error) {
+	if err := fs.reserve(ctx, dataBlocks(off+uint64(len(data)), fs.dev.GetBlockSize())); err != nil {
+		return 0, err
+	}
+	return ctx.Write(off, data)
+}
+
+// reserve 保证文件至少有 nblk 个数据块。FMT_LOCAL 的文件先转换为 FMT_EXTENTS，
+// 新的块优先从 inode 所在的 AG 分配。每次至少分配与已有的数据块一样多的块，区间数随文件大小对数增长；
+// 没有这么大的连续空间时分配能找到的较小的区间。空闲块足够、但过于零碎以致区间列表装不下时返回 ErrFileTooBig
+func (fs *PoundFS) reserve(ctx *InoContext, nblk uint64) error {
+	inode := ctx.coreCache
+	if nblk <= inode.NLocBlk {
+		return nil
+	}
+	if inode.Mode&S_IFMT != S_IFREG {
+		return ErrNotImplemented
+	}
+	if inode.Format == FMT_LOCAL {
+		ctx.convertToExtents()
+	}
+	agno := fs.mp.BlockAg(ctx.ino)
+	var err error
+	for inode.NLocBlk < nblk && err == nil {
+		need := nblk - inode.NLocBlk
+		var start uint64
+		n := Max(need, inode.NLocBlk)
+		for {
+			start, err = fs.mp.AllocNear(agno, n)
+			if err != ErrNoSpace || n == 1 {
+				break
+			}
+			if n > need {
+				n = need
+			} else {
+				n = (n + 1) / 2
+			}
+		}
+		if err != nil {
+			break
+		}
+		if err = ctx.appendExtent(start, n); err != nil {
+			// 区间列表已满，刚分配的块还回去
+			if ferr := fs.mp.FreeBlocks(fs.mp.BlockAg(start), start, n); ferr != nil {
+				return ferr
+			}
+			// 空闲块本来就不够时仍然报告空间不足
+			if fs.mp.Statfs().FreeBlocks < nblk-inode.NLocBlk {
+				err = ErrNoSpace
+			}
+		}
+	}
+	// 出错时也要记录已经分配的块，否则会泄漏
+	if serr := ctx.SyncInode(); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// writtenBlocks 返回新建的普通文件一次写入 size 字节后最多占用的数据块数：预分配的部分，
+// 加上 reserve 第一次扩展时分配的块（至少与预分配的一样多）。用于估算镜像大小
+func writtenBlocks(size uint64, bs uint32) uint64 {
+	n := dataBlocks(FilePreallocBytes, bs)
+	if need := dataBlocks(size, bs); need > n {
+		n += Max(need-n, n)
+	}
+	return n
+}
+
+// truncate 修改文件大小，变长时先分配数据块，变短时释放新的文件末尾之后的数据块。
+// FMT_LOCAL 的文件至少保留 FilePreallocBytes 的数据块，以免又要转换为 FMT_EXTENTS。调用者持有 ctx 的锁
+func (fs *PoundFS) truncate(ctx *InoContext, size uint64) error {
+	bs := fs.dev.GetBlockSize()
+	if err := fs.reserve(ctx, dataBlocks(size, bs)); err != nil {
+		// 空间不够时文件大小不变，还回已经分配的块
+		if ctx.coreCache.Format == FMT_EXTENTS {
+			removed := ctx.trimExtents(dataBlocks(ctx.coreCache.Size, bs))
+			if serr := ctx.SyncInode(); serr != nil {
+				return serr
+			}
+			if ferr := fs.freeExtents(removed); ferr != nil {
+				return ferr
+			}
+		}
+		return err
+	}
+	if err := ctx.Truncate(size); err != nil {
+		return err
+	}
+	nlocblk := ctx.coreCache.NLocBlk
+	switch ctx.coreCache.Format {
+	case FMT_LOCAL:
+		keep := dataBlocks(Max(size, FilePreallocBytes), bs)
+		if keep >= nlocblk {
+			return ctx.SyncInode()
+		}
+		// 先让 inode 不再引用这些块再释放，中途崩溃时只会泄漏
+		ctx.coreCache.NLocBlk = keep
+		if err := ctx.SyncInode(); err != nil {
+			return err
+		}
+		start := ctx.ino + 1 + keep
+		return fs.mp.FreeBlocks(fs.mp.BlockAg(start), start, nlocblk-keep)
+	case FMT_EXTENTS:
+		removed := ctx.trimExtents(dataBlocks(size, bs))
+		if err := ctx.SyncInode(); err != nil {
+			return err
+		}
+		return fs.freeExtents(removed)
+	}
+	return ctx.SyncInode()
+}
+
+// release 释放文件把手，inode 已经没有硬链接且不再打开时回收它的空间
+func (fs *PoundFS) release(fh uint64) error {
+	f := fs.openfiles.Get(fh)
+	if f == nil {
+		return nil
+	}
+	fs.openfiles.Remove(fh)
+	if f.ino == RootIno || fs.openfiles.IsOpen(f.ino) {
+		return nil
+	}
+	unlock := fs.ilocks.lock(f.ino)
+	defer unlock()
+	// 等待锁的时候可能已经被 unlink 回收，inode 块被清零
+	blk, err := fs.dev.ReadBlock(f.ino)
+	if err != nil {
+		return err
+	}
+	if !CheckMagic(blk[:2], InodeMagic) {
+		return nil
+	}
+	ctx := NewInoContext(fs.dev, f.ino)
+	if err := ctx.LoadInode(); err != nil {
+		return err
+	}
+	// 也可能又被打开，或者 inode 块回收后重新分配给了别的文件
+	if ctx.coreCache.Nlink > 0 || fs.openfiles.IsOpen(f.ino) {
+		return nil
+	}
+	return fs.freeInode(ctx)
+}
+
+// rmdir 删除空目录
+func (fs *PoundFS) rmdir(parent *InoContext, name string) error {
+	child, unlock, err := fs.lockEntry(parent, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !child.IsDir() {
+		return ErrNotDirectory
+	}
+	if len(child.dirSfHdr.Entries) > 0 {
+		return ErrNotEmpty
+	}
+	return fs.removeEntry(parent, name, child)
+}
+
+// rename 把 oldDir 中的 oldName 移动为 newDir 中的 newName。newName 已经存在时按 rename(2) 的规则替换：
+// 目录只能替换空目录，文件不能替换目录，被替换的 inode 与 unlink 一样减少硬链接计数并在为 0 时回收
+func (fs *PoundFS) rename(oldDir *InoContext, oldName string, newDir *InoContext, newName string) error {
+	if len(newName) > MaxNameLen {
+		return ErrNameTooLong
+	}
+	// 同一个目录使用同一个对象，否则后写入的会覆盖先写入的
+	if newDir.ino == oldDir.ino {
+		newDir = oldDir
+	} else {
+		fs.renameMu.Lock()
+		defer fs.renameMu.Unlock()
+	}
+	src, dst, unlock, err := fs.lockRename(oldDir, oldName, newDir, newName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// 目录不能移动到自己或自己的子孙目录下，否则会脱离目录树形成环
+	if src.IsDir() && newDir != oldDir {
+		inside, err := fs.isAncestor(src.ino, newDir)
+		if err != nil {
+			return err
+		}
+		if inside {
+			return ErrInvalidArgument
+		}
+	}
+	if dst != nil {
+		// 新旧名字是同一个 inode 的硬链接时什么都不做
+		if dst.ino == src.ino {
+			return nil
+		}
+		switch {
+		case src.IsDir() && !dst.IsDir():
+			return ErrNotDirectory
+		case !src.IsDir() && dst.IsDir():
+			return ErrIsDirectory
+		case dst.IsDir() && len(dst.dirSfHdr.Entries) > 0:
+			return ErrNotEmpty
+		}
+		if err = newDir.RemoveEntry(newName); err != nil {
+			return err
+		}
+	}
+	if err = oldDir.RemoveEntry(oldName); err != nil {
+		return err
+	}
+	// 新目录放不下时两个目录都还没有写回
+	if err = newDir.AddEntry(newName, src.ino); err != nil {
+		return err
+	}
+	if err = oldDir.SyncInode(); err != nil {
+		return err
+	}
+	if newDir != oldDir {
+		if err = newDir.SyncInode(); err != nil {
+			return err
+		}
+		if src.IsDir() {
+			if err = src.SetParent(newDir.ino); err != nil {
+				return err
+			}
+		}
+	}
+	if dst != nil {
+		return fs.dropLink(dst)
+	}
+	return nil
+}
+
+// isAncestor 沿 Parent 向上查找到根目录，判断 ino 是否是 dir 自己或它的祖先
+func (fs *PoundFS) isAncestor(ino uint64, dir *InoContext) (bool, error) {
+	for {
+		if dir.ino == ino {
+			return true, nil
+		}
+		parent := dir.dirSfHdr.Parent
+		if dir.ino == fs.rootIno || parent == dir.ino {
+			return false, nil
+		}
+		dir = NewInoContext(fs.dev, parent)
+		if err := dir.LoadInode(); err != nil {
+			return false, err
+		}
+		if !dir.IsDir() {
+			return false, ErrNotDirectory
+		}
+	}
+}
+
+// readAll 读取整个文件的内容
+func readAll(ctx *InoContext) ([]byte, error) {
+	data := make([]byte, ctx.coreCache.Size)
+	if len(data) == 0 {
+		return data, nil
+	}
+	n, err := ctx.Read(0, data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// lookupPath 从根目录开始逐级查找 path 对应的 inode
+func (fs *PoundFS) lookupPath(path string) (*InoContext, error) {
+	ctx, err := fs.getInode(RootIno)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if !ctx.IsDir() {
+			return nil, ErrNotDirectory
+		}
+		child, err := ctx.GetChild(name)
+		if err != nil {
+			return nil, err
+		}
+		ctx = child
+	}
+	return ctx, nil
+}
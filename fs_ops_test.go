@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestFsOps(t *testing.T) {
+	// 10MB
+	blockcount := uint64(10 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.mkdir(root, "dir", 0755, 1000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.mkdir(root, "dir", 0755, 1000, 1000); err != ErrEntryExists {
+		t.Errorf("err is %v not %v", err, ErrEntryExists)
+	}
+	file, err := fs.createFile(dir, "file", S_IFREG|0644, 1000, 1000, O_CREAT|O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Write(0, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := fs.lookupPath("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := readAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("read %q", data)
+	}
+	if ctx.coreCache.Uid != 1000 || ctx.coreCache.NLocBlk != FilePreallocBytes/DefaultBlockSize {
+		t.Errorf("bad inode %+v", ctx.coreCache)
+	}
+	if _, err = fs.lookupPath("/dir/file/x"); err != ErrNotDirectory {
+		t.Errorf("err is %v not %v", err, ErrNotDirectory)
+	}
+
+	root, _ = fs.lookupPath("/")
+	if err = fs.rmdir(root, "dir"); err != ErrNotEmpty {
+		t.Errorf("err is %v not %v", err, ErrNotEmpty)
+	}
+	dir, _ = fs.lookupPath("/dir")
+	if err = fs.unlink(dir, "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.rmdir(root, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.lookupPath("/dir"); err != ErrNoEntry {
+		t.Errorf("err is %v not %v", err, ErrNoEntry)
+	}
+}
+
+func TestReclaimSpace(t *testing.T) {
+	// 1MB，反复创建删除直到远超设备大小
+	dev, err := NewMemBlockDevice(2048, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{AgCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsp := newAgFreeSpace(fs.mp.AgCtx[0])
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 先分配一次，让 AGFL 补满
+	if _, err = fs.mkdir(root, "keep", 0755, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	before := freeBlocks(t, fsp)
+	for i := 0; i < 100; i++ {
+		if _, err = fs.createFile(root, "file", S_IFREG|0644, 0, 0, 0, 64*1024); err != nil {
+			t.Fatalf("create #%d: %v", i, err)
+		}
+		if _, err = fs.mkdir(root, "dir", 0755, 0, 0); err != nil {
+			t.Fatalf("mkdir #%d: %v", i, err)
+		}
+		if err = fs.unlink(root, "file"); err != nil {
+			t.Fatal(err)
+		}
+		if err = fs.rmdir(root, "dir"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if free := freeBlocks(t, fsp); free != before {
+		t.Errorf("%d blocks free after deleting everything, was %d", free, before)
+	}
+
+	// truncate 释放文件末尾之后的块，但保留预分配的部分
+	file, err := fs.createFile(root, "file", S_IFREG|0644, 0, 0, 0, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.truncate(file, 100); err != nil {
+		t.Fatal(err)
+	}
+	prealloc := uint64(FilePreallocBytes / DefaultBlockSize)
+	if file.coreCache.NLocBlk != prealloc || file.coreCache.Size != 100 {
+		t.Errorf("after truncate: %d blocks, size %d", file.coreCache.NLocBlk, file.coreCache.Size)
+	}
+	if free := freeBlocks(t, fsp); free != before-1-prealloc {
+		t.Errorf("%d blocks free after truncate, want %d", free, before-1-prealloc)
+	}
+
+	// 打开着的文件删除后等到释放把手再回收
+	fh := fs.openfiles.Register(file.ino, O_RDONLY)
+	if err = fs.unlink(root, "file"); err != nil {
+		t.Fatal(err)
+	}
+	if free := freeBlocks(t, fsp); free != before-1-prealloc {
+		t.Errorf("open file reclaimed on unlink: %d blocks free", free)
+	}
+	if err = fs.release(fh); err != nil {
+		t.Fatal(err)
+	}
+	if free := freeBlocks(t, fsp); free != before {
+		t.Errorf("%d blocks free after release, was %d", free, before)
+	}
+
+	// 空间不够时 truncate 返回 ENOSPC，文件大小不变，已经分配的块还回去
+	file, err = fs.createFile(root, "big", S_IFREG|0644, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := fs.mp.Statfs().FreeBlocks
+	in := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: fuse.InHeader{NodeId: file.ino}, Valid: fuse.FATTR_SIZE, Size: 4 * 1024 * 1024}}
+	var out fuse.AttrOut
+	if code := fs.SetAttr(nil, &in, &out); code != fuse.Status(syscall.ENOSPC) {
+		t.Errorf("truncate beyond the device: %v", code)
+	}
+	if err = file.LoadInode(); err != nil {
+		t.Fatal(err)
+	}
+	if file.coreCache.Size != 0 {
+		t.Errorf("size is %d after failed truncate", file.coreCache.Size)
+	}
+	if got := fs.mp.Statfs().FreeBlocks; got < free {
+		t.Errorf("%d blocks free after failed truncate, was %d", got, free)
+	}
+
+	// 指向最后一个 AG 之后的块号不能让挂载崩溃
+	if err = fs.mp.FreeInode(1<<40, 1); err != ErrOutOfRange {
+		t.Errorf("free inode beyond the last AG: err is %v not %v", err, ErrOutOfRange)
+	}
+	if err = fs.mp.FreeBlocks(1, 2048+AgHeaderBlocks, 1); err != ErrOutOfRange {
+		t.Errorf("free blocks in AG 1: err is %v not %v", err, ErrOutOfRange)
+	}
+	if _, err = fs.mp.AllocBlock(1, 1); err != ErrOutOfRange {
+		t.Errorf("alloc in AG 1: err is %v not %v", err, ErrOutOfRange)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
+
+func TestNameTooLong(t *testing.T) {
+	// 4K 的块中短格式目录放得下 300 字节的文件名，但 Namelen 只有一个字节
+	dev, err := NewMemBlockDevice(2048, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := fs.mp.Statfs().FreeBlocks
+	name := strings.Repeat("x", 300)
+	if _, err = fs.createFile(root, name, S_IFREG|0644, 0, 0, O_CREAT|O_WRONLY, 0); err != ErrNameTooLong {
+		t.Errorf("err is %v not %v", err, ErrNameTooLong)
+	}
+	var out fuse.CreateOut
+	if code := fs.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: RootIno}, Mode: S_IFREG | 0644}, name, &out); code != fuse.Status(syscall.ENAMETOOLONG) {
+		t.Errorf("create: %v", code)
+	}
+	if err = root.AddEntry(name, RootIno); err != ErrNameTooLong {
+		t.Errorf("err is %v not %v", err, ErrNameTooLong)
+	}
+	if got := fs.mp.Statfs().FreeBlocks; got != free {
+		t.Errorf("%d blocks free, was %d", got, free)
+	}
+	// 255 字节的文件名可以
+	if _, err = fs.createFile(root, name[:MaxNameLen], S_IFREG|0644, 0, 0, O_CREAT|O_WRONLY, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.lookupPath("/" + name[:MaxNameLen]); err != nil {
+		t.Error(err)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
+
+func TestRename(t *testing.T) {
+	// 10MB
+	blockcount := uint64(10 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(name string, data []byte) *InoContext {
+		t.Helper()
+		ctx, err := fs.createFile(root, name, S_IFREG|0644, 0, 0, O_CREAT|O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fs.write(ctx, 0, data); err != nil {
+			t.Fatal(err)
+		}
+		return ctx
+	}
+	create("a", []byte("aaaa"))
+	free := fs.mp.Statfs().FreeBlocks
+	// 被覆盖的文件扩展成了 FMT_EXTENTS，它的区间也要回收
+	create("b", make([]byte, 64*1024))
+	if err = fs.rename(root, "a", root, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.mp.Statfs().FreeBlocks; got != free {
+		t.Errorf("%d blocks free after renaming over b, was %d", got, free)
+	}
+	if _, err = fs.lookupPath("/a"); err != ErrNoEntry {
+		t.Errorf("err is %v not %v", err, ErrNoEntry)
+	}
+	b, err := fs.lookupPath("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readAll(b); err != nil || string(data) != "aaaa" {
+		t.Errorf("b is %q, %v", data, err)
+	}
+	// 同一个 inode 的两个硬链接之间 rename 什么都不做
+	if err = fs.link(root, "c", b); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.rename(root, "b", root, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.lookupPath("/b"); err != nil {
+		t.Error(err)
+	}
+
+	// 目录和文件不能互相替换，非空目录不能被替换
+	d1, err := fs.mkdir(root, "d1", 0755, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.mkdir(root, "d2", 0755, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	d3, err := fs.mkdir(root, "d3", 0755, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.mkdir(d3, "sub", 0755, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		old, new string
+		want     error
+	}{
+		{"b", "d1", ErrIsDirectory},
+		{"d1", "b", ErrNotDirectory},
+		{"d1", "d3", ErrNotEmpty},
+	} {
+		if err = fs.rename(root, c.old, root, c.new); err != c.want {
+			t.Errorf("rename %s to %s: err is %v not %v", c.old, c.new, err, c.want)
+		}
+	}
+	in := fuse.RenameIn{InHeader: fuse.InHeader{NodeId: RootIno}, Newdir: RootIno}
+	if code := fs.Rename(nil, &in, "d1", "d3"); code != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("rename over a non-empty directory: %v", code)
+	}
+	// 目录替换空目录，移到另一个目录中时更新 ..
+	if err = fs.rename(root, "d2", root, "d1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.rename(root, "d1", d3, "moved"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := fs.lookupPath("/d3/moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.dirSfHdr.Parent != d3.ino || moved.ino == d1.ino {
+		t.Errorf("moved directory %d has parent %d", moved.ino, moved.dirSfHdr.Parent)
+	}
+	// 目录不能移到自己或子孙目录下
+	for _, dir := range []*InoContext{d3, moved} {
+		if err = fs.rename(root, "d3", dir, "loop"); err != ErrInvalidArgument {
+			t.Errorf("rename d3 into %d: err is %v not %v", dir.ino, err, ErrInvalidArgument)
+		}
+	}
+	in = fuse.RenameIn{InHeader: fuse.InHeader{NodeId: RootIno}, Newdir: moved.ino}
+	if code := fs.Rename(nil, &in, "d3", "loop"); code != fuse.EINVAL {
+		t.Errorf("rename into a descendant: %v", code)
+	}
+	if _, err = fs.lookupPath("/d3/moved"); err != nil {
+		t.Error(err)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
+
+func TestCreateInFullDir(t *testing.T) {
+	// 短格式目录满了之后创建失败，分配的 inode 块和数据块要还回去
+	dev, err := NewMemBlockDevice(4096, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.mkdir(root, "dir", 0755, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if _, err = fs.createFile(dir, fmt.Sprintf("file%d", i), S_IFREG|0644, 0, 0, 0, 0); err == ErrNoSpace {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// mkdir 在另一个 AG 中分配，比较所有 AG 的 AGF 计数之和
+	before := fs.mp.Statfs()
+	if _, err = fs.createFile(dir, "file-that-does-not-fit", S_IFREG|0644, 0, 0, 0, 0); err != ErrNoSpace {
+		t.Errorf("err is %v not %v", err, ErrNoSpace)
+	}
+	if _, err = fs.mkdir(dir, "dir-that-does-not-fit", 0755, 0, 0); err != ErrNoSpace {
+		t.Errorf("err is %v not %v", err, ErrNoSpace)
+	}
+	if after := fs.mp.Statfs(); after.FreeBlocks != before.FreeBlocks || after.Inodes != before.Inodes {
+		t.Errorf("%d blocks free, was %d; %d inodes, was %d", after.FreeBlocks, before.FreeBlocks, after.Inodes, before.Inodes)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
+
+func TestReplaceEntryInFullDir(t *testing.T) {
+	// 替换同名 entry 放不下时，原有的 entry 不能丢
+	dev, err := NewMemBlockDevice(4096, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.mkdir(root, "dir", 0755, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if _, err = fs.createFile(dir, fmt.Sprintf("file%d", i), S_IFREG|0644, 0, 0, 0, 0); err == ErrNoSpace {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ino, err := dir.GetEntry("file0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", MaxNameLen)
+	if err = dir.AddEntry("file0", ino+1); err != nil {
+		t.Errorf("replace with same length: %v", err)
+	}
+	if err = dir.AddEntry("file0", ino); err != nil {
+		t.Fatal(err)
+	}
+	before := len(dir.dirSfHdr.Entries)
+	if err = dir.AddEntry(long, ino); err != ErrNoSpace {
+		t.Errorf("err is %v not %v", err, ErrNoSpace)
+	}
+	if got, err := dir.GetEntry("file0"); err != nil || got != ino {
+		t.Errorf("file0 is %d %v, want %d", got, err, ino)
+	}
+	if after := len(dir.dirSfHdr.Entries); after != before || int(dir.dirSfHdr.Count) != after {
+		t.Errorf("%d entries (count %d), was %d", after, dir.dirSfHdr.Count, before)
+	}
+}
@@ -0,0 +1,804 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FsckOptions 控制 fsck 的行为
+type FsckOptions struct {
+	Repair bool // 修复发现的问题
+}
+
+// FsckReport 是一次检查的结果
+type FsckReport struct {
+	Problems   []string // 发现的问题
+	Repairs    []string // 已执行的修复
+	Inodes     int      // 可达的 inode 数量
+	Dirs       int      // 可达的目录数量
+	UsedBlocks uint64   // 被元数据和 inode 占用的块数
+	FreeBlocks uint64   // 空闲空间树中的块数
+	Dirty      bool     // 上次挂载后没有正常卸载，不算作问题
+}
+
+// Clean 表示没有发现任何问题
+func (r *FsckReport) Clean() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *FsckReport) problemf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	logrus.Debugf("fsck: %s", msg)
+	r.Problems = append(r.Problems, msg)
+}
+
+func (r *FsckReport) repairf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	logrus.Debugf("fsck repair: %s", msg)
+	r.Repairs = append(r.Repairs, msg)
+}
+
+const LostFoundName = "lost+found"
+
+// 块的占用者，除 inode 号外的特殊取值
+const (
+	fsckOwnerNone     = uint64(0)
+	fsckOwnerMeta     = ^uint64(0)     // AG 头部
+	fsckOwnerUnlinked = ^uint64(0) - 1 // 已删除（nlink 为 0）但未回收的 inode
+	fsckOwnerBtree    = ^uint64(0) - 2 // 空闲空间树的节点和 AGFL 中预留的块
+)
+
+type fsckInode struct {
+	ctx  *InoContext
+	refs uint32 // 指向它的目录项数量
+}
+
+type fsckEntry struct {
+	parent uint64
+	name   string
+}
+
+type fsckChecker struct {
+	dev    BlockDevice
+	sb     *Superblock
+	opts   FsckOptions
+	report *FsckReport
+	total  uint64
+	ags    []*AgCtx // 头部损坏的 AG 为 nil
+	free   []bool   // 块是否在空闲空间树中
+	owner  []uint64 // 块的占用者
+	root   uint64
+	backup uint32 // 主超级块损坏时所用副本的 AG
+	inodes map[uint64]*fsckInode // 从根目录可达的 inode
+	// 指向无效 inode 的目录项
+	dangling []fsckEntry
+	// 不可达但 nlink 不为 0 的 inode，需要放到 lost+found
+	orphans []*InoContext
+	// nlink 为 0 但未回收的 inode，修复时回收
+	unlinked []uint64
+}
+
+// Fsck 离线检查 dev 上的文件系统，opts.Repair 为 true 时修复发现的问题。
+// 只有无法读取超级块等致命错误才会返回 error，文件系统中的问题记录在 FsckReport 中
+func Fsck(dev BlockDevice, opts FsckOptions) (*FsckReport, error) {
+	sb, backup, err := loadSuperblockOrBackup(dev)
+	if err != nil {
+		return nil, err
+	}
+	readonly, err := checkFeatures(sb)
+	if err != nil {
+		return nil, err
+	}
+	if readonly && opts.Repair {
+		return nil, ErrRoCompatFeature
+	}
+	dev = withFeatures(dev, sb)
+	total := uint64(dev.GetTotalBlockCount())
+	c := &fsckChecker{
+		dev:    dev,
+		sb:     sb,
+		opts:   opts,
+		report: &FsckReport{},
+		total:  total,
+		ags:    make([]*AgCtx, sb.AgCount),
+		free:   make([]bool, total),
+		owner:  make([]uint64, total),
+		inodes: make(map[uint64]*fsckInode),
+		backup: backup,
+	}
+	if backup != 0 {
+		c.report.problemf("primary superblock is damaged, using the backup in AG %d", backup)
+	}
+	c.report.Dirty = sb.State != SbStateClean
+	c.checkAgs()
+	if c.ags[0] != nil {
+		c.walkTree()
+		c.checkNlink()
+		c.scanOrphans()
+	}
+	c.checkInodeCounts()
+	c.checkLeaks()
+	c.summarize()
+	if opts.Repair && !c.report.Clean() {
+		if c.ags[0] == nil {
+			return c.report, fmt.Errorf("cannot repair: headers of AG 0 are damaged")
+		}
+		if err := c.repair(); err != nil {
+			return c.report, err
+		}
+	}
+	// 检查和修复都完成后才能把文件系统标记为 clean
+	if opts.Repair && c.report.Dirty {
+		sb.State = SbStateClean
+		if err := writePrimarySuperblock(dev, sb); err != nil {
+			return c.report, err
+		}
+		c.report.repairf("marked the filesystem clean")
+	}
+	return c.report, nil
+}
+
+// agRange 返回 AG 的起始块号和真实大小
+func (c *fsckChecker) agRange(agno uint32) (start uint64, size uint64) {
+	start = uint64(agno) * uint64(c.sb.AgBlocks)
+	return start, uint64(c.ags[agno].Superblock.Meta.AgBlocks)
+}
+
+// checkAgs 检查每个 AG 的头部和空闲空间树
+func (c *fsckChecker) checkAgs() {
+	for agno := uint32(0); agno < c.sb.AgCount; agno++ {
+		ag := NewAgCtx(c.dev, agno, c.sb.AgBlocks)
+		var err error
+		if agno == 0 && c.backup != 0 {
+			err = ag.loadWithSuperblock(c.sb)
+		} else {
+			err = ag.Load()
+		}
+		if err != nil {
+			c.report.problemf("AG %d: cannot load headers: %v", agno, err)
+			continue
+		}
+		if !c.checkAgHeaders(agno, ag) {
+			continue
+		}
+		c.ags[agno] = ag
+		start, size := c.agRange(agno)
+		if start+size > c.total {
+			c.report.problemf("AG %d: blocks [%d, %d) beyond end of device (%d blocks)", agno, start, start+size, c.total)
+			c.ags[agno] = nil
+			continue
+		}
+		// AG 头部中除了根目录 inode 之外都是元数据
+		for blk := start; blk < start+AgHeaderBlocks; blk++ {
+			if blk != uint64(ag.Agi.Meta.Root) {
+				c.owner[blk] = fsckOwnerMeta
+			}
+		}
+		c.checkFreeSpace(agno)
+	}
+}
+
+func (c *fsckChecker) checkAgHeaders(agno uint32, ag *AgCtx) bool {
+	ok := true
+	check := func(name string, magic uint32, wantMagic uint32, seqno uint32) {
+		if magic != wantMagic {
+			c.report.problemf("AG %d: bad %s magic 0x%x", agno, name, magic)
+			ok = false
+		} else if seqno != agno {
+			c.report.problemf("AG %d: %s has seqno %d", agno, name, seqno)
+			ok = false
+		}
+	}
+	sb := ag.Superblock.Meta
+	check("superblock", sb.MagicNum, SuperBlockMagicNum, sb.SeqNo)
+	check("AGF", ag.Agf.Meta.MagicNum, AgfMagicNum, ag.Agf.Meta.SeqNo)
+	check("AGI", ag.Agi.Meta.MagicNum, AgiMagicNum, ag.Agi.Meta.SeqNo)
+	check("AGFL", ag.Agfl.Meta.MagicNum, AgflMagicNum, ag.Agfl.Meta.SeqNo)
+	if ok && sb.AgCount != c.sb.AgCount {
+		c.report.problemf("AG %d: superblock agcount %d differs from primary %d", agno, sb.AgCount, c.sb.AgCount)
+	}
+	if ok && (sb.AgBlocks < MinAgBlocks || sb.AgBlocks > c.sb.AgBlocks) {
+		c.report.problemf("AG %d: bad AG size %d", agno, sb.AgBlocks)
+		ok = false
+	}
+	return ok
+}
+
+// checkFreeSpace 检查空闲空间树的结构和其中的记录：不能越界，也不能相互重叠
+func (c *fsckChecker) checkFreeSpace(agno uint32) {
+	start, size := c.agRange(agno)
+	cntRoot := uint64(c.ags[agno].Agf.Meta.CntRoot)
+	if cntRoot < start || cntRoot >= start+AgHeaderBlocks {
+		c.report.problemf("AG %d: free space root %d outside AG header", agno, cntRoot)
+		return
+	}
+	t := NewBtreeContext[uint64, DFreeBlockBtRec](c.dev, cntRoot)
+	if err := t.Check(); err != nil {
+		c.report.problemf("AG %d: bad free space tree: %v", agno, err)
+		return
+	}
+	recs, err := t.Records()
+	if err != nil {
+		c.report.problemf("AG %d: cannot load free space tree: %v", agno, err)
+		return
+	}
+	blks, err := t.Blocks()
+	if err != nil {
+		c.report.problemf("AG %d: cannot load free space tree: %v", agno, err)
+		return
+	}
+	if btreeEnabled(c.dev) {
+		bnoBlks, ok := c.checkBnoTree(agno, recs)
+		if !ok {
+			return
+		}
+		blks = append(blks, bnoBlks...)
+	}
+	agfl := c.ags[agno].Agfl.Meta
+	if agfl.Count > AgflSize {
+		c.report.problemf("AG %d: AGFL has %d blocks, at most %d", agno, agfl.Count, AgflSize)
+	} else {
+		for _, blk := range agfl.Blocks[:agfl.Count] {
+			blks = append(blks, uint64(blk))
+		}
+	}
+	for _, blk := range blks {
+		switch {
+		case blk < start+AgHeaderBlocks || blk >= start+size:
+			c.report.problemf("AG %d: free space tree block %d outside AG data area", agno, blk)
+		case c.owner[blk] != fsckOwnerNone:
+			c.report.problemf("AG %d: free space tree block %d is used twice", agno, blk)
+		default:
+			c.owner[blk] = fsckOwnerBtree
+		}
+	}
+	sorted := make([]DFreeBlockBtRec, 0, len(recs))
+	for _, rec := range recs {
+		if rec.BlockCount == 0 {
+			continue
+		}
+		if rec.StartBlock < start+AgHeaderBlocks || rec.StartBlock+rec.BlockCount > start+size {
+			c.report.problemf("AG %d: free extent [%d, %d) outside AG data area", agno, rec.StartBlock, rec.StartBlock+rec.BlockCount)
+			continue
+		}
+		sorted = append(sorted, rec)
+	}
+	var free, longest uint64
+	for _, rec := range recs {
+		free += rec.BlockCount
+		longest = Max(longest, rec.BlockCount)
+	}
+	if agf := c.ags[agno].Agf.Meta; uint64(agf.FreeBlocks) != free || uint64(agf.Longest) != longest {
+		c.report.problemf("AG %d: AGF records %d free blocks (longest %d), free space tree has %d (longest %d)",
+			agno, agf.FreeBlocks, agf.Longest, free, longest)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].StartBlock < sorted[j].StartBlock })
+	for i, rec := range sorted {
+		if i > 0 {
+			prev := sorted[i-1]
+			if prev.StartBlock+prev.BlockCount > rec.StartBlock {
+				c.report.problemf("AG %d: free extents [%d, %d) and [%d, %d) overlap", agno,
+					prev.StartBlock, prev.StartBlock+prev.BlockCount, rec.StartBlock, rec.StartBlock+rec.BlockCount)
+			}
+		}
+		for blk := rec.StartBlock; blk < rec.StartBlock+rec.BlockCount; blk++ {
+			c.free[blk] = true
+		}
+	}
+	for _, blk := range blks {
+		if blk < c.total && c.free[blk] && c.owner[blk] == fsckOwnerBtree {
+			c.report.problemf("AG %d: free space tree block %d is also free", agno, blk)
+		}
+	}
+}
+
+// checkBnoTree 检查按起始块号排序的树，其中的区间必须与 cnt 树中的 recs 相同。
+// 返回树的节点，ok 为 false 表示树无法读取
+func (c *fsckChecker) checkBnoTree(agno uint32, recs []DFreeBlockBtRec) (blks []uint64, ok bool) {
+	start, _ := c.agRange(agno)
+	bnoRoot := uint64(c.ags[agno].Agf.Meta.BnoRoot)
+	if bnoRoot < start || bnoRoot >= start+AgHeaderBlocks {
+		c.report.problemf("AG %d: free space root %d outside AG header", agno, bnoRoot)
+		return nil, false
+	}
+	t := NewBtreeContext[uint64, DFreeBnoBtRec](c.dev, bnoRoot)
+	if err := t.Check(); err != nil {
+		c.report.problemf("AG %d: bad free space tree: %v", agno, err)
+		return nil, false
+	}
+	bnoRecs, err := t.Records()
+	if err == nil {
+		blks, err = t.Blocks()
+	}
+	if err != nil {
+		c.report.problemf("AG %d: cannot load free space tree: %v", agno, err)
+		return nil, false
+	}
+	inCnt := make(map[DFreeBlockBtRec]bool, len(recs))
+	for _, rec := range recs {
+		inCnt[rec] = true
+	}
+	for _, rec := range bnoRecs {
+		if !inCnt[DFreeBlockBtRec(rec)] {
+			c.report.problemf("AG %d: free extent [%d, %d) is missing from the by-size tree", agno, rec.StartBlock, rec.StartBlock+rec.BlockCount)
+		}
+		delete(inCnt, DFreeBlockBtRec(rec))
+	}
+	for rec := range inCnt {
+		c.report.problemf("AG %d: free extent [%d, %d) is missing from the by-block tree", agno, rec.StartBlock, rec.StartBlock+rec.BlockCount)
+	}
+	return blks, true
+}
+
+// loadInode 加载并校验 ino 处的 inode
+func (c *fsckChecker) loadInode(ino uint64) (*InoContext, error) {
+	if ino >= c.total {
+		return nil, fmt.Errorf("inode %d beyond end of device", ino)
+	}
+	ctx := NewInoContext(c.dev, ino)
+	err := ctx.LoadInode()
+	if err == ErrInvalidStructBytes {
+		return nil, fmt.Errorf("inode %d with bad magic", ino)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inode %d: %v", ino, err)
+	}
+	if ctx.coreCache.Ino != ino {
+		return nil, fmt.Errorf("inode %d claiming to be inode %d", ino, ctx.coreCache.Ino)
+	}
+	if ctx.coreCache.Format == FMT_EXTENTS {
+		if err := ctx.checkExtents(); err != nil {
+			return nil, fmt.Errorf("inode %d: bad extent list: %v", ino, err)
+		}
+	}
+	return ctx, nil
+}
+
+// claim 记录 blk 被 ino 占用，并检查重复占用
+func (c *fsckChecker) claim(ino uint64, blk uint64) {
+	if blk >= c.total {
+		c.report.problemf("inode %d references block %d beyond end of device", ino, blk)
+		return
+	}
+	if c.free[blk] {
+		c.report.problemf("block %d is both free and in use by inode %d", blk, ino)
+	}
+	switch owner := c.owner[blk]; owner {
+	case fsckOwnerNone:
+		c.owner[blk] = ino
+	case fsckOwnerMeta:
+		c.report.problemf("block %d is AG metadata but claimed by inode %d", blk, ino)
+	case fsckOwnerBtree:
+		// 修复时重建空闲空间树，让出这一块
+		c.report.problemf("block %d is a free space tree block but claimed by inode %d", blk, ino)
+		c.owner[blk] = ino
+	default:
+		if owner != ino {
+			c.report.problemf("block %d is claimed by inode %d and inode %d", blk, owner, ino)
+		}
+	}
+}
+
+// inodeBlocks 返回 inode 占用的全部块：inode 块及其数据块
+func (c *fsckChecker) inodeBlocks(ctx *InoContext) []uint64 {
+	blks := []uint64{ctx.ino}
+	for i := uint64(0); i < ctx.coreCache.NLocBlk; i++ {
+		blk, err := ctx.Bmap(i)
+		if err != nil {
+			c.report.problemf("inode %d: cannot map block %d: %v", ctx.ino, i, err)
+			break
+		}
+		blks = append(blks, blk)
+	}
+	return blks
+}
+
+func (c *fsckChecker) claimInode(ctx *InoContext) {
+	for _, blk := range c.inodeBlocks(ctx) {
+		c.claim(ctx.ino, blk)
+	}
+}
+
+// walkTree 从根目录开始遍历所有可达的 inode
+func (c *fsckChecker) walkTree() {
+	c.root = uint64(c.ags[0].Agi.Meta.Root)
+	root, err := c.loadInode(c.root)
+	if err != nil {
+		c.report.problemf("cannot load root directory: %v", err)
+		return
+	}
+	if !root.IsDir() {
+		c.report.problemf("root inode %d is not a directory", c.root)
+		return
+	}
+	// 根目录由 AGI 引用
+	c.inodes[c.root] = &fsckInode{ctx: root, refs: 1}
+	c.claimInode(root)
+	queue := []uint64{c.root}
+	for len(queue) > 0 {
+		dirIno := queue[0]
+		queue = queue[1:]
+		dir := c.inodes[dirIno].ctx
+		for _, ent := range dir.dirSfHdr.Entries {
+			name := string(ent.Name)
+			if child, ok := c.inodes[ent.Ino]; ok {
+				child.refs++
+				continue
+			}
+			child, err := c.loadInode(ent.Ino)
+			if err != nil {
+				c.report.problemf("directory %d entry %q points to %v", dirIno, name, err)
+				c.dangling = append(c.dangling, fsckEntry{parent: dirIno, name: name})
+				continue
+			}
+			c.inodes[ent.Ino] = &fsckInode{ctx: child, refs: 1}
+			c.claimInode(child)
+			if child.IsDir() {
+				queue = append(queue, ent.Ino)
+			}
+		}
+	}
+}
+
+func (c *fsckChecker) checkNlink() {
+	for ino, node := range c.inodes {
+		if node.ctx.coreCache.Nlink != node.refs {
+			c.report.problemf("inode %d has nlink %d, but %d directory entries refer to it",
+				ino, node.ctx.coreCache.Nlink, node.refs)
+		}
+	}
+}
+
+// scanOrphans 在既不空闲也未被占用的块中寻找不可达的 inode
+func (c *fsckChecker) scanOrphans() {
+	var candidates []*InoContext
+	for agno, ag := range c.ags {
+		if ag == nil {
+			continue
+		}
+		start, size := c.agRange(uint32(agno))
+		for blk := start + AgHeaderBlocks; blk < start+size; blk++ {
+			if c.free[blk] || c.owner[blk] != fsckOwnerNone {
+				continue
+			}
+			data, err := c.dev.ReadBlock(blk)
+			if err != nil || !CheckMagic(data[:2], InodeMagic) {
+				continue
+			}
+			ctx, err := c.loadInode(blk)
+			if err != nil {
+				continue
+			}
+			candidates = append(candidates, ctx)
+			// 跳过紧跟在后面的数据块
+			if ctx.coreCache.Format == FMT_LOCAL {
+				blk += ctx.coreCache.NLocBlk
+			}
+		}
+	}
+	// 孤儿目录中的子项会随目录一起被找回
+	inSubtree := make(map[uint64]bool)
+	for _, ctx := range candidates {
+		if ctx.IsDir() && ctx.coreCache.Nlink > 0 {
+			for _, ent := range ctx.dirSfHdr.Entries {
+				inSubtree[ent.Ino] = true
+			}
+		}
+	}
+	for _, ctx := range candidates {
+		if ctx.coreCache.Nlink == 0 {
+			c.report.problemf("unlinked inode %d still holds %d blocks", ctx.ino, 1+ctx.coreCache.NLocBlk)
+			c.unlinked = append(c.unlinked, ctx.ino)
+			for _, blk := range c.inodeBlocks(ctx) {
+				if blk < c.total && c.owner[blk] == fsckOwnerNone {
+					c.owner[blk] = fsckOwnerUnlinked
+				}
+			}
+			continue
+		}
+		c.claimInode(ctx)
+		if !inSubtree[ctx.ino] {
+			c.report.problemf("inode %d is not reachable from the root directory", ctx.ino)
+			c.orphans = append(c.orphans, ctx)
+		}
+	}
+}
+
+// countInodes 返回每个 AG 数据区中被占用的 inode 数
+func (c *fsckChecker) countInodes() []uint32 {
+	counts := make([]uint32, len(c.ags))
+	for agno, ag := range c.ags {
+		if ag == nil {
+			continue
+		}
+		start, size := c.agRange(uint32(agno))
+		for blk := start + AgHeaderBlocks; blk < start+size; blk++ {
+			if c.owner[blk] == blk {
+				counts[agno]++
+			}
+		}
+	}
+	return counts
+}
+
+// checkInodeCounts 检查 AGI 中的 inode 数，已删除但未回收的 inode 也计算在内
+func (c *fsckChecker) checkInodeCounts() {
+	counts := c.countInodes()
+	for _, ino := range c.unlinked {
+		counts[ino/uint64(c.sb.AgBlocks)]++
+	}
+	for agno, ag := range c.ags {
+		if ag == nil {
+			continue
+		}
+		agi := ag.Agi.Meta
+		if agi.Count != counts[agno] {
+			c.report.problemf("AG %d: AGI records %d inodes, found %d", agno, agi.Count, counts[agno])
+		}
+		if agi.FreeCount != 0 {
+			c.report.problemf("AG %d: AGI records %d free inodes, should be 0", agno, agi.FreeCount)
+		}
+	}
+}
+
+// checkLeaks 检查既不空闲也未被使用的块
+func (c *fsckChecker) checkLeaks() {
+	for agno, ag := range c.ags {
+		if ag == nil {
+			continue
+		}
+		start, size := c.agRange(uint32(agno))
+		leaked := 0
+		for blk := start + AgHeaderBlocks; blk < start+size; blk++ {
+			if !c.free[blk] && c.owner[blk] == fsckOwnerNone {
+				leaked++
+			}
+		}
+		if leaked > 0 {
+			c.report.problemf("AG %d: %d blocks are neither free nor in use", agno, leaked)
+		}
+	}
+}
+
+func (c *fsckChecker) summarize() {
+	r := c.report
+	r.Inodes = len(c.inodes)
+	for _, node := range c.inodes {
+		if node.ctx.IsDir() {
+			r.Dirs++
+		}
+	}
+	r.UsedBlocks, r.FreeBlocks = 0, 0
+	for blk := range c.owner {
+		if c.free[blk] {
+			r.FreeBlocks++
+		}
+		if c.owner[blk] != fsckOwnerNone && c.owner[blk] != fsckOwnerUnlinked {
+			r.UsedBlocks++
+		}
+	}
+}
+
+// repair 修复检查中发现的问题
+//  1. 删除指向无效 inode 的目录项
+//  2. 修正可达 inode 的 nlink
+//  3. 把孤儿 inode 放到 lost+found
+//  4. 根据实际占用情况重建空闲空间树
+func (c *fsckChecker) repair() error {
+	if c.backup != 0 {
+		if err := writePrimarySuperblock(c.dev, c.sb); err != nil {
+			return err
+		}
+		c.report.repairf("rewrote the primary superblock from the backup in AG %d", c.backup)
+	}
+	for _, ent := range c.dangling {
+		parent := c.inodes[ent.parent].ctx
+		if err := parent.RemoveEntry(ent.name); err != nil {
+			return err
+		}
+		if err := parent.SyncInode(); err != nil {
+			return err
+		}
+		c.report.repairf("removed entry %q from directory %d", ent.name, ent.parent)
+	}
+	for ino, node := range c.inodes {
+		inode := node.ctx.coreCache
+		if inode.Nlink == node.refs {
+			continue
+		}
+		c.report.repairf("set nlink of inode %d from %d to %d", ino, inode.Nlink, node.refs)
+		inode.Nlink = node.refs
+		if err := node.ctx.SyncInode(); err != nil {
+			return err
+		}
+	}
+	if len(c.orphans) > 0 {
+		if err := c.reconnectOrphans(); err != nil {
+			return err
+		}
+	}
+	// 未回收的 inode 随空闲空间树的重建一起回收
+	counts := c.countInodes()
+	for agno, ag := range c.ags {
+		if ag == nil {
+			continue
+		}
+		if err := c.rebuildFreeSpace(uint32(agno)); err != nil {
+			return err
+		}
+		agi := ag.Agi.Meta
+		if agi.Count != counts[agno] || agi.FreeCount != 0 {
+			agi.Count, agi.FreeCount = counts[agno], 0
+			if err := ag.Agi.Sync(); err != nil {
+				return err
+			}
+			c.report.repairf("AG %d: set inode count to %d", agno, counts[agno])
+		}
+	}
+	return nil
+}
+
+func (c *fsckChecker) reconnectOrphans() error {
+	root := c.inodes[c.root].ctx
+	var lostFound *InoContext
+	if ino, err := root.GetEntry(LostFoundName); err == nil {
+		if node, ok := c.inodes[ino]; ok && node.ctx.IsDir() {
+			lostFound = node.ctx
+		}
+	}
+	if lostFound == nil {
+		// 在 AG 0 中找一个未被占用的块作为 lost+found，重建空闲空间树时会跳过它
+		start, size := c.agRange(0)
+		blk := start + AgHeaderBlocks
+		for ; blk < start+size; blk++ {
+			if c.owner[blk] == fsckOwnerNone || c.owner[blk] == fsckOwnerUnlinked {
+				break
+			}
+		}
+		if blk == start+size {
+			return ErrNoSpace
+		}
+		c.owner[blk] = blk
+		lostFound = NewInoContext(c.dev, blk)
+		if err := lostFound.InitInode(S_IFDIR | 0700); err != nil {
+			return err
+		}
+		if err := lostFound.SetParent(c.root); err != nil {
+			return err
+		}
+		if err := root.AddEntry(LostFoundName, blk); err != nil {
+			return err
+		}
+		if err := root.SyncInode(); err != nil {
+			return err
+		}
+		c.report.repairf("created /%s at inode %d", LostFoundName, blk)
+	}
+	for _, orphan := range c.orphans {
+		name := fmt.Sprintf("#%d", orphan.ino)
+		if err := lostFound.AddEntry(name, orphan.ino); err != nil {
+			return err
+		}
+		orphan.coreCache.Nlink = 1
+		if orphan.IsDir() {
+			orphan.dirSfHdr.Parent = lostFound.ino
+		}
+		if err := orphan.SyncInode(); err != nil {
+			return err
+		}
+		c.report.repairf("moved inode %d to /%s/%s", orphan.ino, LostFoundName, name)
+	}
+	return lostFound.SyncInode()
+}
+
+// rebuildFreeSpace 把 AG 数据区中所有未被占用的连续块重新写入空闲空间树
+func (c *fsckChecker) rebuildFreeSpace(agno uint32) error {
+	start, size := c.agRange(agno)
+	var recs []DFreeBlockBtRec
+	for blk := start + AgHeaderBlocks; blk < start+size; blk++ {
+		// 树的节点重新分配
+		if o := c.owner[blk]; o != fsckOwnerNone && o != fsckOwnerUnlinked && o != fsckOwnerBtree {
+			continue
+		}
+		if n := len(recs); n > 0 && recs[n-1].StartBlock+recs[n-1].BlockCount == blk {
+			recs[n-1].BlockCount++
+		} else {
+			recs = append(recs, DFreeBlockBtRec{BlockCount: 1, StartBlock: blk})
+		}
+	}
+	ag := c.ags[agno]
+	btCtx := NewBtreeContext[uint64, DFreeBlockBtRec](c.dev, uint64(ag.Agf.Meta.CntRoot))
+	if !btreeEnabled(c.dev) {
+		if len(recs) > BtreeBlockCapacity[DFreeBlockBtRec](c.dev.GetBlockSize()) {
+			return fmt.Errorf("AG %d: %d free extents do not fit in the free space tree", agno, len(recs))
+		}
+		if err := btCtx.InitBlock(); err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if err := btCtx.Set(rec); err != nil {
+				return err
+			}
+		}
+		if err := c.syncFreeCounts(ag, recs); err != nil {
+			return err
+		}
+		c.report.repairf("AG %d: rebuilt free space tree with %d extents", agno, len(recs))
+		return nil
+	}
+	// 从最大的区间开头逐块切出两棵树的节点。切完一个区间时剩下的区间变少，所需的节点也可能变少，
+	// 所以每切一块都按剩下的区间数重新计算，够用就停，多出来的节点很少，放进 AGFL
+	bnoCtx := NewBtreeContext[uint64, DFreeBnoBtRec](c.dev, uint64(ag.Agf.Meta.BnoRoot))
+	need := func(n int) int { return btCtx.BlocksNeeded(n) + bnoCtx.BlocksNeeded(n) }
+	bySize := make([]*DFreeBlockBtRec, len(recs))
+	for i := range recs {
+		bySize[i] = &recs[i]
+	}
+	sort.Slice(bySize, func(i, j int) bool { return bySize[i].BlockCount > bySize[j].BlockCount })
+	var nodes []uint64
+	left := len(recs)
+	for _, rec := range bySize {
+		for rec.BlockCount > 0 && len(nodes) < need(left) {
+			nodes = append(nodes, rec.StartBlock)
+			rec.StartBlock++
+			rec.BlockCount--
+			if rec.BlockCount == 0 {
+				left--
+			}
+		}
+	}
+	if len(nodes) < need(left) {
+		return fmt.Errorf("AG %d: no space for the free space tree", agno)
+	}
+	if len(nodes)-need(left) > AgflSize {
+		return fmt.Errorf("AG %d: %d spare free space tree nodes do not fit in the AGFL", agno, len(nodes)-need(left))
+	}
+	kept := recs[:0]
+	for _, rec := range recs {
+		if rec.BlockCount > 0 {
+			kept = append(kept, rec)
+		}
+	}
+	used := btCtx.BlocksNeeded(len(kept))
+	if err := btCtx.Build(kept, nodes[:used]); err != nil {
+		return err
+	}
+	bnoRecs := make([]DFreeBnoBtRec, len(kept))
+	for i, rec := range kept {
+		bnoRecs[i] = DFreeBnoBtRec(rec)
+	}
+	bnoUsed := bnoCtx.BlocksNeeded(len(kept))
+	if err := bnoCtx.Build(bnoRecs, nodes[used:used+bnoUsed]); err != nil {
+		return err
+	}
+	used += bnoUsed
+	// 用不完的节点放进 AGFL
+	agfl := ag.Agfl.Meta
+	agfl.Count = 0
+	agfl.Blocks = [AgflSize]uint32{}
+	for _, blk := range nodes[used:] {
+		agfl.Blocks[agfl.Count] = uint32(blk)
+		agfl.Count++
+	}
+	if err := ag.Agfl.Sync(); err != nil {
+		return err
+	}
+	if err := c.syncFreeCounts(ag, kept); err != nil {
+		return err
+	}
+	c.report.repairf("AG %d: rebuilt free space tree with %d extents", agno, len(kept))
+	return nil
+}
+
+// syncFreeCounts 根据重建后的空闲区间更新 AGF 中的计数
+func (c *fsckChecker) syncFreeCounts(ag *AgCtx, recs []DFreeBlockBtRec) error {
+	agf := ag.Agf.Meta
+	agf.FreeBlocks, agf.Longest = 0, 0
+	for _, rec := range recs {
+		agf.FreeBlocks += uint32(rec.BlockCount)
+		agf.Longest = uint32(Max(uint64(agf.Longest), rec.BlockCount))
+	}
+	return ag.Agf.Sync()
+}
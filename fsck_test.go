@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestFsck(t *testing.T) {
+	// 10MB
+	blockcount := uint64(10 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Fatalf("fresh filesystem is not clean: %v", report.Problems)
+	}
+
+	// 通过 FUSE 接口创建一个文件和一个目录
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var createOut fuse.CreateOut
+	code := fs.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: RootIno}, Mode: S_IFREG | 0644}, "file", &createOut)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	var mkdirOut fuse.EntryOut
+	code = fs.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: RootIno}, Mode: 0755}, "dir", &mkdirOut)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	report, err = Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() || report.Inodes != 3 || report.Dirs != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// 制造三个问题：错误的 nlink、孤儿目录、悬空的目录项
+	file, err := fs.getInode(createOut.NodeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.coreCache.Nlink = 3
+	if err = file.SyncInode(); err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.getInode(RootIno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = root.RemoveEntry("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err = root.AddEntry("dangling", uint64(blockcount-1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = root.SyncInode(); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 3 {
+		t.Fatalf("expected 3 problems, got %v", report.Problems)
+	}
+
+	report, err = Fsck(dev, FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Repairs) == 0 {
+		t.Fatal("nothing repaired")
+	}
+	report, err = Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Fatalf("not clean after repair: %v", report.Problems)
+	}
+	lostFound, err := fs.lookupPath("/" + LostFoundName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lostFound.GetEntry(fmt.Sprintf("#%d", mkdirOut.NodeId)); err != nil {
+		t.Errorf("orphaned directory not in %s: %v", LostFoundName, err)
+	}
+}
+
+func TestRebuildFragmentedFreeSpace(t *testing.T) {
+	// 一个 16MB 的 AG，数据区每隔一块被占用，空闲区间都只有一块。
+	// 切出树的节点时会用完很多区间，所需的节点随之减少
+	blockcount := uint64(16 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{AgCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	sb, _, err := loadSuperblockOrBackup(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fdev := withFeatures(dev, sb)
+	c := &fsckChecker{
+		dev:    fdev,
+		sb:     sb,
+		report: &FsckReport{},
+		total:  blockcount,
+		ags:    make([]*AgCtx, 1),
+		free:   make([]bool, blockcount),
+		owner:  make([]uint64, blockcount),
+		inodes: make(map[uint64]*fsckInode),
+	}
+	c.checkAgs()
+	if c.ags[0] == nil {
+		t.Fatal(c.report.Problems)
+	}
+	unowned := 0
+	for blk := uint64(AgHeaderBlocks); blk < blockcount; blk++ {
+		if blk%2 == 0 {
+			c.owner[blk] = blk
+		} else {
+			c.owner[blk] = fsckOwnerNone
+			unowned++
+		}
+	}
+	if err = c.rebuildFreeSpace(0); err != nil {
+		t.Fatal(err)
+	}
+
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag := mp.AgCtx[0]
+	recs, err := newAgFreeSpace(ag).cntTree().Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var free uint64
+	for _, rec := range recs {
+		if rec.BlockCount != 1 || c.owner[rec.StartBlock] != fsckOwnerNone {
+			t.Fatalf("bad free extent %+v", rec)
+		}
+		free += rec.BlockCount
+	}
+	if free != uint64(ag.Agf.Meta.FreeBlocks) {
+		t.Errorf("AGF records %d free blocks, tree has %d", ag.Agf.Meta.FreeBlocks, free)
+	}
+	// 未被占用的块要么空闲，要么在 AGFL 中，要么是两棵树的节点
+	cnt := NewBtreeContext[uint64, DFreeBlockBtRec](fdev, uint64(ag.Agf.Meta.CntRoot))
+	bno := NewBtreeContext[uint64, DFreeBnoBtRec](fdev, uint64(ag.Agf.Meta.BnoRoot))
+	nodes := cnt.BlocksNeeded(len(recs)) + bno.BlocksNeeded(len(recs))
+	if got := int(free) + int(ag.Agfl.Meta.Count) + nodes; got != unowned {
+		t.Errorf("%d free, %d in AGFL, %d tree nodes, %d blocks unowned", free, ag.Agfl.Meta.Count, nodes, unowned)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// 文件系统的身份信息：UUID、卷标和各种时间，保存在每个 AG 的超级块中。
+// UUID、卷标和创建时间在所有 AG 中相同；挂载时间、挂载次数和写入时间只在主超级块中维护
+
+// SbLabelLen 是卷标的最大字节数
+const SbLabelLen = 32
+
+// UUIDXAttr 是挂载点根目录上只读的扩展属性，值为文件系统的 UUID。
+// FUSE 的 statfs 没有 fsid 字段（内核按设备号生成 f_fsid），所以 UUID 通过它提供给用户态
+const UUIDXAttr = "user.poundfs.uuid"
+
+// NewUUID 生成一个随机（第 4 版）UUID
+func NewUUID() [16]byte {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err)
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return u
+}
+
+// FormatUUID 按 8-4-4-4-12 的形式格式化 UUID
+func FormatUUID(u [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// UUIDString 返回文件系统的 UUID，旧镜像没有 UUID 时返回空串
+func (sb *Superblock) UUIDString() string {
+	if sb.UUID == ([16]byte{}) {
+		return ""
+	}
+	return FormatUUID(sb.UUID)
+}
+
+// LabelString 返回卷标，去掉末尾填充的 0
+func (sb *Superblock) LabelString() string {
+	return string(bytes.TrimRight(sb.Label[:], "\x00"))
+}
+
+// SetLabel 设置卷标，超过 SbLabelLen 字节时返回 ErrInvalidArgument
+func (sb *Superblock) SetLabel(label string) error {
+	if len(label) > SbLabelLen {
+		return ErrInvalidArgument
+	}
+	sb.Label = [SbLabelLen]byte{}
+	copy(sb.Label[:], label)
+	return nil
+}
+
+// formatNsec 格式化超级块中的纳秒时间，0 表示从未发生
+func formatNsec(ts uint64) string {
+	if ts == 0 {
+		return "never"
+	}
+	return time.Unix(0, int64(ts)).Format(time.RFC3339)
+}
+
+// SetFsLabel 修改所有 AG 超级块中的卷标，主超级块最后写
+func SetFsLabel(dev BlockDevice, label string) error {
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		return err
+	}
+	if err := checkWritable(mp.sb); err != nil {
+		return err
+	}
+	if err := mp.sb.SetLabel(label); err != nil {
+		return err
+	}
+	for agno := len(mp.AgCtx) - 1; agno > 0; agno-- {
+		agsb := mp.AgCtx[agno].Superblock
+		agsb.Meta.Label = mp.sb.Label
+		if err := agsb.Sync(); err != nil {
+			return err
+		}
+	}
+	return mp.SyncSuperblock()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestFsInfo(t *testing.T) {
+	blockcount := uint64(4 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{AgCount: 4, Label: strings.Repeat("x", SbLabelLen+1)}); err != ErrInvalidArgument {
+		t.Errorf("long label: err is %v not %v", err, ErrInvalidArgument)
+	}
+	geo, err := Makefs(dev, MkfsOptions{AgCount: 4, Label: "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// UUID、卷标和创建时间在所有 AG 中相同
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.sb.UUID != geo.UUID || mp.sb.UUIDString() == "" {
+		t.Fatalf("uuid is %q, mkfs reported %s", mp.sb.UUIDString(), FormatUUID(geo.UUID))
+	}
+	for _, ag := range mp.AgCtx {
+		sb := ag.Superblock.Meta
+		if sb.UUID != mp.sb.UUID || sb.LabelString() != "data" || sb.Ctime != mp.sb.Ctime {
+			t.Errorf("AG %d: uuid %s label %q ctime %d", sb.SeqNo, sb.UUIDString(), sb.LabelString(), sb.Ctime)
+		}
+	}
+	if mp.sb.MountCount != 0 || mp.sb.MountTime != 0 {
+		t.Errorf("fresh image: mount count %d, mount time %d", mp.sb.MountCount, mp.sb.MountTime)
+	}
+
+	// 读写挂载更新挂载次数，只读挂载不更新
+	for i := 0; i < 2; i++ {
+		fs, err := NewPoundFS(dev, MountOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs, err := NewPoundFS(dev, MountOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb := fs.mp.sb; sb.MountCount != 2 || sb.MountTime == 0 || sb.WriteTime < sb.MountTime {
+		t.Errorf("mount count %d, mount time %d, write time %d", sb.MountCount, sb.MountTime, sb.WriteTime)
+	}
+
+	// 根目录的 UUIDXAttr 返回 UUID
+	buf := make([]byte, 64)
+	n, code := fs.GetXAttr(nil, &fuse.InHeader{NodeId: RootIno}, UUIDXAttr, buf)
+	if code != fuse.OK || string(buf[:n]) != mp.sb.UUIDString() {
+		t.Errorf("GetXAttr returned %v %q", code, buf[:n])
+	}
+	if n, code = fs.GetXAttr(nil, &fuse.InHeader{NodeId: RootIno}, UUIDXAttr, nil); code != fuse.ERANGE || n != 36 {
+		t.Errorf("GetXAttr size query returned %v %d", code, n)
+	}
+
+	// 修改卷标
+	if err = SetFsLabel(dev, "backup"); err != nil {
+		t.Fatal(err)
+	}
+	if mp, err = NewMountPoint(dev); err != nil {
+		t.Fatal(err)
+	}
+	for _, ag := range mp.AgCtx {
+		if got := ag.Superblock.Meta.LabelString(); got != "backup" {
+			t.Errorf("AG %d: label is %q", ag.Superblock.Meta.SeqNo, got)
+		}
+	}
+	if err = SetFsLabel(dev, strings.Repeat("x", SbLabelLen+1)); err != ErrInvalidArgument {
+		t.Errorf("long label: err is %v not %v", err, ErrInvalidArgument)
+	}
+	var out bytes.Buffer
+	if err = printInfo(&out, mp); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"uuid:        " + mp.sb.UUIDString(), "label:       backup", "mount count: 2"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("info output lacks %q:\n%s", want, out.String())
+		}
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report)
+	}
+}
+
+func TestDirtyState(t *testing.T) {
+	blockcount := uint64(1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCachedBlockDevice(dev, 64*1024)
+	fs, err := NewPoundFS(cache, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 挂载期间磁盘上是 dirty
+	sb, err := loadSuperblock(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.State != SbStateDirty {
+		t.Errorf("state on disk is %d while mounted", sb.State)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.mkdir(root, "dir", 0755, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	crashed := dev.Snapshot()
+
+	// 正常卸载：缓存写回后标记为 clean，可以再次读写挂载
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sb, _ = loadSuperblock(dev); sb.State != SbStateClean {
+		t.Errorf("state is %d after a clean unmount", sb.State)
+	}
+	if fs, err = NewPoundFS(dev, MountOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.lookupPath("/dir"); err != nil {
+		t.Errorf("lookup after remount: %v", err)
+	}
+
+	// 没有正常卸载：拒绝读写挂载，只读挂载和 -force 可以
+	dev.Restore(crashed)
+	if _, err = NewPoundFS(dev, MountOptions{}); err != ErrDirty {
+		t.Errorf("dirty mount: err is %v not %v", err, ErrDirty)
+	}
+	if _, err = NewPoundFS(dev, MountOptions{ReadOnly: true}); err != nil {
+		t.Errorf("read-only mount: %v", err)
+	}
+	if _, err = NewPoundFS(dev, MountOptions{Force: true}); err != nil {
+		t.Errorf("forced mount: %v", err)
+	}
+
+	// fsck 报告 dirty，修复后标记为 clean
+	dev.Restore(crashed)
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Dirty {
+		t.Errorf("fsck: err %v, dirty %v", err, report.Dirty)
+	}
+	if _, err = Fsck(dev, FsckOptions{Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err = NewPoundFS(dev, MountOptions{}); err != nil {
+		t.Errorf("mount after fsck -repair: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sirupsen/logrus"
+)
+
+// 扩容：先把不满的最后一个 AG 扩展到完整大小，再在末尾追加新的 AG。
+// 主超级块的 AgBlocks 是 AG 的跨度，扩容不会改变它
+
+// GrowfsXAttr 是在挂载点上触发在线扩容的扩展属性，值为新的大小（字节数）
+const GrowfsXAttr = "user.poundfs.growfs"
+
+// GrowResult 描述一次扩容前后的布局
+type GrowResult struct {
+	OldBlocks  uint32
+	NewBlocks  uint32
+	OldAgCount uint32
+	NewAgCount uint32
+	AgBlocks   uint32
+}
+
+// FsTotalBlocks 返回文件系统的总块数。
+// 除最后一个 AG 外都是 sb.AgBlocks 块，最后一个 AG 的真实大小记录在它自己的超级块中
+func FsTotalBlocks(dev BlockDevice, sb *Superblock) (uint32, error) {
+	last := NewAgMetaCtx[Superblock](dev, sb.AgCount-1, sb.AgBlocks)
+	if err := last.Load(); err != nil {
+		return 0, err
+	}
+	if last.Meta.MagicNum != SuperBlockMagicNum {
+		return 0, ErrInvalidStructBytes
+	}
+	return sb.AgBlocks*(sb.AgCount-1) + last.Meta.AgBlocks, nil
+}
+
+// growLayout 计算扩容到 newBlocks 后最后一个旧 AG 的大小和新的 AG 数量。
+// 末尾不足 MinAgBlocks 的部分不会被使用
+func growLayout(sb *Superblock, newBlocks uint32) (lastSize uint32, agcount uint32, total uint32) {
+	stride := uint64(sb.AgBlocks)
+	lastStart := stride * uint64(sb.AgCount-1)
+	rest := uint64(newBlocks) - lastStart
+	if rest <= stride {
+		return uint32(rest), sb.AgCount, newBlocks
+	}
+	agcount = sb.AgCount
+	end := lastStart + stride
+	for uint64(newBlocks)-end >= MinAgBlocks {
+		agcount++
+		end += Min(stride, uint64(newBlocks)-end)
+	}
+	return uint32(stride), agcount, uint32(end)
+}
+
+// Growfs 把文件系统扩展到 newBlocks 块，设备不够大时先扩展设备。
+// 新的 AG 和最后一个 AG 的空闲空间都写好之后才更新各个超级块的 AgCount，主超级块最后写
+func Growfs(dev ResizableBlockDevice, newBlocks uint32) (*GrowResult, error) {
+	sb, err := loadSuperblock(dev)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWritable(sb); err != nil {
+		return nil, err
+	}
+	dev = withFeatures(dev, sb).(ResizableBlockDevice)
+	oldBlocks, err := FsTotalBlocks(dev, sb)
+	if err != nil {
+		return nil, err
+	}
+	if newBlocks <= oldBlocks {
+		return nil, ErrOutOfRange
+	}
+	stride := sb.AgBlocks
+	oldCount := sb.AgCount
+	lastSize, agcount, total := growLayout(sb, newBlocks)
+	if total <= oldBlocks {
+		// 增加的部分不够一个最小的 AG
+		return nil, ErrAgToSmall
+	}
+	if dev.GetTotalBlockCount() < total {
+		if err := dev.Resize(uint64(total)); err != nil {
+			return nil, err
+		}
+	}
+
+	// 1. 扩展最后一个 AG，多出的部分作为一个新的空闲区间
+	lastAg := NewAgCtx(dev, oldCount-1, stride)
+	if err := lastAg.Load(); err != nil {
+		return nil, err
+	}
+	oldLastSize := lastAg.Superblock.Meta.AgBlocks
+	if lastSize > oldLastSize {
+		lastStart := uint64(stride) * uint64(oldCount-1)
+		err := newAgFreeSpace(lastAg).addExtent(lastStart+uint64(oldLastSize), uint64(lastSize-oldLastSize))
+		if err != nil {
+			return nil, err
+		}
+		lastAg.Superblock.Meta.AgBlocks = lastSize
+		if err := lastAg.Superblock.Sync(); err != nil {
+			return nil, err
+		}
+		logrus.Infof("growfs: AG %d grown from %d to %d blocks", oldCount-1, oldLastSize, lastSize)
+	}
+
+	// 2. 追加新的 AG
+	for agno := oldCount; agno < agcount; agno++ {
+		start := agno * stride
+		size := stride
+		if agno == agcount-1 {
+			size = total - start
+		}
+		split := defaultFreeSplit(sb.Features())
+		if split > size-AgHeaderBlocks {
+			split = size - AgHeaderBlocks
+		}
+		if err := MakeAg(dev, agno, start, size, agcount, split, sb); err != nil {
+			return nil, err
+		}
+		logrus.Infof("growfs: AG %d added at block %d, %d blocks", agno, start, size)
+	}
+
+	// 3. 更新旧 AG 超级块中的 AgCount，主超级块最后写
+	if agcount > oldCount {
+		for agno := int(oldCount) - 1; agno >= 0; agno-- {
+			agsb := NewAgMetaCtx[Superblock](dev, uint32(agno), stride)
+			if err := agsb.Load(); err != nil {
+				return nil, err
+			}
+			agsb.Meta.AgCount = agcount
+			if err := agsb.Sync(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &GrowResult{
+		OldBlocks:  oldBlocks,
+		NewBlocks:  total,
+		OldAgCount: oldCount,
+		NewAgCount: agcount,
+		AgBlocks:   stride,
+	}, nil
+}
+
+// growfs 在线扩容。扩容期间独占挂载点的 AG 列表，完成后重新加载各个 AG 并追加新的 AG，
+// 已有的 AgCtx 和其中的锁保持不变
+func (fs *PoundFS) growfs(newBlocks uint32) (*GrowResult, error) {
+	dev, ok := fs.dev.(ResizableBlockDevice)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	mp := fs.mp
+	mp.agsMu.Lock()
+	defer mp.agsMu.Unlock()
+	res, err := Growfs(dev, newBlocks)
+	if err != nil {
+		return nil, err
+	}
+	for _, ag := range mp.AgCtx {
+		if err := ag.Load(); err != nil {
+			return nil, err
+		}
+	}
+	for agno := res.OldAgCount; agno < res.NewAgCount; agno++ {
+		ag := NewAgCtx(mp.dev, agno, res.AgBlocks)
+		if err := ag.Load(); err != nil {
+			return nil, err
+		}
+		mp.AgCtx = append(mp.AgCtx, ag)
+	}
+	mp.sb.AgCount = res.NewAgCount
+	return res, nil
+}
+
+// setGrowfsXAttr 处理挂载点上的 GrowfsXAttr，用于 poundfs growfs MOUNTPOINT
+func (fs *PoundFS) setGrowfsXAttr(data []byte) fuse.Status {
+	size, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return fuse.EINVAL
+	}
+	newBlocks := size / uint64(fs.dev.GetBlockSize())
+	if newBlocks > uint64(^uint32(0)) {
+		return fuse.EINVAL
+	}
+	res, err := fs.growfs(uint32(newBlocks))
+	if err != nil {
+		logrus.Errorf("growfs failed: %v", err)
+		return toFuseStatus(err)
+	}
+	logrus.Infof("growfs: %d => %d blocks, %d => %d AGs", res.OldBlocks, res.NewBlocks, res.OldAgCount, res.NewAgCount)
+	return fuse.OK
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestGrowfs(t *testing.T) {
+	// 2003 块，4 个 AG：501, 501, 501, 500
+	dev, err := NewMemBlockDevice(2003, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo, err := Makefs(dev, MkfsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo.AgBlocksLast != 500 {
+		t.Fatalf("bad geometry %+v", geo)
+	}
+	if _, err = Growfs(dev, 2003); err != ErrOutOfRange {
+		t.Errorf("err is %v not %v", err, ErrOutOfRange)
+	}
+
+	// 只扩展最后一个 AG，剩下的 3 块不够一个 AG
+	res, err := Growfs(dev, 2007)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.NewBlocks != 2004 || res.NewAgCount != 4 {
+		t.Errorf("bad result %+v", res)
+	}
+	if _, err = Growfs(dev, 2010); err != ErrAgToSmall {
+		t.Errorf("err is %v not %v", err, ErrAgToSmall)
+	}
+
+	// 在线扩容：追加 2 个 AG
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := fs.SetXAttr(nil, &fuse.SetXAttrIn{InHeader: fuse.InHeader{NodeId: RootIno}}, GrowfsXAttr, []byte("1536000"))
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(fs.mp.AgCtx) != 6 || dev.GetTotalBlockCount() != 3000 {
+		t.Errorf("agcount %d, device %d blocks", len(fs.mp.AgCtx), dev.GetTotalBlockCount())
+	}
+	total, err := FsTotalBlocks(dev, fs.mp.sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3000 {
+		t.Errorf("total is %d not 3000", total)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Errorf("fsck: %v", report.Problems)
+	}
+	// 新的 AG 可以分配
+	for agno := uint32(0); agno < 6; agno++ {
+		if _, err := fs.mp.AllocBlock(agno, 1); err != nil {
+			t.Errorf("AG %d: %v", agno, err)
+		}
+	}
+}
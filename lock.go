@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// 挂载后 go-fuse 在多个 goroutine 中并发处理请求，使用以下几种锁，按获取的先后排列：
+//  1. inode 锁（PoundFS.ilocks）：保护 inode 块和短格式目录。同时锁多个 inode 时一律按 inode 号从小到大，
+//     需要先读目录才知道子项的 inode 号时，先不加锁读出，加锁后再确认目录项没有变化，见 lockEntry
+//  2. AG 锁（AgCtx.mu）：保护 AGF、AGI、AGFL 和空闲空间树。同一时间最多持有一个，
+//     持有 AG 锁时不再获取 inode 锁，所以不同 AG 中的分配可以并行
+//  3. 打开文件表、块缓存和块设备内部的锁，持有时不再获取其他锁
+// inode 的内容在加锁之后才能信任，加锁前加载的 InoContext 要重新加载
+
+// inodeLockTable 按 inode 号分配互斥锁，没有人使用的锁会被删除
+type inodeLockTable struct {
+	mu    sync.Mutex
+	locks map[uint64]*inodeLock
+}
+
+type inodeLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newInodeLockTable() *inodeLockTable {
+	return &inodeLockTable{locks: make(map[uint64]*inodeLock)}
+}
+
+// lock 按 inode 号从小到大锁住 inos，重复的只锁一次，返回解锁函数
+func (t *inodeLockTable) lock(inos ...uint64) (unlock func()) {
+	sorted := append([]uint64{}, inos...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var held []uint64
+	for i, ino := range sorted {
+		if i > 0 && ino == sorted[i-1] {
+			continue
+		}
+		t.mu.Lock()
+		l, ok := t.locks[ino]
+		if !ok {
+			l = &inodeLock{}
+			t.locks[ino] = l
+		}
+		l.refs++
+		t.mu.Unlock()
+		l.Lock()
+		held = append(held, ino)
+	}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for _, ino := range held {
+			l := t.locks[ino]
+			l.Unlock()
+			if l.refs--; l.refs == 0 {
+				delete(t.locks, ino)
+			}
+		}
+	}
+}
+
+// lockInodes 锁住 ctxs 并重新加载它们
+func (fs *PoundFS) lockInodes(ctxs ...*InoContext) (unlock func(), err error) {
+	inos := make([]uint64, len(ctxs))
+	for i, ctx := range ctxs {
+		inos[i] = ctx.ino
+	}
+	unlock = fs.ilocks.lock(inos...)
+	for _, ctx := range ctxs {
+		if err := ctx.LoadInode(); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+// lockInode 加载并锁住 ino，ino 为 RootIno 时锁住根目录
+func (fs *PoundFS) lockInode(ino uint64) (ctx *InoContext, unlock func(), err error) {
+	ctx, err = fs.getInode(ino)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock, err = fs.lockInodes(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctx, unlock, nil
+}
+
+// lockEntry 锁住目录 parent 和其中名为 name 的目录项指向的 inode，
+// 重新加载后返回目录项指向的 inode。目录项在加锁前后发生变化时重试
+func (fs *PoundFS) lockEntry(parent *InoContext, name string) (child *InoContext, unlock func(), err error) {
+	for {
+		if err := parent.LoadInode(); err != nil {
+			return nil, nil, err
+		}
+		ino, err := parent.GetEntry(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		child = NewInoContext(fs.dev, ino)
+		unlock, err = fs.lockInodes(parent, child)
+		if err != nil {
+			// 子项可能在加锁前被删除并回收，目录项变化时重试
+			if lerr := parent.LoadInode(); lerr != nil {
+				return nil, nil, lerr
+			}
+			if cur, gerr := parent.GetEntry(name); gerr == nil && cur == ino {
+				return nil, nil, err
+			}
+			continue
+		}
+		if cur, err := parent.GetEntry(name); err != nil || cur != ino {
+			unlock()
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		return child, unlock, nil
+	}
+}
+
+// lockRename 锁住 rename 涉及的两个目录、oldName 指向的 src 和 newName 指向的 dst，newName 不存在时 dst 为 nil。
+// 两个目录是同一个时必须传入同一个对象。与 lockEntry 一样，目录项在加锁前后发生变化时重试
+func (fs *PoundFS) lockRename(oldDir *InoContext, oldName string, newDir *InoContext, newName string) (src, dst *InoContext, unlock func(), err error) {
+	dirs := []*InoContext{oldDir}
+	if newDir != oldDir {
+		dirs = append(dirs, newDir)
+	}
+	// entries 重新加载两个目录，返回两个目录项指向的 inode，newName 不存在时为 0
+	entries := func() (srcIno, dstIno uint64, err error) {
+		for _, dir := range dirs {
+			if err = dir.LoadInode(); err != nil {
+				return 0, 0, err
+			}
+		}
+		if srcIno, err = oldDir.GetEntry(oldName); err != nil {
+			return 0, 0, err
+		}
+		if dstIno, err = newDir.GetEntry(newName); err == ErrNoEntry {
+			return srcIno, 0, nil
+		}
+		return srcIno, dstIno, err
+	}
+	for {
+		srcIno, dstIno, err := entries()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		src, dst = NewInoContext(fs.dev, srcIno), nil
+		ctxs := append([]*InoContext{src}, dirs...)
+		if dstIno != 0 {
+			dst = NewInoContext(fs.dev, dstIno)
+			ctxs = append(ctxs, dst)
+		}
+		unlock, err = fs.lockInodes(ctxs...)
+		if err != nil {
+			// 加锁前被删除并回收时目录项会变化，重试
+			if cur, curDst, lerr := entries(); lerr != nil || (cur == srcIno && curDst == dstIno) {
+				if lerr != nil {
+					return nil, nil, nil, lerr
+				}
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		if cur, curDst, err := entries(); err != nil || cur != srcIno || curDst != dstIno {
+			unlock()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		return src, dst, unlock, nil
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestInodeLockTable(t *testing.T) {
+	tbl := newInodeLockTable()
+	// 重复的 inode 只锁一次，不会死锁
+	unlock := tbl.lock(3, 1, 3)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tbl.lock(1)()
+	}()
+	select {
+	case <-done:
+		t.Fatal("inode 1 locked twice")
+	default:
+	}
+	unlock()
+	<-done
+	if len(tbl.locks) != 0 {
+		t.Errorf("%d locks left in the table", len(tbl.locks))
+	}
+}
+
+func TestConcurrentAlloc(t *testing.T) {
+	// 10MB
+	blockcount := uint64(10 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const nworker = 8
+	dirs := make([]*InoContext, nworker)
+	for i := range dirs {
+		if dirs[i], err = fs.mkdir(root, fmt.Sprintf("d%d", i), 0755, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 每个目录由两个 goroutine 同时创建和删除文件，同时还有直接在 AG 0 中分配和释放的
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*nworker)
+	for i := 0; i < 2*nworker; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dir := NewInoContext(fs.dev, dirs[i/2].ino)
+			for j := 0; j < 6; j++ {
+				name := fmt.Sprintf("f%d-%d", i%2, j)
+				if _, err := fs.createFile(dir, name, S_IFREG|0644, 0, 0, 0, 0); err != nil {
+					errs <- fmt.Errorf("create %s: %v", name, err)
+					return
+				}
+				if j%2 == 1 {
+					if err := fs.unlink(dir, name); err != nil {
+						errs <- fmt.Errorf("unlink %s: %v", name, err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < nworker; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				blk, err := fs.mp.AllocBlock(0, 3)
+				if err == nil {
+					err = fs.mp.FreeBlocks(0, blk, 3)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i, dir := range dirs {
+		if err = dir.LoadInode(); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(dir.dirSfHdr.Entries); n != 6 {
+			t.Errorf("d%d has %d entries", i, n)
+		}
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
+
+func TestGrowfsWithLookups(t *testing.T) {
+	// 在线扩容会重新加载 AGI，同时进行的请求不能读 AG 列表中的根目录 inode 号
+	dev, err := NewMemBlockDevice(2048, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.mkdir(root, "dir", 0755, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var entry fuse.EntryOut
+				if code := fs.Lookup(nil, &fuse.InHeader{NodeId: RootIno}, "dir", &entry); !code.Ok() {
+					t.Errorf("lookup: %v", code)
+					return
+				}
+				buf := make([]byte, 4096)
+				list := fuse.NewDirEntryList(buf, 0)
+				if code := fs.ReadDir(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: RootIno}}, list); !code.Ok() {
+					t.Errorf("readdir: %v", code)
+					return
+				}
+			}
+		}()
+	}
+	for blocks := uint32(2048 + 512); blocks <= 4096; blocks += 512 {
+		if _, err = fs.growfs(blocks); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
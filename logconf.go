@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 日志配置文件，每行一个 key=value，# 开头的行是注释：
+//   level=debug                   日志级别：panic、fatal、error、warn、info、debug、trace
+//   file=/var/log/poundfs.log     追加写入的日志文件，不设置时写到 stderr
+// mount -logconf 指定配置文件，收到 SIGHUP 时重新读取并重新打开日志文件，便于配合 logrotate
+
+// LogConf 是日志配置文件的内容，空字段表示保持默认
+type LogConf struct {
+	Level string
+	File  string
+}
+
+// ParseLogConf 解析日志配置
+func ParseLogConf(r io.Reader) (LogConf, error) {
+	var conf LogConf
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case !ok:
+			return conf, fmt.Errorf("line %d: expected key=value", n)
+		case key == "level":
+			if _, err := log.ParseLevel(value); err != nil {
+				return conf, fmt.Errorf("line %d: %v", n, err)
+			}
+			conf.Level = value
+		case key == "file":
+			conf.File = value
+		default:
+			return conf, fmt.Errorf("line %d: unknown key %q", n, key)
+		}
+	}
+	return conf, scanner.Err()
+}
+
+// LoadLogConf 读取日志配置文件
+func LoadLogConf(path string) (LogConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return LogConf{}, err
+	}
+	defer f.Close()
+	conf, err := ParseLogConf(f)
+	if err != nil {
+		return conf, fmt.Errorf("%s: %v", path, err)
+	}
+	return conf, nil
+}
+
+var logFile struct {
+	sync.Mutex
+	f *os.File
+}
+
+// applyLogConf 应用日志配置。level 为空时使用 defaultLevel；
+// file 为空时写到 stderr，否则重新打开日志文件，并关闭之前打开的文件
+func applyLogConf(conf LogConf, defaultLevel log.Level) error {
+	level := defaultLevel
+	if conf.Level != "" {
+		var err error
+		if level, err = log.ParseLevel(conf.Level); err != nil {
+			return err
+		}
+	}
+	var out io.Writer = os.Stderr
+	var f *os.File
+	if conf.File != "" {
+		var err error
+		f, err = os.OpenFile(conf.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	logFile.Lock()
+	defer logFile.Unlock()
+	log.SetOutput(out)
+	log.SetFormatter(newLogFormatter(f == nil))
+	log.SetLevel(level)
+	if logFile.f != nil {
+		logFile.f.Close()
+	}
+	logFile.f = f
+	return nil
+}
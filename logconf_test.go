@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestParseLogConf(t *testing.T) {
+	conf, err := ParseLogConf(strings.NewReader("# comment\n\nlevel = debug\nfile=/tmp/poundfs.log\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf != (LogConf{Level: "debug", File: "/tmp/poundfs.log"}) {
+		t.Errorf("conf is %+v", conf)
+	}
+	for _, bad := range []string{"level=loud", "colour=red", "level"} {
+		if _, err := ParseLogConf(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestApplyLogConf(t *testing.T) {
+	defer applyLogConf(LogConf{}, log.GetLevel())
+	dir := t.TempDir()
+	path := filepath.Join(dir, "poundfs.log")
+	if err := applyLogConf(LogConf{Level: "warn", File: path}, log.InfoLevel); err != nil {
+		t.Fatal(err)
+	}
+	log.Info("hidden")
+	log.Warn("first")
+	// 模拟 logrotate：移走日志文件后重新加载配置，应写入新文件
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyLogConf(LogConf{File: path}, log.InfoLevel); err != nil {
+		t.Fatal(err)
+	}
+	log.Info("second")
+	old, _ := os.ReadFile(rotated)
+	cur, _ := os.ReadFile(path)
+	if strings.Contains(string(old), "hidden") || !strings.Contains(string(old), "first") {
+		t.Errorf("rotated log is %q", old)
+	}
+	if !strings.Contains(string(cur), "second") || strings.Contains(string(cur), "\x1b[") {
+		t.Errorf("new log is %q", cur)
+	}
+}
@@ -1,75 +1,103 @@
 package main
 
 import (
-	"flag"
-	"sync"
+	"fmt"
+	"os"
+	"strings"
 
-	"github.com/hanwen/go-fuse/v2/fuse"
 	log "github.com/sirupsen/logrus"
 )
 
 func init() {
-	stdFormatter := &log.TextFormatter{
+	log.SetFormatter(newLogFormatter(true))
+	log.SetLevel(log.InfoLevel)
+}
+
+// newLogFormatter 返回日志格式，写到文件时不使用颜色
+func newLogFormatter(colors bool) log.Formatter {
+	return &log.TextFormatter{
 		FullTimestamp:   true,
 		TimestampFormat: "15:04:05.000000",
-		ForceColors:     true,
-		DisableColors:   false,
+		ForceColors:     colors,
+		DisableColors:   !colors,
 	}
-	log.SetFormatter(stdFormatter)
-	log.SetLevel(log.InfoLevel)
 }
 
-func main() {
-	debug := flag.Bool("debug", false, "print debug data")
-	flag.Parse()
-	if len(flag.Args()) < 1 {
-		log.Fatal("Usage:\n\tpoundfs MOUNTPOINT")
-	}
-	// *debug = true
-	if *debug {
-		log.SetLevel(log.DebugLevel)
-		log.Warn("Debug mode enabled")
-	}
-	// use device.bin as dev
-	fname := "./device.bin"
-	// get file size
-	fsize, err := GetFileSize(fname)
-	if err != nil {
-		log.Fatal(err)
-	}
+// command 是 poundfs 的一个子命令
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
 
-	blockcount := uint64(fsize / 512)
-	dev, err := NewFileBlockDevice(fname, blockcount)
-	if err != nil {
-		panic(err)
-	}
-	if dev == nil {
-		panic("dev is nil")
-	}
-	fs := NewPoundFS(dev)
-	if nil == fs {
-		panic("fs is nil")
+var commands []command
+
+func init() {
+	commands = []command{
+		{"mkfs", "poundfs mkfs [-size SIZE] [-blocksize SIZE] [-agcount N] [-features LIST] [-L LABEL] [-root DIR] [-f] -o IMAGE", cmdMkfs},
+		{"info", "poundfs info -device IMAGE", cmdInfo},
+		{"label", "poundfs label -device IMAGE [LABEL]", cmdLabel},
+		{"db", "poundfs db [-c COMMAND]... -device IMAGE", cmdDb},
+		{"fsck", "poundfs fsck [-repair] -device IMAGE", cmdFsck},
+		{"ls", "poundfs ls -device IMAGE PATH", cmdLs},
+		{"cat", "poundfs cat -device IMAGE PATH", cmdCat},
+		{"get", "poundfs get -device IMAGE PATH HOSTFILE", cmdGet},
+		{"put", "poundfs put -device IMAGE HOSTFILE PATH", cmdPut},
+		{"mkdir", "poundfs mkdir -device IMAGE PATH", cmdMkdir},
+		{"rm", "poundfs rm -device IMAGE PATH", cmdRm},
+		{"growfs", "poundfs growfs -size SIZE (-device IMAGE | MOUNTPOINT)", cmdGrowfs},
+		{"mount", "poundfs mount (-device IMAGE | -tmpfs SIZE) [-o ro,allow_other,uid=N,gid=N,fsname=NAME] [-cache SIZE] [-writeback DURATION] [-force] [-logconf FILE] MOUNTPOINT", cmdMount},
 	}
-	fs.SetDebug(*debug)
-	mountpoint := flag.Args()[0]
-	server, err := fuse.NewServer(fs, mountpoint, &fuse.MountOptions{RememberInodes: true, Debug: *debug})
-	if err != nil {
-		panic(err)
+}
+
+func commandUsage(name string) string {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.usage
+		}
 	}
-	server.SetDebug(*debug)
+	return ""
+}
 
-	var wg sync.WaitGroup
+func usage() string {
+	var lines []string
+	for _, cmd := range commands {
+		lines = append(lines, cmd.usage)
+	}
+	return "Usage:\n\t" + strings.Join(lines, "\n\t")
+}
 
-	wg.Add(1)
-	go func() {
-		server.Serve()
-		defer server.Unmount()
-		defer wg.Done()
-	}()
+// setupLogLevel 在 debug 模式下打开调试日志，否则使用 level
+func setupLogLevel(debug bool, level log.Level) {
+	if debug {
+		log.SetLevel(log.DebugLevel)
+		log.Warn("Debug mode enabled")
+		return
+	}
+	log.SetLevel(level)
+}
 
-	if err := server.WaitMount(); err != nil {
-		panic(err)
+func main() {
+	if len(os.Args) > 1 {
+		for _, cmd := range commands {
+			if cmd.name == os.Args[1] {
+				if err := cmd.run(os.Args[2:]); err != nil {
+					fmt.Fprintln(os.Stderr, "poundfs "+cmd.name+":", err)
+					os.Exit(1)
+				}
+				return
+			}
+		}
 	}
 
-	wg.Wait()
+	// 兼容旧用法：poundfs [-debug] MOUNTPOINT 挂载当前目录下的 device.bin
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage())
+		os.Exit(2)
+	}
+	log.Warn("no subcommand given, mounting ./device.bin; use `poundfs mount -device IMAGE MOUNTPOINT` instead")
+	if err := cmdMount(append([]string{"-device", "./device.bin"}, os.Args[1:]...)); err != nil {
+		fmt.Fprintln(os.Stderr, "poundfs:", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+)
+
+// MemBlockDevice 是以字节切片为存储的块设备，用于测试和 mount -tmpfs
+type MemBlockDevice struct {
+	mu        sync.RWMutex
+	data      []byte
+	blocksize uint32
+}
+
+// NewMemBlockDevice 创建 blockcount 个 blocksize 字节块的内存设备，内容全为 0
+func NewMemBlockDevice(blockcount uint64, blocksize uint32) (*MemBlockDevice, error) {
+	if !ValidBlockSize(blocksize) {
+		return nil, ErrBadBlockSize
+	}
+	return &MemBlockDevice{
+		data:      make([]byte, blockcount*uint64(blocksize)),
+		blocksize: blocksize,
+	}, nil
+}
+
+func (m *MemBlockDevice) ReadBlock(blockno uint64) ([]byte, error) {
+	data := make([]byte, m.blocksize)
+	if err := m.Read(blockno*uint64(m.blocksize), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m *MemBlockDevice) WriteBlock(blockno uint64, data []byte) error {
+	if len(data) != int(m.blocksize) {
+		return ErrInvalidArgument
+	}
+	return m.Write(blockno*uint64(m.blocksize), data)
+}
+
+func (m *MemBlockDevice) Read(offset uint64, data []byte) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if offset+uint64(len(data)) > uint64(len(m.data)) {
+		return ErrOutOfRange
+	}
+	copy(data, m.data[offset:])
+	return nil
+}
+
+func (m *MemBlockDevice) Write(offset uint64, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if offset+uint64(len(data)) > uint64(len(m.data)) {
+		return ErrOutOfRange
+	}
+	copy(m.data[offset:], data)
+	return nil
+}
+
+func (m *MemBlockDevice) GetTotalBlockCount() uint32 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return uint32(uint64(len(m.data)) / uint64(m.blocksize))
+}
+
+func (m *MemBlockDevice) GetBlockSize() uint32 {
+	return m.blocksize
+}
+
+// Resize 扩展到 blockcount 块，新增部分为 0，不允许缩小
+func (m *MemBlockDevice) Resize(blockcount uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	size := blockcount * uint64(m.blocksize)
+	if size < uint64(len(m.data)) {
+		return ErrOutOfRange
+	}
+	m.data = append(m.data, make([]byte, size-uint64(len(m.data)))...)
+	return nil
+}
+
+// Snapshot 返回当前全部内容的副本
+func (m *MemBlockDevice) Snapshot() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	snap := make([]byte, len(m.data))
+	copy(snap, m.data)
+	return snap
+}
+
+// Restore 把内容恢复为 snap，设备大小随之改变。snap 必须是整数个块
+func (m *MemBlockDevice) Restore(snap []byte) error {
+	if len(snap)%int(m.blocksize) != 0 {
+		return ErrInvalidArgument
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = make([]byte, len(snap))
+	copy(m.data, snap)
+	return nil
+}
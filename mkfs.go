@@ -4,33 +4,174 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func Makefs(dev BlockDevice) (err error) {
+// AG 头部保留的块数（超级块、AGF、AGI、AGFL 以及各个树根），数据区从此处开始
+const AgHeaderBlocks = 16
+
+// MinAgBlocks 是一个 AG 的最小块数：头部之外至少还要留出 32 个数据块
+const MinAgBlocks = AgHeaderBlocks + 32
+
+// DefaultFreeSplit 是没有 btree 特性时空闲空间树初始把数据区平均划分的份数
+const DefaultFreeSplit = 16
+
+// defaultFreeSplit 返回启用 features 时默认的划分份数。
+// 有 btree 特性时释放的区间会与相邻的区间合并，数据区一开始就是一整个区间
+func defaultFreeSplit(features FeatureSet) uint32 {
+	if features.Incompat&FeatIncompatBtree != 0 {
+		return 1
+	}
+	return DefaultFreeSplit
+}
+
+// 自动选择 AG 数量时，单个 AG 的最大块数
+const maxDefaultAgBlocks = 1 << 21
+
+// MkfsOptions 是格式化时可调整的参数，零值表示使用默认值
+type MkfsOptions struct {
+	AgCount   uint32      // AG 数量，0 表示根据设备大小自动选择
+	FreeSplit uint32      // 空闲空间树初始划分份数，0 表示默认值，见 defaultFreeSplit
+	BlockSize uint32      // 块大小，0 表示 DefaultBlockSize；Makefs 中 0 表示使用设备的块大小
+	Features  *FeatureSet // 启用的特性，nil 表示 DefaultFeatures
+	Label     string      // 卷标，不超过 SbLabelLen 字节
+}
+
+// MkfsGeometry 描述格式化后的布局
+//   - 除最后一个 AG 外，每个 AG 都是 AgBlocks 块
+//   - 最后一个 AG 是剩下的 AgBlocksLast 块，不超过 AgBlocks
+type MkfsGeometry struct {
+	TotalBlocks  uint32
+	AgCount      uint32
+	AgBlocks     uint32
+	AgBlocksLast uint32
+	FreeSplit    uint32
+	BlockSize    uint32
+	Features     FeatureSet // 写入超级块的特性标志
+	UUID         [16]byte   // Makefs 生成的 UUID，ComputeGeometry 不设置
+}
+
+// DefaultAgCount 根据设备大小选择 AG 数量
+func DefaultAgCount(totalBlocks uint32) uint32 {
+	agcount := uint32(4)
+	if n := (totalBlocks + maxDefaultAgBlocks - 1) / maxDefaultAgBlocks; n > agcount {
+		agcount = n
+	}
+	// 小设备减少 AG 数量，保证每个 AG 都放得下
+	for agcount > 1 {
+		if _, err := computeGeometry(totalBlocks, agcount, DefaultFreeSplit, DefaultBlockSize); err == nil {
+			break
+		}
+		agcount--
+	}
+	return agcount
+}
+
+// ComputeGeometry 计算并校验格式化布局，不合法时返回 ErrAgToSmall 或 ErrOutOfRange
+func ComputeGeometry(totalBlocks uint32, opts MkfsOptions) (*MkfsGeometry, error) {
+	agcount := opts.AgCount
+	if agcount == 0 {
+		agcount = DefaultAgCount(totalBlocks)
+	}
+	features := DefaultFeatures
+	if opts.Features != nil {
+		features = *opts.Features
+	}
+	split := opts.FreeSplit
+	if split == 0 {
+		split = defaultFreeSplit(features)
+	}
+	bs := opts.BlockSize
+	if bs == 0 {
+		bs = DefaultBlockSize
+	}
+	if !ValidBlockSize(bs) {
+		return nil, ErrBadBlockSize
+	}
+	geo, err := computeGeometry(totalBlocks, agcount, split, bs)
+	if err != nil {
+		return nil, err
+	}
+	geo.Features = features
+	// 不能创建本实现不认识的特性
+	if geo.Features.Unsupported() != (FeatureSet{}) {
+		return nil, ErrInvalidArgument
+	}
+	return geo, nil
+}
+
+func computeGeometry(totalBlocks uint32, agcount uint32, split uint32, bs uint32) (*MkfsGeometry, error) {
+	if agcount == 0 || uint64(agcount)*MinAgBlocks > uint64(totalBlocks) {
+		return nil, ErrAgToSmall
+	}
+	// 向上取整，使最后一个 AG 不大于其他 AG
+	agBlocks := (totalBlocks-1)/agcount + 1
+	if uint64(agBlocks)*uint64(agcount-1) >= uint64(totalBlocks) {
+		return nil, ErrAgToSmall
+	}
+	agBlocksLast := totalBlocks - agBlocks*(agcount-1)
+	if agBlocksLast < MinAgBlocks {
+		return nil, ErrAgToSmall
+	}
+	// 每一份空闲空间至少 1 块，且所有记录要能放进空闲空间树的根块
+	if split == 0 || split > agBlocksLast-AgHeaderBlocks || int(split) > BtreeBlockCapacity[DFreeBlockBtRec](bs) {
+		return nil, ErrOutOfRange
+	}
+	return &MkfsGeometry{
+		TotalBlocks:  totalBlocks,
+		AgCount:      agcount,
+		AgBlocks:     agBlocks,
+		AgBlocksLast: agBlocksLast,
+		FreeSplit:    split,
+		BlockSize:    bs,
+	}, nil
+}
+
+// AgSize 返回第 agno 个 AG 的真实块数
+func (g *MkfsGeometry) AgSize(agno uint32) uint32 {
+	if agno == g.AgCount-1 {
+		return g.AgBlocksLast
+	}
+	return g.AgBlocks
+}
+
+func Makefs(dev BlockDevice, opts MkfsOptions) (*MkfsGeometry, error) {
 	// 创建分配组
-	agCount := uint32(4)
 	totalBlocks := (dev).GetTotalBlockCount()
 	logrus.Info("totalBlocks: ", totalBlocks)
-	agBlocks := totalBlocks / uint32(agCount)
-	agBlocksLast := totalBlocks%uint32(agCount) + agBlocks
-	for agno := uint32(0); agno < agCount; agno++ {
-		var err error
-		blockOff := agno * agBlocks
-		if agno == agCount-1 {
-			err = MakeAg(dev, agno, blockOff, agBlocksLast, agCount)
-		} else {
-			err = MakeAg(dev, agno, blockOff, agBlocks, agCount)
-		}
-
+	if opts.BlockSize == 0 {
+		opts.BlockSize = dev.GetBlockSize()
+	}
+	if opts.BlockSize != dev.GetBlockSize() {
+		return nil, ErrBadBlockSize
+	}
+	geo, err := ComputeGeometry(totalBlocks, opts)
+	if err != nil {
+		return nil, err
+	}
+	// 各个 AG 的超级块共用同一份 UUID、卷标和创建时间
+	tmpl := &Superblock{UUID: NewUUID()}
+	if err = tmpl.SetLabel(opts.Label); err != nil {
+		return nil, err
+	}
+	tmpl.Ctime = GetTimestampNsec()
+	tmpl.WriteTime = tmpl.Ctime
+	tmpl.setFeatures(geo.Features)
+	geo.UUID = tmpl.UUID
+	for agno := uint32(0); agno < geo.AgCount; agno++ {
+		blockOff := agno * geo.AgBlocks
+		err = MakeAg(dev, agno, blockOff, geo.AgSize(agno), geo.AgCount, geo.FreeSplit, tmpl)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return err
+	return geo, nil
 }
 
 // MakeAg 创建分配组
 // - agblocks 是此 AG 的真实大小
-func MakeAg(dev BlockDevice, agno uint32, agBlockOff uint32, agblocks uint32, agcount uint32) error {
-	logrus.Infof("initialize AG at 0x%x", agno*agblocks*BlockSize)
+// - freeSplit 是空闲空间树初始划分的份数
+// - tmpl 提供超级块中各 AG 共用的字段：版本、特性标志、UUID、卷标和时间
+func MakeAg(dev BlockDevice, agno uint32, agBlockOff uint32, agblocks uint32, agcount uint32, freeSplit uint32, tmpl *Superblock) error {
+	bs := dev.GetBlockSize()
+	logrus.Infof("initialize AG at 0x%x", uint64(agBlockOff)*uint64(bs))
 	// 定义 AG 的主要结构、b+tree 树根布局
 	// 以下均是从 0 开始的
 	sbBlk := agBlockOff
@@ -43,42 +184,49 @@ func MakeAg(dev BlockDevice, agno uint32, agBlockOff uint32, agblocks uint32, ag
 	inoRootBlk := cntRootBlk + 1
 	freeRootBlk := inoRootBlk + 1
 
-	dataBlk := sbBlk + 16
+	dataBlk := sbBlk + AgHeaderBlocks
 	dataBlkRel := dataBlk - agBlockOff
 
-	if agBlockOff+agblocks < dataBlk+32 {
+	if agblocks < MinAgBlocks {
 		return ErrAgToSmall
 	}
 
 	// 1. 创建超级块
-	superblock := &Superblock{
-		MagicNum:  SuperBlockMagicNum,
-		BlockSize: BlockSize,
-		AgBlocks:  agblocks,
-		AgCount:   agcount,
-		SeqNo:     agno,
-	}
+	superblock := new(Superblock)
+	*superblock = *tmpl
+	superblock.MagicNum = SuperBlockMagicNum
+	superblock.BlockSize = bs
+	superblock.AgBlocks = agblocks
+	superblock.AgCount = agcount
+	superblock.SeqNo = agno
+	dev = withFeatures(dev, superblock)
 	superblockData, err := BytesOf(superblock)
 	if err != nil {
 		return err
 	}
-	err = dev.WriteBlock(uint64(sbBlk), Pad(superblockData, BlockSize))
+	err = writeMetaBlock(dev, uint64(sbBlk), superblockData)
 	if err != nil {
 		return err
 	}
+	// 本 AG 的剩余空间平均分为 freeSplit 份，最后一份可能有多余
+	agFreeDataBlocks := agblocks - dataBlkRel
+	avgFreeCnt := agFreeDataBlocks / freeSplit
+	lastFreeCnt := agFreeDataBlocks%freeSplit + avgFreeCnt
 	// 2. 创建 AGF
 	agf := &Agf{
-		MagicNum: AgfMagicNum,
-		SeqNo:    agno,
-		BnoRoot:  bnoRootBlk,
-		CntRoot:  cntRootBlk,
+		MagicNum:   AgfMagicNum,
+		SeqNo:      agno,
+		BnoRoot:    bnoRootBlk,
+		CntRoot:    cntRootBlk,
+		FreeBlocks: agFreeDataBlocks,
+		Longest:    lastFreeCnt,
 	}
 	agfData, err := BytesOf(agf)
 	if err != nil {
 		return err
 	}
 
-	err = dev.WriteBlock(uint64(agfBlk), Pad(agfData, BlockSize))
+	err = writeMetaBlock(dev, uint64(agfBlk), agfData)
 	if err != nil {
 		return err
 	}
@@ -94,7 +242,7 @@ func MakeAg(dev BlockDevice, agno uint32, agBlockOff uint32, agblocks uint32, ag
 		return err
 	}
 
-	err = dev.WriteBlock(uint64(agiBlk), Pad(agiData, BlockSize))
+	err = writeMetaBlock(dev, uint64(agiBlk), agiData)
 	if err != nil {
 		return err
 	}
@@ -108,26 +256,27 @@ func MakeAg(dev BlockDevice, agno uint32, agBlockOff uint32, agblocks uint32, ag
 		return err
 	}
 
-	err = dev.WriteBlock(uint64(afglBlk), Pad(agflData, BlockSize))
+	err = writeMetaBlock(dev, uint64(afglBlk), agflData)
 	if err != nil {
 		return err
 	}
 
 	// === 接下来初始化空闲空间树 ===
-	// 1. 创建空闲空间树的根节点
+	// 1. 创建空闲空间树的根节点，没有 btree 特性时不使用 bno 树
 	btCtx := NewBtreeContext[uint64, DFreeBlockBtRec](dev, uint64(cntRootBlk))
 	err = btCtx.InitBlock()
 	if err != nil {
 		return err
 	}
-	// 2. 计算本 AG 的剩余空间
-	agFreeDataBlocks := agblocks - dataBlkRel
-	initDiv := uint32(16)
-	// 初始状态，把 agFreeBlocks 平均分配为 initDiv 份
-	avgFreeCnt := agFreeDataBlocks / initDiv
-	// 最后一项可能有多余
-	lastFreeCnt := agFreeDataBlocks%initDiv + avgFreeCnt
-	// 3. 创建空闲空间树的节点
+	var bnoCtx *BtreeContext[uint64, DFreeBnoBtRec]
+	if btreeEnabled(dev) {
+		bnoCtx = NewBtreeContext[uint64, DFreeBnoBtRec](dev, uint64(bnoRootBlk))
+		if err = bnoCtx.InitBlock(); err != nil {
+			return err
+		}
+	}
+	// 2. 创建空闲空间树的节点
+	initDiv := freeSplit
 	// 计算各个空闲块的起始块号
 	for i := uint32(0); i < initDiv; i++ {
 		// 创建空闲块记录
@@ -143,14 +292,18 @@ func MakeAg(dev BlockDevice, agno uint32, agBlockOff uint32, agblocks uint32, ag
 		if err != nil {
 			return err
 		}
+		if bnoCtx != nil {
+			if err = bnoCtx.Set(DFreeBnoBtRec(freeBlock)); err != nil {
+				return err
+			}
+		}
 	}
 	// === 接下来初始化根节点 inode ===
 	// 1. 创建根节点
 	rootInodeCtx := NewInoContext(dev, uint64(inoRootBlk))
-	err = rootInodeCtx.InitInode(S_IFDIR | 755)
+	err = rootInodeCtx.InitInode(S_IFDIR | 0755)
 	if err != nil {
 		return err
 	}
-	rootInodeCtx.SetParent(uint64(inoRootBlk))
-	return nil
+	return rootInodeCtx.SetParent(uint64(inoRootBlk))
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 格式化时把宿主机的目录树复制到镜像中（mkfs -root DIR），类似 mke2fs -d
+
+// hostInode 唯一标识宿主机上的一个 inode，用于识别硬链接
+type hostInode struct {
+	dev uint64
+	ino uint64
+}
+
+// TreeUsage 是目录树复制到镜像后预计占用的空间
+type TreeUsage struct {
+	Blocks    uint64 // 所有 inode 及其数据块的总块数
+	MaxExtent uint64 // 单次分配需要的最大连续块数
+}
+
+func (u *TreeUsage) add(n uint64) {
+	u.Blocks += n
+	if n > u.MaxExtent {
+		u.MaxExtent = n
+	}
+}
+
+// MeasureTree 统计把 root 复制到块大小为 bs 的镜像需要的块数，硬链接只计算一次
+func MeasureTree(root string, bs uint32) (*TreeUsage, error) {
+	usage := &TreeUsage{}
+	seen := make(map[hostInode]bool)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// 根目录使用镜像中已有的根 inode
+		if path == root {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if !fi.IsDir() && st.Nlink > 1 {
+			key := hostInode{uint64(st.Dev), st.Ino}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		ndata := uint64(0)
+		switch {
+		case fi.Mode().IsRegular():
+			// 与挂载后写入一样，inode 和预分配的数据块在一起，超出的部分另外分配
+			prealloc := dataBlocks(FilePreallocBytes, bs)
+			if grow := writtenBlocks(uint64(fi.Size()), bs) - prealloc; grow > 0 {
+				usage.add(grow)
+			}
+			ndata = prealloc
+		case fi.Mode()&os.ModeSymlink != 0:
+			ndata = dataBlocks(uint64(fi.Size()), bs)
+		}
+		usage.add(1 + ndata)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// EstimateImageBlocks 选择能放下 usage 的最小镜像块数。
+// 文件跟随父目录所在的 AG，最坏情况下都分配在 AG 0 中，因此要求 AG 0 的每一份空闲空间都放得下最大的 inode，
+// 且扣除每份末尾可能浪费的空间后总量仍然足够
+func EstimateImageBlocks(usage *TreeUsage, opts MkfsOptions) (uint32, error) {
+	total := usage.Blocks + usage.Blocks/4 + MinAgBlocks
+	for total <= uint64(^uint32(0)) {
+		geo, err := ComputeGeometry(uint32(total), opts)
+		if err == nil {
+			extent := uint64(geo.AgBlocks-AgHeaderBlocks) / uint64(geo.FreeSplit)
+			if extent >= usage.MaxExtent &&
+				(extent-usage.MaxExtent+1)*uint64(geo.FreeSplit) >= usage.Blocks {
+				return uint32(total), nil
+			}
+		}
+		total += total/8 + MinAgBlocks
+	}
+	return 0, ErrOutOfRange
+}
+
+// PopulateFromDir 把宿主机上的目录树 root 复制到已格式化的 dev 中，
+// 保留权限、属主、时间戳、符号链接和硬链接。复制失败时也会正常卸载，镜像不会留下 dirty 标记
+func PopulateFromDir(dev BlockDevice, root string) (err error) {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: %v", root, ErrNotDirectory)
+	}
+	pfs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := pfs.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	rootCtx, err := pfs.lookupPath("/")
+	if err != nil {
+		return err
+	}
+	p := &populator{fs: pfs, links: make(map[hostInode]uint64)}
+	if err := p.copyDir(root, rootCtx); err != nil {
+		return err
+	}
+	return setHostMeta(rootCtx, fi)
+}
+
+type populator struct {
+	fs    *PoundFS
+	links map[hostInode]uint64 // 宿主机 inode => 镜像中的 inode
+}
+
+// copyDir 把宿主机目录 dir 下的所有条目复制到 parent 中
+func (p *populator) copyDir(dir string, parent *InoContext) error {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		path := filepath.Join(dir, ent.Name())
+		if err := p.copyEntry(path, ent.Name(), parent); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func (p *populator) copyEntry(path string, name string, parent *InoContext) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	key := hostInode{uint64(st.Dev), st.Ino}
+	if ino, ok := p.links[key]; ok {
+		target := NewInoContext(p.fs.dev, ino)
+		if err := target.LoadInode(); err != nil {
+			return err
+		}
+		return p.fs.link(parent, name, target)
+	}
+
+	var ctx *InoContext
+	mode := st.Mode
+	switch mode & S_IFMT {
+	case S_IFDIR:
+		ctx, err = p.fs.mkdir(parent, name, mode&07777, st.Uid, st.Gid)
+		if err != nil {
+			return err
+		}
+		if err := p.copyDir(path, ctx); err != nil {
+			return err
+		}
+	case S_IFREG:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// 与通过 FUSE 创建和写入的文件一样，超出预分配的部分由 fs.write 扩展
+		ctx, err = p.fs.createFile(parent, name, mode, st.Uid, st.Gid, 0, 0)
+		if err != nil {
+			return err
+		}
+		if len(data) > 0 {
+			if _, err := p.fs.write(ctx, 0, data); err != nil {
+				return err
+			}
+		}
+	case S_IFLNK:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		ctx, err = p.fs.symlink(parent, name, target, st.Uid, st.Gid)
+		if err != nil {
+			return err
+		}
+	default:
+		if mode&S_IFMT == S_IFCHR || mode&S_IFMT == S_IFBLK {
+			logrus.Warnf("%s: device numbers are not stored, creating an empty node", path)
+		}
+		ctx, err = p.fs.mknod(parent, name, mode, st.Uid, st.Gid)
+		if err != nil {
+			return err
+		}
+	}
+	if !fi.IsDir() && st.Nlink > 1 {
+		p.links[key] = ctx.ino
+	}
+	return setHostMeta(ctx, fi)
+}
+
+// setHostMeta 把宿主机文件的权限、属主和时间戳写入 inode
+func setHostMeta(ctx *InoContext, fi os.FileInfo) error {
+	st := fi.Sys().(*syscall.Stat_t)
+	inode := ctx.coreCache
+	inode.Mode = inode.Mode&S_IFMT | uint16(st.Mode&07777)
+	inode.Uid = st.Uid
+	inode.Gid = st.Gid
+	inode.Atime = uint64(st.Atim.Nano())
+	inode.Mtime = uint64(st.Mtim.Nano())
+	return ctx.SyncInode()
+}
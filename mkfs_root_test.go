@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPopulateFromDir(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+	big := bytes.Repeat([]byte("0123456789"), 3000)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, step := range []error{
+		os.MkdirAll(filepath.Join(root, "dir", "sub"), 0750),
+		os.WriteFile(filepath.Join(root, "dir", "small"), []byte("hello"), 0600),
+		os.WriteFile(filepath.Join(root, "big"), big, 0644),
+		os.Link(filepath.Join(root, "dir", "small"), filepath.Join(root, "hard")),
+		os.Symlink("dir/small", filepath.Join(root, "sym")),
+		os.Chtimes(filepath.Join(root, "dir", "small"), mtime, mtime),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+
+	usage, err := MeasureTree(root, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dir, sub, small, big, sym；hard 与 small 共用 inode
+	if want := uint64(1 + 1 + (1 + FilePreallocBytes/DefaultBlockSize) + (1 + 59) + (1 + 1)); usage.Blocks != want {
+		t.Errorf("usage is %d blocks not %d", usage.Blocks, want)
+	}
+	blockcount, err := EstimateImageBlocks(usage, MkfsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := NewMemBlockDevice(uint64(blockcount), DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = PopulateFromDir(dev, root); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := NewPoundFS(dev, MountOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := fs.lookupPath("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := readAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, big) {
+		t.Errorf("big: content differs")
+	}
+	// 与挂载后写入的文件一样，超出预分配的部分转换为区间列表
+	if n := writtenBlocks(uint64(len(big)), DefaultBlockSize); ctx.coreCache.Format != FMT_EXTENTS || ctx.coreCache.NLocBlk != n {
+		t.Errorf("big: format %d, %d blocks not %d", ctx.coreCache.Format, ctx.coreCache.NLocBlk, n)
+	}
+	small, err := fs.lookupPath("/dir/small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hard, err := fs.lookupPath("/hard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hard.ino != small.ino || hard.coreCache.Nlink != 2 {
+		t.Errorf("hard link: ino %d/%d nlink %d", hard.ino, small.ino, hard.coreCache.Nlink)
+	}
+	if small.coreCache.Mode != S_IFREG|0600 || small.coreCache.Mtime != uint64(mtime.UnixNano()) {
+		t.Errorf("small: mode %o mtime %d", small.coreCache.Mode, small.coreCache.Mtime)
+	}
+	if uid := uint32(os.Getuid()); small.coreCache.Uid != uid {
+		t.Errorf("small: uid %d not %d", small.coreCache.Uid, uid)
+	}
+	dir, err := fs.lookupPath("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.coreCache.Mode != S_IFDIR|0750 {
+		t.Errorf("dir: mode %o", dir.coreCache.Mode)
+	}
+	sym, err := fs.lookupPath("/sym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := fs.readlink(sym)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(target) != "dir/small" {
+		t.Errorf("sym: target %q", target)
+	}
+
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Errorf("fsck: %v", report.Problems)
+	}
+}
+
+func TestPopulateFromDirFailure(t *testing.T) {
+	// 放不下目录树时返回错误，但镜像仍然正常卸载，可以直接挂载
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "big"), make([]byte, 2*1024*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dev, err := NewMemBlockDevice(2048, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = PopulateFromDir(dev, root); err == nil || !strings.Contains(err.Error(), ErrNoSpace.Error()) {
+		t.Errorf("err is %v", err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatalf("mount after failed populate: %v", err)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestMakefs(t *testing.T) {
 	// 10MB
-	blockcount := uint64(10 * 1024 * 1024 / BlockSize)
-	// remove
-	os.Remove("./device.bin")
-	dev, err := NewFileBlockDevice("./device.bin", blockcount)
+	blockcount := uint64(10 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
 	if err != nil {
 		t.Error(err)
 	}
@@ -18,7 +19,7 @@ func TestMakefs(t *testing.T) {
 		t.Error("dev is nil")
 	}
 	// 格式化文件系统
-	err = Makefs(dev)
+	_, err = Makefs(dev, MkfsOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -28,25 +29,13 @@ func TestMakefs(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	cntroot := mp.AgCtx[0].Agf.Meta.CntRoot
-	btCtx := NewBtreeContext[uint64, DFreeBlockBtRec](dev, uint64(cntroot))
-	needBlk := uint64(2*1024) / BlockSize // 2KB
-	rec, index, err := btCtx.GetFirstMeet(needBlk)
+	ndatablock := uint64(8192 / DefaultBlockSize)
+	// 创建 inode
+	inoblk, err := mp.AllocBlock(0, ndatablock+1)
 	if err != nil {
 		t.Error(err)
-	}
-	if rec == nil {
-		t.Error("rec is nil")
 		return
 	}
-	ndatablock := uint64(8192 / BlockSize)
-	// 创建 inode
-	inoblk := rec.StartBlock
-	defer func() {
-		rec.BlockCount -= ndatablock + 1
-		rec.StartBlock += ndatablock + 1
-		btCtx.SetByIndex(*rec, index)
-	}()
 	// dirInoCtx := NewInoContext(dev, inoblk)
 	// 创建目录
 	// dirInoCtx.InitInode(S_IFDIR | 0755)
@@ -69,7 +58,7 @@ func TestMakefs(t *testing.T) {
 	}
 
 	// bytes is loop 0x01 to 0xfe to fill the block
-	bytes := make([]byte, BlockSize*4)
+	bytes := make([]byte, DefaultBlockSize*4)
 	for i := 0; i < len(bytes); i++ {
 		bytes[i] = byte(i%0xfe + 1)
 	}
@@ -97,3 +86,148 @@ func TestMakefs(t *testing.T) {
 	// dirInoCtx.AddEntry("myfile.txt", fileInoCtx.ino)
 	// dirInoCtx.Sync()
 }
+
+func TestComputeGeometry(t *testing.T) {
+	// 10MB，默认 4 个 AG
+	geo, err := ComputeGeometry(10*1024*1024/DefaultBlockSize, MkfsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo.AgCount != 4 || geo.AgBlocks*(geo.AgCount-1)+geo.AgBlocksLast != geo.TotalBlocks {
+		t.Errorf("bad geometry %+v", geo)
+	}
+	if geo.AgBlocksLast > geo.AgBlocks {
+		t.Errorf("last AG %d larger than agsize %d", geo.AgBlocksLast, geo.AgBlocks)
+	}
+	// 小设备自动减少 AG 数量
+	geo, err = ComputeGeometry(100, MkfsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo.AgCount != 2 {
+		t.Errorf("agcount is %d not 2", geo.AgCount)
+	}
+	// AG 过小
+	_, err = ComputeGeometry(100, MkfsOptions{AgCount: 4})
+	if err != ErrAgToSmall {
+		t.Errorf("err is %v not %v", err, ErrAgToSmall)
+	}
+	_, err = ComputeGeometry(4801, MkfsOptions{AgCount: 100})
+	if err != ErrAgToSmall {
+		t.Errorf("err is %v not %v", err, ErrAgToSmall)
+	}
+}
+
+func TestMkfsImageSize(t *testing.T) {
+	dir := t.TempDir()
+	// 不存在的文件需要 -size
+	if _, err := mkfsImageSize(filepath.Join(dir, "new.bin"), "", false, false); err == nil {
+		t.Error("missing -size accepted")
+	}
+	if size, err := mkfsImageSize(filepath.Join(dir, "new.bin"), "1M", false, false); err != nil || size != 1024*1024 {
+		t.Errorf("new image: %d, %v", size, err)
+	}
+	// 空文件直接使用
+	empty := filepath.Join(dir, "empty.bin")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := mkfsImageSize(empty, "1M", false, false); err != nil || size != 1024*1024 {
+		t.Errorf("empty file: %d, %v", size, err)
+	}
+
+	// 已有的 poundfs 镜像和其他非空文件都需要 -f
+	image := filepath.Join(dir, "image.bin")
+	dev, err := NewFileBlockDevice(image, 4096, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dev.Close()
+	other := filepath.Join(dir, "other.bin")
+	if err = os.WriteFile(other, bytes.Repeat([]byte("not poundfs\n"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ path, msg string }{
+		{image, "already contains a poundfs filesystem"},
+		{other, "is not empty"},
+	} {
+		if _, err = mkfsImageSize(c.path, "", false, false); err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%s without -f: %v", c.path, err)
+		}
+		fsize, _ := GetFileSize(c.path)
+		if size, err := mkfsImageSize(c.path, "", true, false); err != nil || size != uint64(fsize) {
+			t.Errorf("%s with -f: %d, %v", c.path, size, err)
+		}
+	}
+}
+
+func TestMakefsBlockSize(t *testing.T) {
+	data := bytes.Repeat([]byte("poundfs "), 2000)
+	for _, bs := range []uint32{512, 1024, 2048, 4096} {
+		path := filepath.Join(t.TempDir(), "bs.bin")
+		dev, err := NewFileBlockDevice(path, 4096, bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		geo, err := Makefs(dev, MkfsOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if geo.BlockSize != bs {
+			t.Errorf("geometry block size %d not %d", geo.BlockSize, bs)
+		}
+		dev.Close()
+
+		// 重新打开时从超级块中读出块大小
+		dev, err = OpenFileBlockDevice(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dev.GetBlockSize() != bs || dev.GetTotalBlockCount() != 4096 {
+			t.Errorf("opened with block size %d, %d blocks", dev.GetBlockSize(), dev.GetTotalBlockCount())
+		}
+		fs, err := NewPoundFS(dev, MountOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := fs.lookupPath("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := fs.createFile(root, "file", S_IFREG|0644, 0, 0, O_CREAT|O_WRONLY, uint64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = file.Write(0, data); err != nil {
+			t.Fatal(err)
+		}
+		if want := dataBlocks(uint64(len(data)), bs); file.coreCache.NLocBlk != want {
+			t.Errorf("bs %d: %d data blocks not %d", bs, file.coreCache.NLocBlk, want)
+		}
+		file, err = fs.lookupPath("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("bs %d: content differs", bs)
+		}
+		report, err := Fsck(dev, FsckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Clean() {
+			t.Errorf("bs %d: fsck: %v", bs, report.Problems)
+		}
+		dev.Close()
+	}
+	if _, err := NewFileBlockDevice(filepath.Join(t.TempDir(), "bad.bin"), 16, 3000); err != ErrBadBlockSize {
+		t.Errorf("err is %v not %v", err, ErrBadBlockSize)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// MountOptions 是 mount -o 指定的挂载选项
+//   - 一部分交给 fuse.MountOptions（allow_other, fsname 以及不认识的选项）
+//   - 一部分影响 PoundFS 的行为（ro, uid, gid）
+type MountOptions struct {
+	ReadOnly   bool
+	AllowOther bool
+	Uid        *uint32 // 非空时，所有文件都显示为此用户所有
+	Gid        *uint32 // 非空时，所有文件都显示为此组所有
+	FsName     string
+	Extra      []string // 原样传给 fusermount 的其他选项
+	Force      bool     // 上次没有正常卸载时仍然读写挂载，由 mount -force 设置
+}
+
+// ParseMountOptions 解析形如 "ro,allow_other,uid=1000,fsname=img" 的选项字符串
+func ParseMountOptions(str string) (MountOptions, error) {
+	var opts MountOptions
+	for _, opt := range strings.Split(str, ",") {
+		if opt == "" {
+			continue
+		}
+		key, value, hasValue := strings.Cut(opt, "=")
+		switch key {
+		case "ro":
+			opts.ReadOnly = true
+		case "rw":
+			opts.ReadOnly = false
+		case "allow_other":
+			opts.AllowOther = true
+		case "uid", "gid":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if !hasValue || err != nil {
+				return opts, fmt.Errorf("invalid mount option %q", opt)
+			}
+			id32 := uint32(id)
+			if key == "uid" {
+				opts.Uid = &id32
+			} else {
+				opts.Gid = &id32
+			}
+		case "fsname":
+			if !hasValue || value == "" {
+				return opts, fmt.Errorf("invalid mount option %q", opt)
+			}
+			opts.FsName = value
+		default:
+			opts.Extra = append(opts.Extra, opt)
+		}
+	}
+	return opts, nil
+}
+
+// FuseOptions 转换为 go-fuse 的挂载选项
+func (opts MountOptions) FuseOptions(debug bool) *fuse.MountOptions {
+	fuseOpts := &fuse.MountOptions{
+		RememberInodes: true,
+		Debug:          debug,
+		AllowOther:     opts.AllowOther,
+		FsName:         opts.FsName,
+		Name:           "poundfs",
+		Options:        append([]string{}, opts.Extra...),
+	}
+	if opts.ReadOnly {
+		fuseOpts.Options = append(fuseOpts.Options, "ro")
+	}
+	return fuseOpts
+}
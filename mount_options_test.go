@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestParseMountOptions(t *testing.T) {
+	opts, err := ParseMountOptions("ro,allow_other,uid=1000,gid=100,fsname=img,default_permissions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.ReadOnly || !opts.AllowOther || opts.FsName != "img" {
+		t.Errorf("bad options %+v", opts)
+	}
+	if opts.Uid == nil || *opts.Uid != 1000 || opts.Gid == nil || *opts.Gid != 100 {
+		t.Errorf("bad uid/gid %+v", opts)
+	}
+	if len(opts.Extra) != 1 || opts.Extra[0] != "default_permissions" {
+		t.Errorf("bad extra options %v", opts.Extra)
+	}
+	fuseOpts := opts.FuseOptions(false)
+	if !fuseOpts.AllowOther || fuseOpts.FsName != "img" || len(fuseOpts.Options) != 2 {
+		t.Errorf("bad fuse options %+v", fuseOpts)
+	}
+	if _, err := ParseMountOptions("uid=abc"); err == nil {
+		t.Error("expected error for invalid uid")
+	}
+}
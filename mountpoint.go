@@ -1,37 +1,119 @@
 package main
 
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
 type MountPoint struct {
-	dev   BlockDevice
-	sb    *Superblock
-	AgCtx []*AgCtx
+	dev      BlockDevice
+	sb       *Superblock
+	AgCtx    []*AgCtx
+	ReadOnly bool   // 有不认识的 ro-compat 特性，只能只读访问
+	BackupAg uint32 // 主超级块损坏时所用副本的 AG，为 0 表示主超级块完好
+	dirRotor uint32 // 下一个新目录所在的 AG，见 agalloc.go
+	agsMu    sync.RWMutex // 保护 AgCtx 切片，在线扩容时独占，见 lock.go
 }
 
+// 主超级块中的文件系统状态。读写挂载时标记为 dirty，所有缓存写回后正常卸载时标记为 clean，
+// 所以挂载时看到 dirty 说明上次没有正常卸载（进程被杀死、掉电等）
+const (
+	SbStateClean = uint32(0)
+	SbStateDirty = uint32(1)
+)
+
 // NewMountPoint creates a new mount point.
-// 此方法会自动从磁盘加载数据，所以后续不必手动 Load
+// 此方法会自动从磁盘加载数据，所以后续不必手动 Load。
+// 版本或 incompat 特性不支持时返回错误。
+// 只加载，不修改超级块；读写挂载还需要调用 Mount。
+// 主超级块损坏时使用其他 AG 中的副本，见 sbbackup.go
 func NewMountPoint(dev BlockDevice) (*MountPoint, error) {
-	sb, err := loadSuperblock(dev)
+	sb, backup, err := loadSuperblockOrBackup(dev)
+	if err != nil {
+		return nil, err
+	}
+	readonly, err := checkFeatures(sb)
 	if err != nil {
 		return nil, err
 	}
+	dev = withFeatures(dev, sb)
 	agctx := make([]*AgCtx, sb.AgCount)
 	for i := uint32(0); i < sb.AgCount; i++ {
 		agctx[i] = NewAgCtx(dev, uint32(i), sb.AgBlocks)
-		agctx[i].Load()
+		if i == 0 && backup != 0 {
+			err = agctx[i].loadWithSuperblock(sb)
+		} else {
+			err = agctx[i].Load()
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &MountPoint{
-		dev:   dev,
-		sb:    sb,
-		AgCtx: agctx,
+		dev:      dev,
+		sb:       sb,
+		AgCtx:    agctx,
+		ReadOnly: readonly,
+		BackupAg: backup,
 	}, nil
 }
 
+// Dirty 表示上次挂载后没有正常卸载
+func (mp *MountPoint) Dirty() bool {
+	return mp.sb.State != SbStateClean
+}
+
+// Mount 开始一次读写挂载：更新挂载时间和次数，并把状态标记为 dirty。
+// 上次没有正常卸载时返回 ErrDirty，force 为 true 时忽略
+func (mp *MountPoint) Mount(force bool) error {
+	if mp.ReadOnly {
+		return ErrRoCompatFeature
+	}
+	if mp.Dirty() && !force {
+		return ErrDirty
+	}
+	mp.sb.MountCount++
+	mp.sb.MountTime = GetTimestampNsec()
+	mp.sb.State = SbStateDirty
+	if err := mp.SyncSuperblock(); err != nil {
+		return err
+	}
+	return syncDevice(mp.dev)
+}
+
+// Unmount 结束一次读写挂载，把状态标记为 clean。
+// 调用前必须已经写回所有缓存；超级块写入后再次 Sync，使 clean 状态落盘
+func (mp *MountPoint) Unmount() error {
+	mp.sb.State = SbStateClean
+	if err := mp.SyncSuperblock(); err != nil {
+		return err
+	}
+	return syncDevice(mp.dev)
+}
+
 // SyncSuperblock writes the superblock to the disk.
+// 同时记录写入时间
 func (mp *MountPoint) SyncSuperblock() error {
-	sbbytes, err := BytesOf(mp.sb)
+	return writePrimarySuperblock(mp.dev, mp.sb)
+}
+
+// writePrimarySuperblock 记录写入时间并写入主超级块
+func writePrimarySuperblock(dev BlockDevice, sb *Superblock) error {
+	sb.WriteTime = GetTimestampNsec()
+	sbbytes, err := BytesOf(sb)
 	if err != nil {
 		return err
 	}
-	return (mp.dev).WriteBlock(0, Pad(sbbytes, BlockSize))
+	return writeMetaBlock(dev, 0, sbbytes)
+}
+
+// syncDevice 让 dev 持久化已写入的数据，dev 不支持时什么也不做
+func syncDevice(dev BlockDevice) error {
+	if s, ok := dev.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
 }
 
 func (mp *MountPoint) GetSuperblock() Superblock {
@@ -60,27 +142,77 @@ func loadSuperblock(dev BlockDevice) (*Superblock, error) {
 	if err != nil {
 		return nil, err
 	}
+	if sb.FeatRoCompat&FeatRoCompatMetaCrc != 0 && !verifyMetaCrc(sbbytes) {
+		return nil, ErrBadChecksum
+	}
+	// 设备必须按超级块中记录的块大小访问
+	if sb.BlockSize != dev.GetBlockSize() {
+		return nil, ErrBadBlockSize
+	}
 	return &sb, nil
 }
 
+// AllocBlock 在 AG agno 中分配 nblock 个连续的块
 func (mp *MountPoint) AllocBlock(agno uint32, nblock uint64) (blockno uint64, err error) {
-	cntroot := mp.AgCtx[agno].Agf.Meta.CntRoot
-	btCtx := NewBtreeContext[uint64, DFreeBlockBtRec](mp.dev, uint64(cntroot))
-	rec, index, err := btCtx.GetFirstMeet(nblock)
-	if err != nil {
-		return 0, err
+	mp.agsMu.RLock()
+	defer mp.agsMu.RUnlock()
+	return mp.allocBlock(agno, nblock, false)
+}
+
+// allocBlock 同 AllocBlock，调用者持有 agsMu。inode 为 true 时第一块用作 inode，计入 AGI 的 inode 数
+func (mp *MountPoint) allocBlock(agno uint32, nblock uint64, inode bool) (blockno uint64, err error) {
+	if agno >= uint32(len(mp.AgCtx)) {
+		return 0, ErrOutOfRange
 	}
-	if rec == nil {
-		return 0, ErrNoSpace
+	ag := mp.AgCtx[agno]
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	blockno, err = newAgFreeSpace(ag).allocExtent(nblock)
+	if err != nil || !inode {
+		return blockno, err
+	}
+	ag.Agi.Meta.Count++
+	return blockno, ag.Agi.Sync()
+}
 
+// FreeBlocks 把 AG agno 中从 start 开始的 count 个块还给空闲空间树，与相邻的空闲区间合并。
+// 范围超出 AG 的数据区时返回 ErrOutOfRange，其中有已经空闲的块时返回 ErrDoubleFree
+func (mp *MountPoint) FreeBlocks(agno uint32, start uint64, count uint64) error {
+	return mp.freeBlocks(agno, start, count, false)
+}
+
+// FreeInode 回收从 inode 块 ino 开始的 nblock 个块，从所在 AG 的 inode 数中减去它
+func (mp *MountPoint) FreeInode(ino uint64, nblock uint64) error {
+	return mp.freeBlocks(mp.BlockAg(ino), ino, nblock, true)
+}
+
+func (mp *MountPoint) freeBlocks(agno uint32, start uint64, count uint64, inode bool) error {
+	mp.agsMu.RLock()
+	defer mp.agsMu.RUnlock()
+	// 损坏的区间列表或 inode 号可能指向最后一个 AG 之后
+	if agno >= uint32(len(mp.AgCtx)) {
+		return ErrOutOfRange
+	}
+	ag := mp.AgCtx[agno]
+	agStart := uint64(agno) * uint64(mp.sb.AgBlocks)
+	if count == 0 || start < agStart+AgHeaderBlocks || start+count > agStart+uint64(ag.Superblock.Meta.AgBlocks) {
+		return ErrOutOfRange
 	}
-	// 创建 inode
-	blockno = rec.StartBlock
-	defer func() {
-		rec.BlockCount -= nblock
-		rec.StartBlock += nblock
-		btCtx.SetByIndex(*rec, index)
-	}()
-	return
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if err := newAgFreeSpace(ag).addExtent(start, count); err != nil || !inode {
+		return err
+	}
+	// 旧镜像中没有记录 inode 数
+	if ag.Agi.Meta.Count == 0 {
+		logrus.Warnf("AG %d: inode count is already 0, run fsck to recount", agno)
+		return nil
+	}
+	ag.Agi.Meta.Count--
+	return ag.Agi.Sync()
+}
 
+// BlockAg 返回块所在的 AG
+func (mp *MountPoint) BlockAg(blkno uint64) uint32 {
+	return uint32(blkno / uint64(mp.sb.AgBlocks))
 }
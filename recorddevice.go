@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+)
+
+// WriteRecord 是记录下来的一次写入
+type WriteRecord struct {
+	Offset uint64 // 字节偏移
+	Data   []byte
+}
+
+// RecordingBlockDevice 原样转发所有操作，并按顺序记录每一次写入，
+// 用于在崩溃一致性测试中重放写入序列的任意前缀
+type RecordingBlockDevice struct {
+	mu  sync.Mutex
+	dev BlockDevice
+	log []WriteRecord
+}
+
+// NewRecordingBlockDevice 包装 dev 并开始记录
+func NewRecordingBlockDevice(dev BlockDevice) *RecordingBlockDevice {
+	return &RecordingBlockDevice{dev: dev}
+}
+
+func (r *RecordingBlockDevice) ReadBlock(blockno uint64) ([]byte, error) {
+	return r.dev.ReadBlock(blockno)
+}
+
+func (r *RecordingBlockDevice) WriteBlock(blockno uint64, data []byte) error {
+	if err := r.dev.WriteBlock(blockno, data); err != nil {
+		return err
+	}
+	r.record(blockno*uint64(r.dev.GetBlockSize()), data)
+	return nil
+}
+
+func (r *RecordingBlockDevice) Read(offset uint64, data []byte) error {
+	return r.dev.Read(offset, data)
+}
+
+func (r *RecordingBlockDevice) Write(offset uint64, data []byte) error {
+	if err := r.dev.Write(offset, data); err != nil {
+		return err
+	}
+	r.record(offset, data)
+	return nil
+}
+
+func (r *RecordingBlockDevice) GetTotalBlockCount() uint32 {
+	return r.dev.GetTotalBlockCount()
+}
+
+func (r *RecordingBlockDevice) GetBlockSize() uint32 {
+	return r.dev.GetBlockSize()
+}
+
+// Log 返回到目前为止记录的写入
+func (r *RecordingBlockDevice) Log() []WriteRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]WriteRecord(nil), r.log...)
+}
+
+// Reset 清空记录
+func (r *RecordingBlockDevice) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log = nil
+}
+
+func (r *RecordingBlockDevice) record(offset uint64, data []byte) {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log = append(r.log, WriteRecord{Offset: offset, Data: buf})
+}
+
+// ReplayWrites 在 base 镜像上依次应用 log 中的写入，得到写到一半时崩溃的镜像
+func ReplayWrites(base []byte, blocksize uint32, log []WriteRecord) (*MemBlockDevice, error) {
+	dev, err := NewMemBlockDevice(0, blocksize)
+	if err != nil {
+		return nil, err
+	}
+	if err = dev.Restore(base); err != nil {
+		return nil, err
+	}
+	for _, rec := range log {
+		if err = dev.Write(rec.Offset, rec.Data); err != nil {
+			return nil, err
+		}
+	}
+	return dev, nil
+}
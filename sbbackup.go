@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// 每个 AG 的第一块都是超级块的副本。主超级块（块 0）的 magic 或校验和损坏时，
+// 从其他 AG 的副本重建主超级块。副本中 AgBlocks 是该 AG 的真实大小，除最后一个 AG 外
+// 都等于 AG 的间隔；SeqNo 是 AG 编号，所以位于块 b 的副本满足 b = SeqNo * 间隔
+
+// loadSuperblockOrBackup 读取主超级块，主超级块损坏时改用副本重建。
+// backup 是所用副本所在的 AG，为 0 表示主超级块完好
+func loadSuperblockOrBackup(dev BlockDevice) (sb *Superblock, backup uint32, err error) {
+	sb, err = loadSuperblock(dev)
+	if err != ErrInvalidStructBytes && err != ErrBadChecksum {
+		return sb, 0, err
+	}
+	bak, agno, berr := findBackupSuperblock(dev)
+	if berr != nil {
+		logrus.Errorf("primary superblock is damaged (%v) and no backup found: %v", err, berr)
+		return nil, 0, err
+	}
+	logrus.Warnf("primary superblock is damaged (%v), using the backup in AG %d", err, agno)
+	return bak, agno, nil
+}
+
+// findBackupSuperblock 扫描设备寻找超级块副本，返回据此重建的主超级块和所用副本的 AG 编号。
+// 重建的超级块状态为 dirty：副本中没有维护挂载状态，无法知道上次是否正常卸载
+func findBackupSuperblock(dev BlockDevice) (*Superblock, uint32, error) {
+	total := uint64(dev.GetTotalBlockCount())
+	for blkno := uint64(MinAgBlocks); blkno < total; blkno++ {
+		sb, stride := probeBackupSuperblock(dev, blkno, 0)
+		if sb == nil {
+			continue
+		}
+		// 找到 AG 的间隔后比较所有副本：growfs 最后才更新旧 AG 的 AgCount，取 AgCount 最大的
+		best, bestAg := sb, sb.SeqNo
+		for agno := uint64(1); agno*stride < total; agno++ {
+			cand, _ := probeBackupSuperblock(dev, agno*stride, stride)
+			if cand != nil && cand.AgCount > best.AgCount {
+				best, bestAg = cand, cand.SeqNo
+			}
+		}
+		primary := *best
+		primary.SeqNo = 0
+		primary.AgBlocks = uint32(stride)
+		primary.State = SbStateDirty
+		return &primary, bestAg, nil
+	}
+	return nil, 0, ErrInvalidStructBytes
+}
+
+// probeBackupSuperblock 检查 blkno 处是否是一个完好的超级块副本，返回副本和 AG 的间隔。
+// stride 不为 0 时要求副本与之相符
+func probeBackupSuperblock(dev BlockDevice, blkno uint64, stride uint64) (*Superblock, uint64) {
+	data, err := dev.ReadBlock(blkno)
+	if err != nil || !CheckMagic(data[:4], SuperBlockMagicNum) {
+		return nil, 0
+	}
+	var sb Superblock
+	if err := StructOf(data, &sb); err != nil {
+		return nil, 0
+	}
+	if sb.SeqNo == 0 || sb.SeqNo >= sb.AgCount || blkno%uint64(sb.SeqNo) != 0 {
+		return nil, 0
+	}
+	s := blkno / uint64(sb.SeqNo)
+	if s < MinAgBlocks || (stride != 0 && s != stride) {
+		return nil, 0
+	}
+	// 只有最后一个 AG 的大小可以小于间隔
+	if uint64(sb.AgBlocks) != s && (sb.SeqNo != sb.AgCount-1 || uint64(sb.AgBlocks) > s) {
+		return nil, 0
+	}
+	if sb.BlockSize != dev.GetBlockSize() {
+		return nil, 0
+	}
+	if sb.FeatRoCompat&FeatRoCompatMetaCrc != 0 && !verifyMetaCrc(data) {
+		return nil, 0
+	}
+	// 紧随其后的 AGF 也必须属于同一个 AG，避免把文件内容误认为副本
+	agf := NewAgMetaCtx[Agf](withFeatures(dev, &sb), sb.SeqNo, uint32(s))
+	if err := agf.Load(); err != nil || agf.Meta.MagicNum != AgfMagicNum || agf.Meta.SeqNo != sb.SeqNo {
+		return nil, 0
+	}
+	return &sb, s
+}
+
+// loadWithSuperblock 和 Load 相同，但超级块使用 sb 而不从磁盘读取，用于主超级块损坏的 AG 0
+func (ctx *AgCtx) loadWithSuperblock(sb *Superblock) error {
+	copied := *sb
+	ctx.Superblock.Meta = &copied
+	if err := ctx.Agf.Load(); err != nil {
+		return err
+	}
+	if err := ctx.Agi.Load(); err != nil {
+		return err
+	}
+	return ctx.Agfl.Load()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupSuperblock(t *testing.T) {
+	// 2003 块，4 个 AG：501, 501, 501, 500
+	dev, err := NewMemBlockDevice(2003, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo, err := Makefs(dev, MkfsOptions{Label: "backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.mkdir(root, "dir", 0755, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	base := dev.Snapshot()
+
+	// 主超级块的 magic 损坏
+	if err = dev.WriteBlock(0, make([]byte, DefaultBlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadSuperblock(dev); err != ErrInvalidStructBytes {
+		t.Fatalf("err is %v not %v", err, ErrInvalidStructBytes)
+	}
+	sb, agno, err := findBackupSuperblock(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agno != 1 || sb.SeqNo != 0 || sb.AgBlocks != geo.AgBlocks || sb.AgCount != geo.AgCount ||
+		sb.UUID != geo.UUID || sb.LabelString() != "backup" {
+		t.Errorf("backup from AG %d: %+v", agno, sb)
+	}
+
+	// 不知道上次是否正常卸载，读写挂载需要 -force，只读挂载可以
+	if _, err = NewPoundFS(dev, MountOptions{}); err != ErrDirty {
+		t.Errorf("err is %v not %v", err, ErrDirty)
+	}
+	fs, err = NewPoundFS(dev, MountOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.mp.BackupAg != 1 {
+		t.Errorf("backup AG is %d", fs.mp.BackupAg)
+	}
+	if _, err = fs.lookupPath("/dir"); err != nil {
+		t.Errorf("lookup with backup superblock: %v", err)
+	}
+
+	// fsck 报告问题，-repair 重写主超级块
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Clean() {
+		t.Error("fsck did not report the damaged primary superblock")
+	}
+	if _, err = Fsck(dev, FsckOptions{Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Fsck(dev, FsckOptions{}); err != nil || !report.Clean() || report.Dirty {
+		t.Errorf("fsck after repair: %v %v", err, report)
+	}
+	if sb, err = loadSuperblock(dev); err != nil || sb.UUID != geo.UUID {
+		t.Errorf("primary after repair: %v %+v", err, sb)
+	}
+
+	// 扩容后的副本：旧 AG 的 AgCount 未更新时取最大的 AgCount
+	dev.Restore(base)
+	if _, err = Growfs(dev, 3000); err != nil {
+		t.Fatal(err)
+	}
+	agsb := NewAgMetaCtx[Superblock](dev, 1, geo.AgBlocks)
+	if err = agsb.Load(); err != nil {
+		t.Fatal(err)
+	}
+	agsb.Meta.AgCount = geo.AgCount
+	agsb.Dev = withFeatures(dev, agsb.Meta)
+	if err = agsb.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	flipByte(t, dev, 0, 0)
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.sb.AgCount != 6 || mp.BackupAg == 1 {
+		t.Errorf("agcount %d from backup in AG %d", mp.sb.AgCount, mp.BackupAg)
+	}
+
+	// 只有一个 AG 时没有副本
+	single, err := NewMemBlockDevice(MinAgBlocks, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(single, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	flipByte(t, single, 0, 0)
+	if _, err = NewMountPoint(single); err != ErrInvalidStructBytes {
+		t.Errorf("single AG: err is %v not %v", err, ErrInvalidStructBytes)
+	}
+}
+
+func TestBackupSuperblockBlockSize(t *testing.T) {
+	// 主超级块损坏时从副本中得到块大小，不能按默认的 512 字节扫描
+	path := filepath.Join(t.TempDir(), "image.bin")
+	dev, err := NewFileBlockDevice(path, 4096, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.WriteBlock(0, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	dev.Close()
+
+	if dev, err = OpenFileBlockDevice(path, true); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if dev.GetBlockSize() != 4096 || dev.GetTotalBlockCount() != 4096 {
+		t.Errorf("opened with block size %d, %d blocks", dev.GetBlockSize(), dev.GetTotalBlockCount())
+	}
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.BackupAg != 1 || mp.sb.BlockSize != 4096 {
+		t.Errorf("backup AG %d, block size %d", mp.BackupAg, mp.sb.BlockSize)
+	}
+}
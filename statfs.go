@@ -0,0 +1,67 @@
+package main
+
+import "github.com/sirupsen/logrus"
+
+// 空闲空间和 inode 的统计：每个 AG 的 AGF 记录空闲块数和最长的空闲区间，AGI 记录 inode 数，
+// 分配和释放时在 AG 锁内更新。statfs 把各个 AG 的计数加起来，不需要遍历空闲空间树。
+// 每个空闲块都可以用作新的 inode，所以空闲 inode 数包括空闲块数
+
+// FsStat 是整个文件系统的容量统计
+type FsStat struct {
+	Blocks     uint64 // 所有 AG 的块数，包括 AG 头部
+	FreeBlocks uint64 // 空闲空间树和 AGFL 中的块，AGFL 中的块多了会还给空闲空间树
+	Longest    uint64 // 最长的空闲区间，一次最多能分配的连续块数
+	Inodes     uint64 // 已使用的 inode 数，包括根目录
+	FreeInodes uint64
+}
+
+// Statfs 汇总各个 AG 中的计数
+func (mp *MountPoint) Statfs() FsStat {
+	mp.agsMu.RLock()
+	defer mp.agsMu.RUnlock()
+	st := FsStat{Inodes: 1}
+	for _, ag := range mp.AgCtx {
+		ag.mu.Lock()
+		st.Blocks += uint64(ag.Superblock.Meta.AgBlocks)
+		st.FreeBlocks += uint64(ag.Agf.Meta.FreeBlocks) + uint64(ag.Agfl.Meta.Count)
+		st.Longest = Max(st.Longest, uint64(ag.Agf.Meta.Longest))
+		st.Inodes += uint64(ag.Agi.Meta.Count)
+		st.FreeInodes += uint64(ag.Agi.Meta.FreeCount)
+		ag.mu.Unlock()
+	}
+	st.FreeInodes += st.FreeBlocks
+	return st
+}
+
+// checkCounters 挂载时用空闲空间树核对 AGF 中的计数，不一致时记录警告并改正，fix 为 true 时写回。
+// inode 数只能由 fsck 遍历目录树核对，这里只检查它不超过已使用的块数
+func (mp *MountPoint) checkCounters(fix bool) error {
+	for agno, ag := range mp.AgCtx {
+		fsp := newAgFreeSpace(ag)
+		recs, err := fsp.cntTree().Records()
+		if err != nil {
+			return err
+		}
+		var free, longest uint32
+		for _, rec := range recs {
+			free += uint32(rec.BlockCount)
+			longest = uint32(Max(uint64(longest), rec.BlockCount))
+		}
+		agf := ag.Agf.Meta
+		if agf.FreeBlocks != free || agf.Longest != longest {
+			logrus.Warnf("AG %d: AGF records %d free blocks (longest %d), free space tree has %d (longest %d)",
+				agno, agf.FreeBlocks, agf.Longest, free, longest)
+			agf.FreeBlocks, agf.Longest = free, longest
+			if fix {
+				if err := ag.Agf.Sync(); err != nil {
+					return err
+				}
+			}
+		}
+		data := ag.Superblock.Meta.AgBlocks - AgHeaderBlocks - ag.Agfl.Meta.Count
+		if free <= data && ag.Agi.Meta.Count > data-free {
+			logrus.Warnf("AG %d: AGI records %d inodes but only %d blocks are in use, run fsck", agno, ag.Agi.Meta.Count, data-free)
+		}
+	}
+	return nil
+}
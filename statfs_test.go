@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestStatFs(t *testing.T) {
+	// 10MB
+	blockcount := uint64(10 * 1024 * 1024 / DefaultBlockSize)
+	dev, err := NewMemBlockDevice(blockcount, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewPoundFS(dev, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statfs := func() fuse.StatfsOut {
+		var out fuse.StatfsOut
+		if code := fs.StatFs(nil, &fuse.InHeader{NodeId: RootIno}, &out); !code.Ok() {
+			t.Fatal(code)
+		}
+		return out
+	}
+	before := statfs()
+	if before.Blocks != blockcount || before.Bsize != DefaultBlockSize || before.NameLen != MaxNameLen {
+		t.Errorf("bad statfs %+v", before)
+	}
+	if before.Files-before.Ffree != 1 || before.Bavail != before.Bfree {
+		t.Errorf("fresh filesystem: %+v", before)
+	}
+
+	root, err := fs.lookupPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.createFile(root, "file", S_IFREG|0644, 0, 0, 0, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	after := statfs()
+	if used := before.Bfree - after.Bfree; used != 1+64*1024/DefaultBlockSize {
+		t.Errorf("file used %d blocks", used)
+	}
+	if after.Files-after.Ffree != 2 {
+		t.Errorf("%d inodes in use", after.Files-after.Ffree)
+	}
+	if err = fs.unlink(root, "file"); err != nil {
+		t.Fatal(err)
+	}
+	if got := statfs(); got.Bfree != before.Bfree || got.Files-got.Ffree != 1 {
+		t.Errorf("after unlink: %+v, want %+v", got, before)
+	}
+	if _, err = fs.mkdir(root, "dir", 0755, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Fatalf("fsck: %v %v", err, report.Problems)
+	}
+	base := dev.Snapshot()
+
+	// 挂载时改正 AGF 中错误的计数
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.AgCtx[1].Agf.Meta.FreeBlocks += 10
+	mp.AgCtx[1].Agf.Meta.Longest = 1
+	if err = mp.AgCtx[1].Agf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Fsck(dev, FsckOptions{}); err != nil || len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "AGF records") {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+	if fs, err = NewPoundFS(dev, MountOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := statfs(); got.Bfree != before.Bfree-1 {
+		t.Errorf("after mount: %d free blocks, want %d", got.Bfree, before.Bfree-1)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Fsck(dev, FsckOptions{}); err != nil || !report.Clean() {
+		t.Errorf("fsck after mount: %v %v", err, report.Problems)
+	}
+
+	// inode 数只能由 fsck 修复
+	dev.Restore(base)
+	if mp, err = NewMountPoint(dev); err != nil {
+		t.Fatal(err)
+	}
+	for _, ag := range mp.AgCtx {
+		ag.Agi.Meta.Count = 0
+		if err = ag.Agi.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if report, err = Fsck(dev, FsckOptions{}); err != nil || len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "AGI records 0 inodes, found 1") {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+	if _, err = Fsck(dev, FsckOptions{Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Fsck(dev, FsckOptions{}); err != nil || !report.Clean() {
+		t.Errorf("fsck after repair: %v %v", err, report.Problems)
+	}
+}
+
+func TestFailedAllocCounters(t *testing.T) {
+	// 分配失败前补充 AGFL 用掉的块也要记在 AGF 中
+	dev, err := NewMemBlockDevice(2048, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Makefs(dev, MkfsOptions{FreeSplit: 16}); err != nil {
+		t.Fatal(err)
+	}
+	mp, err := NewMountPoint(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := mp.Statfs().FreeBlocks
+	if _, err = mp.AllocBlock(1, 100); err != ErrNoSpace {
+		t.Errorf("err is %v not %v", err, ErrNoSpace)
+	}
+	if got := mp.Statfs().FreeBlocks; got != free {
+		t.Errorf("%d blocks free, was %d", got, free)
+	}
+	report, err := Fsck(dev, FsckOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("fsck: %v %v", err, report.Problems)
+	}
+}
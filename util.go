@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -100,6 +102,19 @@ func Min[T Ordered](nums ...T) T {
 	return min
 }
 
+func Max[T Ordered](nums ...T) T {
+	if len(nums) == 0 {
+		panic(ErrUnreachable)
+	}
+	max := nums[0]
+	for _, v := range nums[1:] {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
 func TimestampSecPart(ts uint64) uint64 {
 	return ts / 1000000000
 }
@@ -180,3 +195,49 @@ func PreviewBuffer(buf []byte, length int) string {
 	strHex := hex.EncodeToString(buf[:length])
 	return fmt.Sprintf("%s(%s)", str, strHex)
 }
+
+// ParseSize 解析形如 "512", "64K", "1G", "2GiB" 的容量字符串，单位按 1024 进位
+func ParseSize(str string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(str))
+	s = strings.TrimSuffix(s, "IB")
+	s = strings.TrimSuffix(s, "B")
+	shift := uint(0)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+		if shift != 0 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+	if n > (^uint64(0))>>shift {
+		return 0, fmt.Errorf("size %q overflows", str)
+	}
+	return n << shift, nil
+}
+
+// FormatSize 将字节数格式化为易读的字符串，如 "1.0 GiB"
+func FormatSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	v := float64(size)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
@@ -13,3 +13,25 @@ func TestGetTimestampNsec(t *testing.T) {
 func TestDecodeFlags(t *testing.T) {
 	println(Join(DecodeFlags(33152), "|"))
 }
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]uint64{
+		"512":  512,
+		"64K":  64 * 1024,
+		"1G":   1 << 30,
+		"1gib": 1 << 30,
+		"2MB":  2 << 20,
+	}
+	for in, want := range cases {
+		got, err := ParseSize(in)
+		if err != nil {
+			t.Errorf("ParseSize(%q): %v", in, err)
+		}
+		if got != want {
+			t.Errorf("ParseSize(%q) = %d, want %d", in, got, want)
+		}
+	}
+	if _, err := ParseSize("1X"); err == nil {
+		t.Error("expected error for invalid size")
+	}
+}